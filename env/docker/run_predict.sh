@@ -2,4 +2,4 @@
 
 /usr/bin/wait-for-it.sh 127.0.0.1:$REDIS_PORT -- echo "Redis (127.0.0.1:$REDIS_PORT) is up"
 
-./predict -redis-address=$REDIS_ADDRESS 
+./predict -redis_address=$REDIS_ADDRESS 
@@ -1,48 +1,35 @@
 package main
 
 import (
-	"bytes"
-	"encoding/json"
+	"context"
 	"flag"
 	"fmt"
+	commons "github.com/bbernhard/imagemonkey-playground/commons"
 	datastructures "github.com/bbernhard/imagemonkey-playground/datastructures"
+	exporter "github.com/bbernhard/imagemonkey-playground/exporter"
 	"github.com/garyburd/redigo/redis"
 	"github.com/getsentry/raven-go"
 	"github.com/gin-gonic/gin"
-	"github.com/gofrs/uuid"
 	log "github.com/sirupsen/logrus"
-	"github.com/yrsh/simplify-go"
-	"io"
 	"net/http"
 	"os"
+	"os/signal"
 	"strconv"
+	"strings"
+	"syscall"
 	"time"
 )
 
-func GetEnv(name string) string {
-	val, found := os.LookupEnv(name)
-	if found {
-		return val
-	}
-
-	return ""
-}
-
-func MustGetEnv(name string) string {
-	val := GetEnv(name)
-	if val == "" {
-		log.Fatal("Couldn't get env ", name)
-	}
-
-	return val
-}
+//response headers that browser clients are allowed to read
+const exposedHeaders = "Location, RateLimit-Limit, RateLimit-Remaining, RateLimit-Reset, Retry-After, X-Api-Quota-Limit, X-Api-Quota-Remaining"
 
 //CORS Middleware
 func CorsMiddleware(allowOrigin string) gin.HandlerFunc {
 	return func(c *gin.Context) {
 		c.Writer.Header().Set("Access-Control-Allow-Origin", allowOrigin)
-		c.Writer.Header().Set("Access-Control-Allow-Headers", "Content-Type, X-Requested-With, X-PINGOTHER, X-File-Name, Cache-Control")
+		c.Writer.Header().Set("Access-Control-Allow-Headers", "Content-Type, X-Requested-With, X-PINGOTHER, X-File-Name, Cache-Control, X-Api-Key")
 		c.Writer.Header().Set("Access-Control-Allow-Methods", "POST, OPTIONS, GET,    PUT, PATCH, HEAD")
+		c.Writer.Header().Set("Access-Control-Expose-Headers", exposedHeaders)
 
 		if c.Request.Method == "OPTIONS" {
 			c.AbortWithStatus(200)
@@ -55,54 +42,146 @@ func CorsMiddleware(allowOrigin string) gin.HandlerFunc {
 func main() {
 	log.SetLevel(log.DebugLevel)
 
-	releaseMode := flag.Bool("release", false, "Run in release mode")
-	redisAddress := flag.String("redis_address", ":6379", "Address to the Redis server")
-	redisMaxConnections := flag.Int("redis_max_connections", 50, "Max connections to Redis")
-	predictionsDir := flag.String("predictions_dir", "../predictions/", "Location of the temporary saved images for predictions")
-	donationsDir := flag.String("donations_dir", "../../imagemonkey-core/donations/", "Location of the uploaded and verified donations")
-	corsAllowOrigin := flag.String("cors_allow_origin", "*", "CORS Access-Control-Allow-Origin")
-	listenPort := flag.Int("listen_port", 8082, "Specify the listen port")
-	useSentry := flag.Bool("use_sentry", false, "Use Sentry for error logging")
-
-	flag.Parse()
-	if *releaseMode {
+	config := defaultConfig()
+
+	printConfig := flag.Bool("print_config", false, "Print the effective configuration (secrets redacted) and exit")
+	createApiKeyName := flag.String("create_api_key", "", "Create an api key with the given name, print it and exit")
+	apiKeyDailyQuota := flag.Int("api_key_daily_quota", 10000, "Max requests per day for the api key created with -create_api_key (0 = unlimited)")
+	apiKeyEndpoints := flag.String("api_key_endpoints", "", "Comma separated list of endpoints (predict, batch, grabcut, poll) the api key created with -create_api_key can access (empty = all)")
+	revokeApiKeyId := flag.String("revoke_api_key", "", "Revoke the api key with the given id and exit")
+
+	err := commons.LoadConfig(&config, flag.CommandLine, os.Args[1:])
+	if err != nil {
+		log.Fatal("[Main] Invalid configuration: ", err.Error())
+	}
+
+	if *printConfig {
+		err = commons.PrintConfig(os.Stdout, &config)
+		if err != nil {
+			log.Fatal("[Main] Couldn't print configuration: ", err.Error())
+		}
+		return
+	}
+
+	if config.Release {
 		fmt.Printf("[Main] Starting gin in release mode!\n")
 		gin.SetMode(gin.ReleaseMode)
 	}
 
-	if *useSentry {
+	if config.UseSentry {
 		fmt.Printf("Setting Sentry DSN\n")
-		sentryDsn := MustGetEnv("SENTRY_DSN")
 		raven.SetEnvironment("grabcut")
-		raven.SetDSN(sentryDsn)
+		raven.SetDSN(config.SentryDsn)
 
 		raven.CaptureMessage("Starting up playground-api worker", nil)
 	}
 
-	//creating predictions-dir if it not already exists
-	//as predicitions are temporary the directory might not already exist (e.q if predictions are stored in /tmp and server reboots)
-	if _, err := os.Stat(*predictionsDir); os.IsNotExist(err) {
-		log.Debug("[Main] Creating directory for predictions as it doesn't exist")
-		err := os.Mkdir(*predictionsDir, 0755)
-		if err != nil {
-			log.Debug("[Main] Couldn't create directory: ", err.Error())
-			os.Exit(1)
-		}
+	storage, err := commons.NewStorage(config.StorageConfig)
+	if err != nil {
+		log.Fatal("[Main] Couldn't create storage: ", err.Error())
 	}
 
 	redisPool := redis.NewPool(func() (redis.Conn, error) {
-		c, err := redis.Dial("tcp", *redisAddress)
+		c, err := redis.Dial("tcp", config.RedisAddress)
 
 		if err != nil {
 			return nil, err
 		}
 
 		return c, err
-	}, *redisMaxConnections)
+	}, config.RedisMaxConnections)
 	defer redisPool.Close()
 
+	if *createApiKeyName != "" || *revokeApiKeyId != "" {
+		os.Exit(runApiKeyCommand(redisPool, *createApiKeyName, *apiKeyDailyQuota, *apiKeyEndpoints, *revokeApiKeyId))
+	}
+
+	//closed once the server shuts down
+	shutdown := make(chan struct{})
+
+	webhooksStopped := make(chan struct{})
+	if config.UseWebhooks {
+		deliverer := NewWebhookDeliverer(config.WebhookSecret, config.WebhookMaxAttempts, time.Duration(config.WebhookInitialBackoff)*time.Second,
+			config.WebhookAllowPrivate)
+		go func() {
+			runWebhookDispatcher(redisPool, deliverer, config.WebhookWorkers, shutdown)
+			close(webhooksStopped)
+		}()
+	} else {
+		close(webhooksStopped)
+	}
+
+	if config.MetricsAddress != "" {
+		go serveMetrics(config.MetricsAddress)
+	}
+
+	go runQueueReaper(redisPool, storage, time.Duration(config.QueueReapInterval)*time.Second,
+		time.Duration(config.QueueOrphanTimeout)*time.Second, config.QueueMaxDeliveries)
+
+	router := setupRouter(redisPool, storage, config, shutdown)
+
+	if config.CorsAllowOrigin == "*" {
+		corsWarning := "CORS Access-Control-Allow-Origin is set to '*' - which is a potential security risk."
+		corsWarning += "DO NOT RUN THE SERVICE IN PRODUCTION WITH THIS CONFIGURATION!"
+		log.Info(corsWarning)
+	}
+
+	server := &http.Server{
+		Addr:    ":" + strconv.Itoa(config.ListenPort),
+		Handler: router,
+	}
+	server.RegisterOnShutdown(func() {
+		close(shutdown)
+	})
+
+	go func() {
+		err := server.ListenAndServe()
+		if err != nil && err != http.ErrServerClosed {
+			log.Fatal("[Main] Couldn't start server: ", err.Error())
+		}
+	}()
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT)
+	sig := <-signals
+
+	//stop accepting new requests and give the running ones some time to finish
+	log.Info("[Main] Received ", sig, " - shutting down")
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(config.ShutdownTimeout)*time.Second)
+	defer cancel()
+
+	err = server.Shutdown(ctx)
+	if err != nil {
+		log.Error("[Main] Couldn't shut down gracefully: ", err.Error())
+	}
+
+	//webhook attempts that don't finish in time are made again once their claim expired
+	select {
+	case <-webhooksStopped:
+	case <-ctx.Done():
+		log.Error("[Main] Couldn't finish the running webhook deliveries in time")
+	}
+}
+
+//setupRouter registers all routes. Long running requests (event streams) are
+//closed once shutdown is closed.
+func setupRouter(redisPool *redis.Pool, storage commons.Storage, config Config, shutdown <-chan struct{}) *gin.Engine {
+	proxies, _ := parseTrustedProxies(config.TrustedProxies) //already validated
+	predictRateLimiter := RateLimitMiddleware(redisPool, proxies, "predict", config.RateLimitPredict)
+	batchRateLimiter := RateLimitMiddleware(redisPool, proxies, "batch", config.RateLimitBatch)
+	grabcutRateLimiter := RateLimitMiddleware(redisPool, proxies, "grabcut", config.RateLimitGrabcut)
+	pollRateLimiter := RateLimitMiddleware(redisPool, proxies, "poll", config.RateLimitPoll)
+
+	predictApiKey := ApiKeyMiddleware(redisPool, "predict")
+	batchApiKey := ApiKeyMiddleware(redisPool, "batch")
+	grabcutApiKey := ApiKeyMiddleware(redisPool, "grabcut")
+	pollApiKey := ApiKeyMiddleware(redisPool, "poll")
+
+	routeNames := map[string]string{}
+
 	router := gin.Default()
-	router.Use(CorsMiddleware(*corsAllowOrigin))
+	router.Use(MetricsMiddleware(routeNames))
+	router.Use(CorsMiddleware(config.CorsAllowOrigin))
 
 	/*router.OPTIONS("/v1/predict", func(c *gin.Context) {
 		c.Writer.Header().Set("Access-Control-Allow-Origin", "*")
@@ -111,13 +190,15 @@ func main() {
 	    c.JSON(http.StatusOK, struct{}{})
 	})*/
 
-	router.POST("/v1/predict", func(c *gin.Context) {
+	router.POST("/v1/predict", predictApiKey, predictRateLimiter, func(c *gin.Context) {
 		/*	c.Writer.Header().Set("Access-Control-Allow-Origin", "*")
 		c.Writer.Header().Set("Access-Control-Allow-Headers", "Content-Type, X-Requested-With, X-PINGOTHER, X-File-Name, Cache-Control")
 		c.Writer.Header().Set("Access-Control-Allow-Methods", "POST, OPTIONS, GET, PUT")*/
-		c.Writer.Header().Set("Access-Control-Expose-Headers", "Location")
+		c.Writer.Header().Set("Access-Control-Expose-Headers", exposedHeaders)
 
-		classificationType := c.PostForm("classification_type")
+		if !parseUploadForm(c, (config.MaxUploadSize + multipartOverhead)) {
+			return
+		}
 
 		_, header, err := c.Request.FormFile("image")
 		if err != nil {
@@ -125,40 +206,23 @@ func main() {
 			return
 		}
 
-		u, err := uuid.NewV4()
-		if err != nil {
-			c.JSON(500, gin.H{"error": "Couldn't process request, please try again later!"})
+		if uploadErr := validateImageUpload(header, config.getUploadLimits()); uploadErr != nil {
+			c.JSON(uploadErr.Status, uploadErr.response())
 			return
 		}
 
-		uuid := u.String()
-		c.SaveUploadedFile(header, (*predictionsDir + uuid))
+		options, ok := getPredictionOptions(c, config)
+		if !ok {
+			return
+		}
 
 		redisConn := redisPool.Get()
 		defer redisConn.Close()
 
-		//add a prediction request to the REDIS 'predictme' queue
-		var predictionRequest datastructures.PredictionRequest
-		predictionRequest.Uuid = uuid
-		predictionRequest.Created = int64(time.Now().Unix())
-		predictionRequest.Filename = (*predictionsDir + uuid)
-
-		if classificationType == "nsfw" {
-			predictionRequest.Type = "nsfw-classification"
-		} else {
-			predictionRequest.Type = "classification"
-		}
-
-		serialized, err := json.Marshal(predictionRequest)
-		if err != nil {
-			log.Debug("[Predicting] Couldn't serialize request: ", err.Error())
-			c.JSON(500, gin.H{"error": "Couldn't accept request - please try again later"})
-			return
-		}
-
-		_, err = redisConn.Do("RPUSH", "predictme", serialized)
+		uuid, err := enqueuePrediction(redisConn, header, storage, options)
 		if err != nil {
 			log.Debug("[Predicting] Couldn't accept request: ", err.Error())
+			enqueueFailuresTotal.WithLabelValues(commons.GetPredictionQueue(options.Type).Name).Inc()
 			c.JSON(500, gin.H{"error": "Couldn't accept request - please try again later"})
 			return
 		}
@@ -167,7 +231,7 @@ func main() {
 		c.JSON(202, gin.H{})
 	})
 
-	router.GET("/v1/predict/:uuid", func(c *gin.Context) {
+	router.GET("/v1/predict/:uuid", pollApiKey, pollRateLimiter, func(c *gin.Context) {
 		/*c.Writer.Header().Set("Access-Control-Allow-Origin", "*")
 		  c.Writer.Header().Set("Access-Control-Allow-Headers", "Content-Type, X-Requested-With, X-PINGOTHER, X-File-Name, Cache-Control")
 		  c.Writer.Header().Set("Access-Control-Allow-Methods", "POST, OPTIONS, GET, PUT")*/
@@ -175,88 +239,124 @@ func main() {
 		uuid := c.Param("uuid")
 		key := "predict" + uuid
 
+		if !waitForJobIfRequested(c, redisPool, uuid, config.MaxWait) {
+			return
+		}
+
 		redisConn := redisPool.Get()
 		defer redisConn.Close()
 
-		ok, err := redis.Bool(redisConn.Do("EXISTS", key))
+		jobState, data, ok := getJobResult(c, redisConn, uuid, key)
+		if !ok { //response was already written
+			return
+		}
+
+		response, err := getPredictMeResponse(jobState, data)
 		if err != nil {
-			log.Debug("[Predicting] Couldn't check status of request: ", err.Error())
-			c.JSON(500, gin.H{"error": "Couldn't check status of request - please try again later"})
+			log.Debug("[Predicting] Couldn't unmarshal: ", err.Error())
+			c.JSON(500, gin.H{"error": "Couldn't get status of request - please try again later"})
 			return
 		}
 
-		if !ok { //nothing available yet. Which means either the uuid is wrong or processing isn't finished.
-			//at this point we don't care for the reason.
-			c.JSON(200, gin.H{})
+		c.JSON(http.StatusOK, response)
+	})
+
+	router.POST("/v1/batch/predict", batchApiKey, batchRateLimiter, func(c *gin.Context) {
+		c.Writer.Header().Set("Access-Control-Expose-Headers", exposedHeaders)
+
+		if !parseUploadForm(c, ((config.MaxUploadSize * int64(config.MaxBatchSize)) + multipartOverhead)) {
 			return
 		}
 
-		var data []byte
-		var predictionResult datastructures.PredictionResult
-		data, err = redis.Bytes(redisConn.Do("GET", key))
-		if err != nil {
-			log.Debug("[Predicting] Couldn't get status of request: ", err.Error())
-			c.JSON(500, gin.H{"error": "Couldn't get status of request - please try again later"})
+		form, err := c.MultipartForm()
+		if err != nil || len(form.File["image"]) == 0 {
+			c.JSON(400, gin.H{"error": "Pictures are missing"})
 			return
 		}
 
-		err = json.Unmarshal(data, &predictionResult)
-		if err != nil {
-			log.Debug("[Predicting] Couldn't unmarshal: ", err.Error())
-			c.JSON(500, gin.H{"error": "Couldn't get status of request - please try again later"})
+		headers := form.File["image"]
+		if len(headers) > config.MaxBatchSize {
+			c.JSON(422, gin.H{"error": ("Too many pictures - a batch can contain at most " + strconv.Itoa(config.MaxBatchSize))})
 			return
 		}
 
-		c.JSON(http.StatusOK, gin.H{"label": predictionResult.Result.Label, "score": predictionResult.Result.Score,
-			"model_info": predictionResult.ModelInfo})
-	})
+		//reject the whole batch, if one of the pictures is invalid
+		for _, header := range headers {
+			if uploadErr := validateImageUpload(header, config.getUploadLimits()); uploadErr != nil {
+				response := uploadErr.response()
+				response["filename"] = header.Filename
+				c.JSON(uploadErr.Status, response)
+				return
+			}
+		}
 
-	router.POST("/v1/grabcut", func(c *gin.Context) {
-		c.Writer.Header().Set("Access-Control-Expose-Headers", "Location")
+		options, ok := getPredictionOptions(c, config)
+		if !ok {
+			return
+		}
 
 		redisConn := redisPool.Get()
 		defer redisConn.Close()
 
-		file, _, err := c.Request.FormFile("image")
+		batch, err := enqueuePredictionBatch(redisConn, headers, storage, options)
 		if err != nil {
-			log.Debug("image is missing")
-			c.JSON(400, gin.H{"error": "Picture is missing"})
+			log.Debug("[Batch] Couldn't accept request: ", err.Error())
+			enqueueFailuresTotal.WithLabelValues(commons.GetPredictionQueue(options.Type).Name).Inc()
+			c.JSON(500, gin.H{"error": "Couldn't accept request - please try again later"})
 			return
 		}
 
-		imageUuid := c.PostForm("uuid")
-		if imageUuid == "" {
-			c.JSON(422, gin.H{"error": "Couldn't process request - parameters missing"})
+		c.Writer.Header().Set("Location", batch.Uuid)
+		c.JSON(202, gin.H{"uuid": batch.Uuid, "predictions": batch.Items})
+	})
+
+	router.GET("/v1/batch/predict/:uuid", pollApiKey, pollRateLimiter, func(c *gin.Context) {
+		redisConn := redisPool.Get()
+		defer redisConn.Close()
+
+		batch, found, err := getPredictionBatch(redisConn, c.Param("uuid"))
+		if err != nil {
+			log.Debug("[Batch] Couldn't get batch: ", err.Error())
+			c.JSON(500, gin.H{"error": "Couldn't get status of request - please try again later"})
 			return
 		}
 
-		buf := bytes.NewBuffer(nil)
-		if _, err := io.Copy(buf, file); err != nil {
-			c.JSON(500, gin.H{"error": "Couldn't process request - please try again later"})
+		if !found {
+			c.JSON(404, gin.H{"error": "Couldn't find request"})
 			return
 		}
 
-		u, err := uuid.NewV4()
+		response, err := getPredictionBatchResponse(redisConn, batch)
 		if err != nil {
-			c.JSON(500, gin.H{"error": "Couldn't process request - please try again later"})
+			log.Debug("[Batch] Couldn't get status of batch: ", err.Error())
+			c.JSON(500, gin.H{"error": "Couldn't get status of request - please try again later"})
 			return
 		}
 
-		var grabcutRequest datastructures.GrabcutRequest
-		grabcutRequest.Filename = (*donationsDir + imageUuid)
-		grabcutRequest.Mask = buf.Bytes()
-		grabcutRequest.Uuid = u.String()
+		c.JSON(http.StatusOK, response)
+	})
+
+	router.POST("/v1/grabcut", grabcutApiKey, grabcutRateLimiter, func(c *gin.Context) {
+		c.Writer.Header().Set("Access-Control-Expose-Headers", exposedHeaders)
 
-		serialized, err := json.Marshal(grabcutRequest)
+		params, ok := getGrabcutParams(c, config)
+		if !ok {
+			return
+		}
+
+		grabcutRequest, err := newGrabcutRequest(params, params.Mask)
 		if err != nil {
-			log.Debug("[Grabcutme] Couldn't serialize request: ", err.Error())
-			c.JSON(500, gin.H{"error": "Couldn't accept request - please try again later"})
+			c.JSON(500, gin.H{"error": "Couldn't process request - please try again later"})
 			return
 		}
 
-		_, err = redisConn.Do("RPUSH", "grabcutme", serialized)
+		redisConn := redisPool.Get()
+		defer redisConn.Close()
+
+		err = enqueueGrabcutRequest(redisConn, grabcutRequest)
 		if err != nil {
 			log.Debug("[Grabcutme] Couldn't accept request: ", err.Error())
+			enqueueFailuresTotal.WithLabelValues("grabcutme").Inc()
 			c.JSON(500, gin.H{"error": "Couldn't accept request - please try again later"})
 			return
 		}
@@ -265,68 +365,275 @@ func main() {
 		c.JSON(202, gin.H{})
 	})
 
-	router.GET("/v1/grabcut/:uuid", func(c *gin.Context) {
+	router.GET("/v1/grabcut/:uuid", pollApiKey, pollRateLimiter, func(c *gin.Context) {
 		//c.Writer.Header().Set("Access-Control-Allow-Origin", "*")
 		uuid := c.Param("uuid")
 		key := "grabcut" + uuid
 
+		format := c.DefaultQuery("format", "json")
+		if format != "json" && !exporter.IsSupportedFormat(format) {
+			c.JSON(422, gin.H{"error": ("Invalid format - needs to be json, " + strings.Join(exporter.Formats, ", "))})
+			return
+		}
+
+		if !waitForJobIfRequested(c, redisPool, uuid, config.MaxWait) {
+			return
+		}
+
 		redisConn := redisPool.Get()
 		defer redisConn.Close()
 
-		ok, err := redis.Bool(redisConn.Do("EXISTS", key))
+		jobState, data, ok := getJobResult(c, redisConn, uuid, key)
+		if !ok { //response was already written
+			return
+		}
+
+		response, err := getGrabcutMeResponse(jobState, data)
 		if err != nil {
-			log.Debug("[Grabcut] Couldn't check status of request: ", err.Error())
-			c.JSON(500, gin.H{"error": "Couldn't check status of request - please try again later"})
+			log.Debug("[Grabcut] Couldn't unmarshal: ", err.Error())
+			c.JSON(500, gin.H{"error": "Couldn't get status of request - please try again later"})
 			return
 		}
 
-		if !ok { //nothing available yet. Which means either the uuid is wrong or processing isn't finished.
-			//at this point we don't care for the reason.
-			c.JSON(200, gin.H{})
+		//failed requests are always reported in the default format
+		if _, failed := response["error"]; format == "json" || failed {
+			c.JSON(http.StatusOK, response)
 			return
 		}
 
-		var data []byte
-		var grabcutResult datastructures.GrabcutResult
-		data, err = redis.Bytes(redisConn.Do("GET", key))
+		exported, contentType, err := exporter.Export(format, response["result"].(datastructures.GrabcutMeResult))
+		if err == exporter.ErrImageTooLarge {
+			c.JSON(422, gin.H{"error": "Couldn't export result - the image is too large for " + format})
+			return
+		}
 		if err != nil {
-			log.Debug("[Grabcut] Couldn't get status of request: ", err.Error())
+			log.Debug("[Grabcut] Couldn't export result: ", err.Error())
 			c.JSON(500, gin.H{"error": "Couldn't get status of request - please try again later"})
 			return
 		}
+		c.Data(http.StatusOK, contentType, exported)
+	})
 
-		err = json.Unmarshal(data, &grabcutResult)
+	router.POST("/v1/grabcut-sessions", grabcutApiKey, grabcutRateLimiter, func(c *gin.Context) {
+		c.Writer.Header().Set("Access-Control-Expose-Headers", exposedHeaders)
+
+		params, ok := getGrabcutParams(c, config)
+		if !ok {
+			return
+		}
+
+		//the corrections of the following rounds are drawn on the mask
+		mask, err := decodeGrabcutMask(params.Mask, config.getUploadLimits())
 		if err != nil {
-			log.Debug("[Grabcut] Couldn't unmarshal: ", err.Error())
-			c.JSON(500, gin.H{"error": "Couldn't get status of request - please try again later"})
+			c.JSON(422, gin.H{"error": ("Invalid mask - " + err.Error())})
 			return
 		}
 
-		//simplify polyline
-		var grabcutMeResult datastructures.GrabcutMeResult
-		simplifiedDataPoints := simplifier.Simplify(grabcutResult.Points, 1.5, false)
-		for i, _ := range simplifiedDataPoints {
-			var item datastructures.GrabcutMeResultPoint
-			item.X = float32(simplifiedDataPoints[i][0])
-			item.Y = float32(simplifiedDataPoints[i][1])
-			grabcutMeResult.Points = append(grabcutMeResult.Points, item)
+		imageWidth, imageHeight, err := getImageSize(params.DonationPath)
+		if err != nil {
+			log.Debug("[Grabcut Session] Couldn't get size of donation: ", err.Error())
+			c.JSON(500, gin.H{"error": "Couldn't process request - please try again later"})
+			return
+		}
+		if mask.Bounds().Dx() > imageWidth || mask.Bounds().Dy() > imageHeight {
+			c.JSON(422, gin.H{"error": "Invalid mask - mask can't be bigger than the image"})
+			return
 		}
 
-		grabcutMeResult.Angle = 0
-		grabcutMeResult.Type = "polygon"
+		redisConn := redisPool.Get()
+		defer redisConn.Close()
 
-		if grabcutResult.Error == "" {
-			c.JSON(http.StatusOK, gin.H{"result": grabcutMeResult})
-		} else {
-			c.JSON(http.StatusOK, gin.H{"result": grabcutMeResult, "error": grabcutResult.Error})
+		session, err := createGrabcutSession(redisConn, params, mask)
+		if err != nil {
+			log.Debug("[Grabcut Session] Couldn't accept request: ", err.Error())
+			enqueueFailuresTotal.WithLabelValues("grabcutme").Inc()
+			c.JSON(500, gin.H{"error": "Couldn't accept request - please try again later"})
+			return
 		}
+
+		c.Writer.Header().Set("Location", session.Uuid)
+		c.JSON(202, gin.H{"uuid": session.Uuid, "round": 1, "job": session.Rounds[0].Uuid})
 	})
 
-	if *corsAllowOrigin == "*" {
-		corsWarning := "CORS Access-Control-Allow-Origin is set to '*' - which is a potential security risk."
-		corsWarning += "DO NOT RUN THE SERVICE IN PRODUCTION WITH THIS CONFIGURATION!"
-		log.Info(corsWarning)
+	router.POST("/v1/grabcut-sessions/:uuid/rounds", grabcutApiKey, grabcutRateLimiter, func(c *gin.Context) {
+		c.Writer.Header().Set("Access-Control-Expose-Headers", exposedHeaders)
+
+		if !parseUploadForm(c, (config.MaxUploadSize + multipartOverhead)) {
+			return
+		}
+
+		rawStrokes := c.PostForm("strokes")
+		if rawStrokes == "" {
+			c.JSON(400, gin.H{"error": "Strokes are missing"})
+			return
+		}
+
+		redisConn := redisPool.Get()
+		defer redisConn.Close()
+
+		//concurrent rounds would otherwise overwrite each other's corrections
+		session, found, err := watchGrabcutSession(redisConn, c.Param("uuid"))
+		if err != nil {
+			log.Debug("[Grabcut Session] Couldn't get session: ", err.Error())
+			c.JSON(500, gin.H{"error": "Couldn't process request - please try again later"})
+			return
+		}
+
+		if !found {
+			c.JSON(404, gin.H{"error": "Couldn't find session"})
+			return
+		}
+
+		if len(session.Rounds) >= maxGrabcutSessionRounds {
+			c.JSON(422, gin.H{"error": ("Too many rounds - a session can contain at most " + strconv.Itoa(maxGrabcutSessionRounds))})
+			return
+		}
+
+		donationPath, ok := getDonationPath(c, config.DonationsDir, session.Image)
+		if !ok {
+			return
+		}
+
+		imageWidth, imageHeight, err := getImageSize(donationPath)
+		if err != nil {
+			log.Debug("[Grabcut Session] Couldn't get size of donation: ", err.Error())
+			c.JSON(500, gin.H{"error": "Couldn't process request - please try again later"})
+			return
+		}
+
+		corrections, err := parseGrabcutCorrections(rawStrokes, imageWidth, imageHeight)
+		if err != nil {
+			c.JSON(422, gin.H{"error": ("Invalid strokes - " + err.Error())})
+			return
+		}
+
+		session, err = refineGrabcutSession(redisConn, session, donationPath, corrections, config.getUploadLimits())
+		if err == errGrabcutSessionConflict {
+			c.JSON(http.StatusConflict, gin.H{"error": "Couldn't accept request - the session was modified concurrently, please try again"})
+			return
+		}
+		if err != nil {
+			log.Debug("[Grabcut Session] Couldn't accept request: ", err.Error())
+			enqueueFailuresTotal.WithLabelValues("grabcutme").Inc()
+			c.JSON(500, gin.H{"error": "Couldn't accept request - please try again later"})
+			return
+		}
+
+		c.Writer.Header().Set("Location", session.Uuid)
+		c.JSON(202, gin.H{"uuid": session.Uuid, "round": len(session.Rounds), "job": session.Rounds[len(session.Rounds)-1].Uuid})
+	})
+
+	router.GET("/v1/grabcut-sessions/:uuid", pollApiKey, pollRateLimiter, func(c *gin.Context) {
+		redisConn := redisPool.Get()
+		defer redisConn.Close()
+
+		session, found, err := getGrabcutSession(redisConn, c.Param("uuid"))
+		if err != nil {
+			log.Debug("[Grabcut Session] Couldn't get session: ", err.Error())
+			c.JSON(500, gin.H{"error": "Couldn't get status of session - please try again later"})
+			return
+		}
+
+		if !found {
+			c.JSON(404, gin.H{"error": "Couldn't find session"})
+			return
+		}
+
+		response, err := getGrabcutSessionResponse(redisConn, session)
+		if err != nil {
+			log.Debug("[Grabcut Session] Couldn't get status of session: ", err.Error())
+			c.JSON(500, gin.H{"error": "Couldn't get status of session - please try again later"})
+			return
+		}
+
+		c.JSON(http.StatusOK, response)
+	})
+
+	router.GET("/v1/grabcut-sessions/:uuid/mask", pollApiKey, pollRateLimiter, func(c *gin.Context) {
+		redisConn := redisPool.Get()
+		defer redisConn.Close()
+
+		session, found, err := getGrabcutSession(redisConn, c.Param("uuid"))
+		if err != nil {
+			log.Debug("[Grabcut Session] Couldn't get session: ", err.Error())
+			c.JSON(500, gin.H{"error": "Couldn't get mask of session - please try again later"})
+			return
+		}
+
+		if !found {
+			c.JSON(404, gin.H{"error": "Couldn't find session"})
+			return
+		}
+
+		c.Data(http.StatusOK, "image/png", session.Mask)
+	})
+
+	router.GET("/v1/jobs/:uuid/events", pollApiKey, pollRateLimiter, func(c *gin.Context) {
+		streamJobEvents(c, redisPool, c.Param("uuid"), time.Duration(config.MaxEventStreamDuration)*time.Second, shutdown)
+	})
+
+	router.GET("/v1/jobs/:uuid/webhook", pollApiKey, pollRateLimiter, func(c *gin.Context) {
+		uuid := c.Param("uuid")
+
+		redisConn := redisPool.Get()
+		defer redisConn.Close()
+
+		_, found, err := commons.GetJobState(redisConn, uuid)
+		if err != nil {
+			log.Debug("[Webhooks] Couldn't get state of request: ", err.Error())
+			c.JSON(500, gin.H{"error": "Couldn't get delivery log - please try again later"})
+			return
+		}
+
+		if !found {
+			c.JSON(404, gin.H{"error": "Couldn't find request"})
+			return
+		}
+
+		attempts, err := getWebhookDeliveryLog(redisConn, uuid)
+		if err != nil {
+			log.Debug("[Webhooks] Couldn't get delivery log: ", err.Error())
+			c.JSON(500, gin.H{"error": "Couldn't get delivery log - please try again later"})
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{"attempts": attempts})
+	})
+
+	router.GET("/healthz", func(c *gin.Context) {
+		h, ok := getHealth(redisPool, false, time.Duration(config.WorkerHeartbeatTimeout)*time.Second)
+		writeHealth(c, h, ok)
+	})
+
+	router.GET("/readyz", func(c *gin.Context) {
+		h, ok := getHealth(redisPool, true, time.Duration(config.WorkerHeartbeatTimeout)*time.Second)
+		writeHealth(c, h, ok)
+	})
+
+	router.GET("/v1/openapi.json", func(c *gin.Context) {
+		c.Data(http.StatusOK, "application/json; charset=utf-8", []byte(openApiSpec))
+	})
+
+	if config.UseAdminApi {
+		router.GET("/v1/admin/apikeys", AdminMiddleware(config.AdminToken), func(c *gin.Context) {
+			redisConn := redisPool.Get()
+			defer redisConn.Close()
+
+			apiKeys, err := getApiKeysWithUsage(redisConn)
+			if err != nil {
+				log.Debug("[Admin] Couldn't get api keys: ", err.Error())
+				c.JSON(500, gin.H{"error": "Couldn't get api keys - please try again later"})
+				return
+			}
+
+			c.JSON(http.StatusOK, gin.H{"api_keys": apiKeys})
+		})
+	}
+
+	//needs to happen after all routes are registered
+	for name, path := range getRouteNames(router) {
+		routeNames[name] = path
 	}
 
-	router.Run(":" + strconv.Itoa(*listenPort))
+	return router
 }
@@ -0,0 +1,278 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/garyburd/redigo/redis"
+	"github.com/gin-gonic/gin"
+	log "github.com/sirupsen/logrus"
+	"strconv"
+	"strings"
+	"time"
+)
+
+//endpoints an api key can be restricted to (same names as the rate limiters)
+var apiKeyEndpoints = []string{"predict", "batch", "grabcut", "poll"}
+
+//usage counters are kept for two days, so that yesterday's usage is still available
+const apiKeyUsageExpiration = 2 * 86400
+
+type ApiKey struct {
+	Id            string `json:"id" redis:"id"`
+	Hash          string `json:"-" redis:"hash"`
+	Name          string `json:"name" redis:"name"`
+	DailyQuota    int    `json:"daily_quota" redis:"daily_quota"`
+	Endpoints     string `json:"endpoints" redis:"endpoints"`
+	Created       int64  `json:"created" redis:"created"`
+	Revoked       bool   `json:"revoked" redis:"revoked"`
+	TotalRequests int64  `json:"total_requests" redis:"total_requests"`
+}
+
+//IsEndpointAllowed returns true if the key can be used for the given endpoint. A key
+//without any endpoint restrictions can be used for all endpoints.
+func (k ApiKey) IsEndpointAllowed(endpoint string) bool {
+	if k.Endpoints == "" {
+		return true
+	}
+
+	for _, e := range strings.Split(k.Endpoints, ",") {
+		if e == endpoint {
+			return true
+		}
+	}
+	return false
+}
+
+func hashApiKey(key string) string {
+	hash := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(hash[:])
+}
+
+//the id is derived from the key, so that we can look up a key without storing it in plain text
+func getApiKeyId(hash string) string {
+	return hash[:16]
+}
+
+func getApiKeyUsageKey(id string, day time.Time) string {
+	return "apikeyusage" + id + day.UTC().Format("20060102")
+}
+
+//createApiKey creates a new api key and returns it. The key itself isn't stored,
+//so this is the only time it is available.
+func createApiKey(redisConn redis.Conn, name string, dailyQuota int, endpoints string) (string, ApiKey, error) {
+	var apiKey ApiKey
+
+	for _, endpoint := range strings.Split(endpoints, ",") {
+		if endpoint != "" && !isValidApiKeyEndpoint(endpoint) {
+			return "", apiKey, errors.New("invalid endpoint " + endpoint + " (valid: " + strings.Join(apiKeyEndpoints, ",") + ")")
+		}
+	}
+
+	buf := make([]byte, 32)
+	_, err := rand.Read(buf)
+	if err != nil {
+		return "", apiKey, err
+	}
+	key := hex.EncodeToString(buf)
+
+	apiKey.Hash = hashApiKey(key)
+	apiKey.Id = getApiKeyId(apiKey.Hash)
+	apiKey.Name = name
+	apiKey.DailyQuota = dailyQuota
+	apiKey.Endpoints = endpoints
+	apiKey.Created = time.Now().Unix()
+
+	redisConn.Send("MULTI")
+	redisConn.Send("HMSET", redis.Args{}.Add("apikey"+apiKey.Id).AddFlat(apiKey)...)
+	redisConn.Send("SADD", "apikeys", apiKey.Id)
+	_, err = redisConn.Do("EXEC")
+	return key, apiKey, err
+}
+
+func isValidApiKeyEndpoint(endpoint string) bool {
+	for _, e := range apiKeyEndpoints {
+		if e == endpoint {
+			return true
+		}
+	}
+	return false
+}
+
+//revokeApiKey revokes the api key with the given id. The key is kept, so that its usage is still visible.
+func revokeApiKey(redisConn redis.Conn, id string) error {
+	exists, err := redis.Bool(redisConn.Do("EXISTS", "apikey"+id))
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return errors.New("api key " + id + " doesn't exist")
+	}
+
+	_, err = redisConn.Do("HSET", "apikey"+id, "revoked", true)
+	return err
+}
+
+func getApiKeyById(redisConn redis.Conn, id string) (apiKey ApiKey, found bool, err error) {
+	values, err := redis.Values(redisConn.Do("HGETALL", "apikey"+id))
+	if err != nil || len(values) == 0 {
+		return apiKey, false, err
+	}
+
+	err = redis.ScanStruct(values, &apiKey)
+	return apiKey, err == nil, err
+}
+
+//getApiKey returns the api key for the (plain text) key
+func getApiKey(redisConn redis.Conn, key string) (apiKey ApiKey, found bool, err error) {
+	hash := hashApiKey(key)
+	apiKey, found, err = getApiKeyById(redisConn, getApiKeyId(hash))
+	if err != nil || !found {
+		return apiKey, false, err
+	}
+
+	if subtle.ConstantTimeCompare([]byte(apiKey.Hash), []byte(hash)) != 1 {
+		return apiKey, false, nil
+	}
+	return apiKey, true, nil
+}
+
+//getApiKeysWithUsage returns all api keys together with their usage of today and yesterday
+func getApiKeysWithUsage(redisConn redis.Conn) ([]gin.H, error) {
+	ids, err := redis.Strings(redisConn.Do("SMEMBERS", "apikeys"))
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	apiKeys := []gin.H{}
+	for _, id := range ids {
+		apiKey, found, err := getApiKeyById(redisConn, id)
+		if err != nil {
+			return nil, err
+		}
+		if !found {
+			continue
+		}
+
+		usage, err := redis.Ints(redisConn.Do("MGET", getApiKeyUsageKey(id, now), getApiKeyUsageKey(id, now.AddDate(0, 0, -1))))
+		if err != nil {
+			return nil, err
+		}
+
+		apiKeys = append(apiKeys, gin.H{"api_key": apiKey, "usage_today": usage[0], "usage_yesterday": usage[1]})
+	}
+
+	return apiKeys, nil
+}
+
+//ApiKeyMiddleware authenticates clients that send an X-Api-Key header and enforces the
+//key's endpoint restrictions and daily quota. Authenticated clients aren't subject to the
+//per-client rate limits. Requests without api key are passed on unchanged.
+func ApiKeyMiddleware(redisPool *redis.Pool, endpoint string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		key := c.GetHeader("X-Api-Key")
+		if key == "" {
+			c.Next()
+			return
+		}
+
+		redisConn := redisPool.Get()
+		defer redisConn.Close()
+
+		apiKey, found, err := getApiKey(redisConn, key)
+		if err != nil {
+			log.Error("[Api Key] Couldn't get api key: ", err.Error())
+			c.AbortWithStatusJSON(500, gin.H{"error": "Couldn't process request - please try again later"})
+			return
+		}
+
+		if !found || apiKey.Revoked {
+			c.AbortWithStatusJSON(401, gin.H{"error": "Invalid api key"})
+			return
+		}
+
+		if !apiKey.IsEndpointAllowed(endpoint) {
+			c.AbortWithStatusJSON(403, gin.H{"error": "Api key isn't allowed to access this endpoint"})
+			return
+		}
+
+		now := time.Now().UTC()
+		usageKey := getApiKeyUsageKey(apiKey.Id, now)
+		redisConn.Send("MULTI")
+		redisConn.Send("INCR", usageKey)
+		redisConn.Send("EXPIRE", usageKey, apiKeyUsageExpiration)
+		redisConn.Send("HINCRBY", "apikey"+apiKey.Id, "total_requests", 1)
+		values, err := redis.Values(redisConn.Do("EXEC"))
+		if err != nil {
+			log.Error("[Api Key] Couldn't increment usage: ", err.Error())
+			c.AbortWithStatusJSON(500, gin.H{"error": "Couldn't process request - please try again later"})
+			return
+		}
+
+		usage, err := redis.Int(values[0], nil)
+		if err != nil {
+			log.Error("[Api Key] Couldn't get usage: ", err.Error())
+			c.AbortWithStatusJSON(500, gin.H{"error": "Couldn't process request - please try again later"})
+			return
+		}
+
+		if apiKey.DailyQuota > 0 {
+			remaining := apiKey.DailyQuota - usage
+			if remaining < 0 {
+				remaining = 0
+			}
+			c.Writer.Header().Set("X-Api-Quota-Limit", strconv.Itoa(apiKey.DailyQuota))
+			c.Writer.Header().Set("X-Api-Quota-Remaining", strconv.Itoa(remaining))
+
+			if usage > apiKey.DailyQuota {
+				tomorrow := time.Date(now.Year(), now.Month(), now.Day()+1, 0, 0, 0, 0, time.UTC)
+				c.Writer.Header().Set("Retry-After", strconv.Itoa(int(tomorrow.Sub(now).Seconds())+1))
+				c.AbortWithStatusJSON(429, gin.H{"error": "Daily quota exceeded"})
+				return
+			}
+		}
+
+		c.Set("apiKey", apiKey.Id)
+		c.Next()
+	}
+}
+
+//AdminMiddleware only lets requests with the correct X-Admin-Token header pass
+func AdminMiddleware(adminToken string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		token := c.GetHeader("X-Admin-Token")
+		if subtle.ConstantTimeCompare([]byte(token), []byte(adminToken)) != 1 {
+			c.AbortWithStatusJSON(401, gin.H{"error": "Invalid admin token"})
+			return
+		}
+		c.Next()
+	}
+}
+
+//runApiKeyCommand creates or revokes an api key and returns the exit code
+func runApiKeyCommand(redisPool *redis.Pool, createName string, dailyQuota int, endpoints string, revokeId string) int {
+	redisConn := redisPool.Get()
+	defer redisConn.Close()
+
+	if revokeId != "" {
+		err := revokeApiKey(redisConn, revokeId)
+		if err != nil {
+			fmt.Printf("Couldn't revoke api key: %s\n", err.Error())
+			return 1
+		}
+		fmt.Printf("Revoked api key %s\n", revokeId)
+		return 0
+	}
+
+	key, apiKey, err := createApiKey(redisConn, createName, dailyQuota, endpoints)
+	if err != nil {
+		fmt.Printf("Couldn't create api key: %s\n", err.Error())
+		return 1
+	}
+	fmt.Printf("Created api key %s (id: %s) - store it safely, it can't be shown again\n", key, apiKey.Id)
+	return 0
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"github.com/garyburd/redigo/redis"
+	"github.com/gin-gonic/gin"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+)
+
+func TestApiKeyEndpointRestrictions(t *testing.T) {
+	unrestricted := ApiKey{}
+	for _, endpoint := range apiKeyEndpoints {
+		if !unrestricted.IsEndpointAllowed(endpoint) {
+			t.Errorf("expected unrestricted api key to be allowed to access %s", endpoint)
+		}
+	}
+
+	restricted := ApiKey{Endpoints: "predict,poll"}
+	if !restricted.IsEndpointAllowed("predict") || !restricted.IsEndpointAllowed("poll") {
+		t.Errorf("expected api key to be allowed to access predict and poll")
+	}
+	if restricted.IsEndpointAllowed("grabcut") || restricted.IsEndpointAllowed("pred") {
+		t.Errorf("expected api key to be restricted to predict and poll")
+	}
+}
+
+func TestApiKeyIdIsDerivedFromHash(t *testing.T) {
+	hash := hashApiKey("my-key")
+	if hash == hashApiKey("my-other-key") {
+		t.Fatalf("expected different keys to have different hashes")
+	}
+	if len(hash) != 64 || getApiKeyId(hash) != hash[:16] {
+		t.Errorf("unexpected hash %s / id %s", hash, getApiKeyId(hash))
+	}
+}
+
+func newApiKeyRouter(redisPool *redis.Pool, endpoint string) *gin.Engine {
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.GET("/", ApiKeyMiddleware(redisPool, endpoint), func(c *gin.Context) {
+		c.String(200, c.GetString("apiKey"))
+	})
+	return router
+}
+
+func doApiKeyRequest(router *gin.Engine, key string) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("GET", "/", nil)
+	if key != "" {
+		r.Header.Set("X-Api-Key", key)
+	}
+	router.ServeHTTP(w, r)
+	return w
+}
+
+func createTestApiKey(t *testing.T, redisPool *redis.Pool, dailyQuota int, endpoints string) (string, ApiKey) {
+	redisConn := redisPool.Get()
+	defer redisConn.Close()
+
+	key, apiKey, err := createApiKey(redisConn, "test", dailyQuota, endpoints)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key, apiKey
+}
+
+func TestApiKeyMiddlewareAuthenticates(t *testing.T) {
+	server, redisPool := newTestRedisPool(t)
+	defer server.Close()
+	defer redisPool.Close()
+
+	router := newApiKeyRouter(redisPool, "predict")
+	key, apiKey := createTestApiKey(t, redisPool, 0, "")
+
+	//requests without api key are passed on unauthenticated
+	if w := doApiKeyRequest(router, ""); w.Code != 200 || w.Body.String() != "" {
+		t.Errorf("expected request without api key to pass unauthenticated, got %d (%q)", w.Code, w.Body.String())
+	}
+
+	if w := doApiKeyRequest(router, key); w.Code != 200 || w.Body.String() != apiKey.Id {
+		t.Errorf("expected request to be authenticated as %s, got %d (%q)", apiKey.Id, w.Code, w.Body.String())
+	}
+
+	if w := doApiKeyRequest(router, "unknown"); w.Code != 401 {
+		t.Errorf("expected unknown api key to be rejected with 401, got %d", w.Code)
+	}
+
+	redisConn := redisPool.Get()
+	defer redisConn.Close()
+	if err := revokeApiKey(redisConn, apiKey.Id); err != nil {
+		t.Fatal(err)
+	}
+	if w := doApiKeyRequest(router, key); w.Code != 401 {
+		t.Errorf("expected revoked api key to be rejected with 401, got %d", w.Code)
+	}
+}
+
+func TestApiKeyMiddlewareRestrictsEndpoints(t *testing.T) {
+	server, redisPool := newTestRedisPool(t)
+	defer server.Close()
+	defer redisPool.Close()
+
+	key, _ := createTestApiKey(t, redisPool, 0, "poll")
+	if w := doApiKeyRequest(newApiKeyRouter(redisPool, "poll"), key); w.Code != 200 {
+		t.Errorf("expected api key to be allowed to access poll, got %d", w.Code)
+	}
+	if w := doApiKeyRequest(newApiKeyRouter(redisPool, "predict"), key); w.Code != 403 {
+		t.Errorf("expected api key to be rejected with 403 for predict, got %d", w.Code)
+	}
+}
+
+func TestApiKeyMiddlewareEnforcesQuota(t *testing.T) {
+	server, redisPool := newTestRedisPool(t)
+	defer server.Close()
+	defer redisPool.Close()
+
+	router := newApiKeyRouter(redisPool, "predict")
+	key, apiKey := createTestApiKey(t, redisPool, 2, "")
+	for i := 0; i < 2; i++ {
+		if w := doApiKeyRequest(router, key); w.Code != 200 || w.Header().Get("X-Api-Quota-Remaining") != strconv.Itoa(1-i) {
+			t.Fatalf("expected request %d to be allowed, got %d (remaining %q)", i+1, w.Code,
+				w.Header().Get("X-Api-Quota-Remaining"))
+		}
+	}
+
+	w := doApiKeyRequest(router, key)
+	if w.Code != 429 || w.Header().Get("X-Api-Quota-Remaining") != "0" || w.Header().Get("Retry-After") == "" {
+		t.Errorf("expected 429 with Retry-After once the quota is exceeded, got %d (Retry-After %q)", w.Code,
+			w.Header().Get("Retry-After"))
+	}
+
+	redisConn := redisPool.Get()
+	defer redisConn.Close()
+	stored, _, err := getApiKeyById(redisConn, apiKey.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stored.TotalRequests != 3 {
+		t.Errorf("expected 3 counted requests, got %d", stored.TotalRequests)
+	}
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"encoding/json"
+	commons "github.com/bbernhard/imagemonkey-playground/commons"
+	datastructures "github.com/bbernhard/imagemonkey-playground/datastructures"
+	"github.com/garyburd/redigo/redis"
+	"github.com/gin-gonic/gin"
+	"github.com/gofrs/uuid"
+	"mime/multipart"
+	"time"
+)
+
+//a batch is kept as long as the job states of its predictions
+const batchExpiration = 86400
+
+type batchProgress struct {
+	Total      int `json:"total"`
+	Queued     int `json:"queued"`
+	Processing int `json:"processing"`
+	Done       int `json:"done"`
+	Failed     int `json:"failed"`
+	Expired    int `json:"expired"`
+	Finished   int `json:"finished"`
+}
+
+//enqueuePredictionBatch adds a prediction request per image and groups them into a batch.
+//Either all predictions and the batch are queued or none of them.
+func enqueuePredictionBatch(redisConn redis.Conn, headers []*multipart.FileHeader, storage commons.Storage,
+	options predictionOptions) (datastructures.PredictionBatch, error) {
+	var batch datastructures.PredictionBatch
+
+	u, err := uuid.NewV4()
+	if err != nil {
+		return batch, err
+	}
+	batch.Uuid = u.String()
+	batch.Created = time.Now().Unix()
+
+	var predictionRequests []datastructures.PredictionRequest
+	removeImages := func() {
+		for _, predictionRequest := range predictionRequests {
+			storage.Delete(predictionRequest.Filename)
+		}
+	}
+
+	for _, header := range headers {
+		predictionRequest, err := storePrediction(header, storage, options)
+		if err != nil {
+			storage.Delete(predictionRequest.Filename)
+			removeImages()
+			return batch, err
+		}
+		predictionRequests = append(predictionRequests, predictionRequest)
+		batch.Items = append(batch.Items, datastructures.PredictionBatchItem{Uuid: predictionRequest.Uuid, Filename: header.Filename})
+	}
+
+	serialized, err := json.Marshal(batch)
+	if err != nil {
+		removeImages()
+		return batch, err
+	}
+
+	redisConn.Send("MULTI")
+	for _, predictionRequest := range predictionRequests {
+		err = sendPredictionRequest(redisConn, predictionRequest)
+		if err != nil {
+			redisConn.Do("DISCARD")
+			removeImages()
+			return batch, err
+		}
+	}
+	redisConn.Send("SETEX", ("batch" + batch.Uuid), batchExpiration, serialized)
+
+	_, err = redisConn.Do("EXEC")
+	if err != nil {
+		removeImages()
+	}
+	return batch, err
+}
+
+//getPredictionBatch returns the batch with the given uuid. found is false if there is no such batch.
+func getPredictionBatch(redisConn redis.Conn, batchUuid string) (batch datastructures.PredictionBatch, found bool, err error) {
+	data, err := redis.Bytes(redisConn.Do("GET", ("batch" + batchUuid)))
+	if err == redis.ErrNil {
+		return batch, false, nil
+	}
+	if err != nil {
+		return batch, false, err
+	}
+
+	err = json.Unmarshal(data, &batch)
+	return batch, err == nil, err
+}
+
+//getPredictionBatchResponse returns the state (and if available the result) of every
+//prediction in the batch, together with the aggregated progress.
+func getPredictionBatchResponse(redisConn redis.Conn, batch datastructures.PredictionBatch) (gin.H, error) {
+	var progress batchProgress
+	progress.Total = len(batch.Items)
+
+	items := []gin.H{}
+	for _, batchItem := range batch.Items {
+		item := gin.H{"uuid": batchItem.Uuid, "filename": batchItem.Filename}
+
+		jobState, found, err := commons.GetJobState(redisConn, batchItem.Uuid)
+		if err != nil {
+			return nil, err
+		}
+		if !found {
+			jobState.State = commons.JobStateExpired
+		}
+
+		if jobState.State == commons.JobStateDone || jobState.State == commons.JobStateFailed {
+			data, err := redis.Bytes(redisConn.Do("GET", getResultKey(commons.JobTypePrediction, batchItem.Uuid)))
+			if err == nil {
+				item["result"], err = getPredictMeResponse(jobState, data)
+				if err != nil {
+					return nil, err
+				}
+			} else if err == redis.ErrNil {
+				if jobState.State == commons.JobStateDone {
+					jobState.State = commons.JobStateExpired
+				}
+			} else {
+				return nil, err
+			}
+		}
+
+		switch jobState.State {
+		case commons.JobStateQueued:
+			progress.Queued++
+		case commons.JobStateProcessing:
+			progress.Processing++
+		case commons.JobStateDone:
+			progress.Done++
+		case commons.JobStateFailed:
+			progress.Failed++
+		case commons.JobStateExpired:
+			progress.Expired++
+		}
+		if commons.IsFinalJobState(jobState.State) {
+			progress.Finished++
+		}
+
+		item["state"] = jobState.State
+		if jobState.Error != "" {
+			item["error"] = jobState.Error
+		}
+		items = append(items, item)
+	}
+
+	return gin.H{"uuid": batch.Uuid, "created": batch.Created, "progress": progress, "predictions": items}, nil
+}
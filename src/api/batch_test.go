@@ -0,0 +1,120 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	commons "github.com/bbernhard/imagemonkey-playground/commons"
+	"github.com/garyburd/redigo/redis"
+	"io"
+	"io/ioutil"
+	"mime/multipart"
+	"os"
+	"strconv"
+	"testing"
+)
+
+//failingStorage fails to store the image with the given number
+type failingStorage struct {
+	commons.Storage
+	puts   int
+	failAt int
+}
+
+func (s *failingStorage) Put(key string, r io.Reader, size int64) error {
+	s.puts++
+	if s.puts == s.failAt {
+		return errors.New("storage unavailable")
+	}
+	return s.Storage.Put(key, r, size)
+}
+
+func getTestFileHeaders(t *testing.T, n int) []*multipart.FileHeader {
+	var body bytes.Buffer
+	writer := multipart.NewWriter(&body)
+	for i := 0; i < n; i++ {
+		part, err := writer.CreateFormFile("images", "image"+strconv.Itoa(i)+".jpg")
+		if err != nil {
+			t.Fatal(err)
+		}
+		part.Write([]byte("image"))
+	}
+	writer.Close()
+
+	form, err := multipart.NewReader(&body, writer.Boundary()).ReadForm(1024 * 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return form.File["images"]
+}
+
+func TestEnqueuePredictionBatch(t *testing.T) {
+	server, redisPool := newTestRedisPool(t)
+	defer server.Close()
+	defer redisPool.Close()
+
+	dir, err := ioutil.TempDir("", "batch")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	localStorage, err := commons.NewLocalStorage(dir + "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	redisConn := redisPool.Get()
+	defer redisConn.Close()
+
+	//nothing is queued if one of the images can't be stored
+	storage := &failingStorage{Storage: localStorage, failAt: 3}
+	_, err = enqueuePredictionBatch(redisConn, getTestFileHeaders(t, 3), storage, predictionOptions{Type: "classification", TopK: 1})
+	if err == nil {
+		t.Fatalf("expected the batch to fail")
+	}
+	keys, err := redis.Strings(redisConn.Do("KEYS", "*"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 0 {
+		t.Errorf("expected nothing to be queued, got %v", keys)
+	}
+	if files, _ := ioutil.ReadDir(dir); len(files) != 0 {
+		t.Errorf("expected the stored images to be removed, got %d images", len(files))
+	}
+
+	batch, err := enqueuePredictionBatch(redisConn, getTestFileHeaders(t, 3), localStorage, predictionOptions{Type: "classification", TopK: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	queued, _, err := commons.PredictionQueue.Len(redisConn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if queued != 3 {
+		t.Errorf("expected 3 queued predictions, got %d", queued)
+	}
+
+	stored, found, err := getPredictionBatch(redisConn, batch.Uuid)
+	if err != nil || !found || len(stored.Items) != 3 {
+		t.Fatalf("expected the batch with 3 items, got %+v (found %v, err %v)", stored, found, err)
+	}
+	for _, item := range stored.Items {
+		jobState, found, err := commons.GetJobState(redisConn, item.Uuid)
+		if err != nil || !found || jobState.State != commons.JobStateQueued {
+			t.Errorf("expected prediction %s to be queued, got %+v (found %v, err %v)", item.Uuid, jobState, found, err)
+		}
+	}
+	//every model has its own queue
+	_, err = enqueuePredictionBatch(redisConn, getTestFileHeaders(t, 2), localStorage, predictionOptions{Type: "nsfw-classification", TopK: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	queued, _, err = commons.NSFWPredictionQueue.Len(redisConn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if queued != 2 {
+		t.Errorf("expected 2 queued nsfw predictions, got %d", queued)
+	}
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"strings"
+)
+
+// trustedProxies are the reverse proxies (e.g. nginx) whose X-Forwarded-For and X-Real-Ip
+// headers we believe. The headers of everybody else are ignored, as a client could
+// otherwise pick any ip address (and e.g. bypass the rate limits).
+type trustedProxies []*net.IPNet
+
+// parseTrustedProxies parses a comma separated list of ip addresses and CIDR ranges
+func parseTrustedProxies(value string) (trustedProxies, error) {
+	var proxies trustedProxies
+	for _, entry := range strings.Split(value, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		if !strings.Contains(entry, "/") {
+			if ip := net.ParseIP(entry); ip != nil && ip.To4() != nil {
+				entry += "/32"
+			} else {
+				entry += "/128"
+			}
+		}
+
+		_, network, err := net.ParseCIDR(entry)
+		if err != nil {
+			return nil, err
+		}
+		proxies = append(proxies, network)
+	}
+	return proxies, nil
+}
+
+func (p trustedProxies) contains(ip net.IP) bool {
+	for _, network := range p {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// clientIp returns the ip address of the client. The forwarding headers are only used
+// if the request comes from a trusted proxy. X-Forwarded-For is read from the right, as
+// only the entries that were added by our proxies can be trusted.
+func (p trustedProxies) clientIp(r *http.Request) string {
+	remoteIp, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		remoteIp = r.RemoteAddr
+	}
+
+	ip := net.ParseIP(remoteIp)
+	if ip == nil || !p.contains(ip) {
+		return remoteIp
+	}
+
+	forwardedFor := strings.Split(r.Header.Get("X-Forwarded-For"), ",")
+	for i := len(forwardedFor) - 1; i >= 0; i-- {
+		forwardedIp := net.ParseIP(strings.TrimSpace(forwardedFor[i]))
+		if forwardedIp == nil {
+			break
+		}
+		if !p.contains(forwardedIp) {
+			return forwardedIp.String()
+		}
+	}
+
+	if realIp := net.ParseIP(strings.TrimSpace(r.Header.Get("X-Real-Ip"))); realIp != nil {
+		return realIp.String()
+	}
+	return remoteIp
+}
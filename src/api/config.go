@@ -0,0 +1,129 @@
+package main
+
+import (
+	"errors"
+	commons "github.com/bbernhard/imagemonkey-playground/commons"
+	"strings"
+)
+
+//Config contains the configuration of the api. Every value can be set in the config
+//file, with a PLAYGROUND_* environment variable or with a flag (see commons.LoadConfig).
+type Config struct {
+	Release                bool   `config:"release" help:"Run in release mode"`
+	RedisAddress           string `config:"redis_address" help:"Address to the Redis server"`
+	RedisMaxConnections    int    `config:"redis_max_connections" help:"Max connections to Redis"`
+	DonationsDir           string `config:"donations_dir" help:"Location of the uploaded and verified donations"`
+	CorsAllowOrigin        string `config:"cors_allow_origin" help:"CORS Access-Control-Allow-Origin"`
+	ListenPort             int    `config:"listen_port" help:"Specify the listen port"`
+	ShutdownTimeout        int    `config:"shutdown_timeout" help:"Max number of seconds to wait for running requests on shutdown"`
+	UseSentry              bool   `config:"use_sentry" help:"Use Sentry for error logging (needs sentry_dsn)"`
+	SentryDsn              string `config:"sentry_dsn" env:"SENTRY_DSN" secret:"true" help:"Sentry DSN"`
+	MaxTopK                int    `config:"max_top_k" help:"Max number of labels a client can request per prediction"`
+	MaxBatchSize           int    `config:"max_batch_size" help:"Max number of images per batch prediction"`
+	MaxUploadSize          int64  `config:"max_upload_size" help:"Max size (in bytes) of an uploaded picture"`
+	MaxImageDimension      int    `config:"max_image_dimension" help:"Max width/height (in pixels) of an uploaded picture"`
+	MaxImagePixels         int    `config:"max_image_pixels" help:"Max number of pixels of an uploaded picture"`
+	RateLimitPredict       int    `config:"rate_limit_predict" help:"Max predictions per minute and client (0 = unlimited)"`
+	RateLimitBatch         int    `config:"rate_limit_batch" help:"Max batch predictions per minute and client (0 = unlimited)"`
+	RateLimitGrabcut       int    `config:"rate_limit_grabcut" help:"Max grabcut requests per minute and client (0 = unlimited)"`
+	RateLimitPoll          int    `config:"rate_limit_poll" help:"Max result/status requests per minute and client (0 = unlimited)"`
+	TrustedProxies         string `config:"trusted_proxies" help:"Comma separated ip addresses/CIDR ranges of the reverse proxies whose X-Forwarded-For/X-Real-Ip headers are used"`
+	MaxWait                int    `config:"max_wait" help:"Max number of seconds a client can wait for a result"`
+	MaxEventStreamDuration int    `config:"max_event_stream_duration" help:"Max number of seconds a job event stream stays open"`
+	UseWebhooks            bool   `config:"use_webhooks" help:"Deliver results to the callback url of a request (needs webhook_secret)"`
+	WebhookSecret          string `config:"webhook_secret" env:"WEBHOOK_SECRET" secret:"true" help:"Secret the webhook payloads are signed with"`
+	WebhookMaxAttempts     int    `config:"webhook_max_attempts" help:"Max number of delivery attempts per webhook"`
+	WebhookInitialBackoff  int    `config:"webhook_initial_backoff" help:"Seconds to wait before the first webhook retry (doubles after every attempt)"`
+	WebhookWorkers         int    `config:"webhook_workers" help:"Max number of webhooks that are delivered concurrently"`
+	WebhookAllowPrivate    bool   `config:"webhook_allow_private" help:"Allow callback urls that point to loopback, private or link-local addresses (only for testing)"`
+	WorkerHeartbeatTimeout int    `config:"worker_heartbeat_timeout" help:"Seconds after which a worker without heartbeat is considered dead"`
+	QueueReapInterval      int    `config:"queue_reap_interval" help:"Seconds between two checks for jobs whose worker didn't finish them in time"`
+	QueueOrphanTimeout     int    `config:"queue_orphan_timeout" help:"Seconds a worker has for a job it took, but didn't lease (it died in between)"`
+	QueueMaxDeliveries     int    `config:"queue_max_deliveries" help:"Max number of times a job is handed to a worker, before it's marked as failed"`
+	UseAdminApi            bool   `config:"use_admin_api" help:"Enable the admin endpoints (needs admin_token)"`
+	AdminToken             string `config:"admin_token" env:"ADMIN_TOKEN" secret:"true" help:"Token that grants access to the admin endpoints"`
+	MetricsAddress         string `config:"metrics_address" help:"Address to serve the Prometheus metrics on, separate from the public api (empty = disabled)"`
+	commons.StorageConfig
+}
+
+func defaultConfig() Config {
+	return Config{
+		RedisAddress:           ":6379",
+		RedisMaxConnections:    50,
+		DonationsDir:           "../../imagemonkey-core/donations/",
+		CorsAllowOrigin:        "*",
+		ListenPort:             8082,
+		MetricsAddress:         ":9101",
+		ShutdownTimeout:        30,
+		MaxTopK:                10,
+		MaxBatchSize:           100,
+		MaxUploadSize:          5 * 1024 * 1024,
+		MaxImageDimension:      10000,
+		MaxImagePixels:         50000000,
+		RateLimitPredict:       30,
+		RateLimitBatch:         5,
+		RateLimitGrabcut:       30,
+		RateLimitPoll:          600,
+		TrustedProxies:         "127.0.0.1,::1",
+		MaxWait:                30,
+		MaxEventStreamDuration: 300,
+		WebhookMaxAttempts:     5,
+		WebhookInitialBackoff:  2,
+		WebhookWorkers:         10,
+		WorkerHeartbeatTimeout: 30,
+		QueueReapInterval:      30,
+		QueueOrphanTimeout:     300,
+		QueueMaxDeliveries:     3,
+		StorageConfig: commons.StorageConfig{
+			Storage:        commons.StorageTypeLocal,
+			PredictionsDir: "../predictions/",
+		},
+	}
+}
+
+//Validate returns an error that lists all invalid values
+func (c *Config) Validate() error {
+	var problems []string
+	check := func(ok bool, problem string) {
+		if !ok {
+			problems = append(problems, problem)
+		}
+	}
+
+	check(c.RedisAddress != "", "redis_address is required")
+	check(c.RedisMaxConnections >= 1, "redis_max_connections needs to be at least 1")
+	check(c.DonationsDir != "", "donations_dir is required")
+	check(c.ListenPort >= 1 && c.ListenPort <= 65535, "listen_port needs to be between 1 and 65535")
+	check(c.ShutdownTimeout >= 0, "shutdown_timeout can't be negative")
+	check(!c.UseSentry || c.SentryDsn != "", "sentry_dsn is required when use_sentry is set")
+	check(c.MaxTopK >= 1, "max_top_k needs to be at least 1")
+	check(c.MaxBatchSize >= 1, "max_batch_size needs to be at least 1")
+	check(c.MaxUploadSize >= 1, "max_upload_size needs to be at least 1")
+	check(c.MaxImageDimension >= 1, "max_image_dimension needs to be at least 1")
+	check(c.MaxImagePixels >= 1, "max_image_pixels needs to be at least 1")
+	check(c.RateLimitPredict >= 0 && c.RateLimitBatch >= 0 && c.RateLimitGrabcut >= 0 && c.RateLimitPoll >= 0,
+		"rate limits can't be negative")
+	_, err := parseTrustedProxies(c.TrustedProxies)
+	check(err == nil, "trusted_proxies needs to be a comma separated list of ip addresses/CIDR ranges")
+	check(c.MaxWait >= 0, "max_wait can't be negative")
+	check(c.MaxEventStreamDuration >= 1, "max_event_stream_duration needs to be at least 1")
+	check(!c.UseWebhooks || c.WebhookSecret != "", "webhook_secret is required when use_webhooks is set")
+	check(c.WebhookMaxAttempts >= 1, "webhook_max_attempts needs to be at least 1")
+	check(c.WebhookInitialBackoff >= 0, "webhook_initial_backoff can't be negative")
+	check(c.WebhookWorkers >= 1, "webhook_workers needs to be at least 1")
+	check(c.WorkerHeartbeatTimeout >= 1, "worker_heartbeat_timeout needs to be at least 1")
+	check(c.QueueReapInterval >= 1, "queue_reap_interval needs to be at least 1")
+	check(c.QueueOrphanTimeout >= 1, "queue_orphan_timeout needs to be at least 1")
+	check(c.QueueMaxDeliveries >= 1, "queue_max_deliveries needs to be at least 1")
+	check(!c.UseAdminApi || c.AdminToken != "", "admin_token is required when use_admin_api is set")
+	problems = append(problems, c.StorageConfig.Validate()...)
+
+	if len(problems) > 0 {
+		return errors.New(strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+func (c *Config) getUploadLimits() uploadLimits {
+	return uploadLimits{MaxSize: c.MaxUploadSize, MaxDimension: c.MaxImageDimension, MaxPixels: c.MaxImagePixels}
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+var errInvalidDonationId = errors.New("invalid donation id")
+var errDonationNotFound = errors.New("donation not found")
+
+//donation ids are either uuids or plain file names (e.g apple1.jpeg) - never paths
+var donationIdRegexp = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9_.-]{0,127}$`)
+
+//resolveDonation returns the path of the donation image with the given id. The
+//path is guaranteed to be inside donationsDir.
+func resolveDonation(donationsDir string, id string) (string, error) {
+	if !donationIdRegexp.MatchString(id) || strings.Contains(id, "..") {
+		return "", errInvalidDonationId
+	}
+
+	path := filepath.Join(donationsDir, id)
+	if filepath.Dir(path) != filepath.Clean(donationsDir) {
+		return "", errInvalidDonationId
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return "", errDonationNotFound
+		}
+		return "", err
+	}
+	if !info.Mode().IsRegular() {
+		return "", errDonationNotFound
+	}
+
+	return path, nil
+}
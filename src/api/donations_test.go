@@ -0,0 +1,42 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestResolveDonation(t *testing.T) {
+	dir, err := ioutil.TempDir("", "donations")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	err = ioutil.WriteFile(filepath.Join(dir, "apple1.jpeg"), []byte("image"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.Mkdir(filepath.Join(dir, "subdir"), 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	path, err := resolveDonation(dir+"/", "apple1.jpeg")
+	if err != nil || path != filepath.Join(dir, "apple1.jpeg") {
+		t.Errorf("expected donation to be resolved, got %q (%v)", path, err)
+	}
+
+	for _, id := range []string{"../../etc/passwd", "..", "/etc/passwd", "subdir/../apple1.jpeg", "apple1.jpeg\x00", ".hidden", "a..b"} {
+		if _, err = resolveDonation(dir, id); err != errInvalidDonationId {
+			t.Errorf("expected %q to be rejected, got %v", id, err)
+		}
+	}
+
+	for _, id := range []string{"not-existing.jpeg", "subdir", "ab1f8ab5-6e4a-4f3e-a2a4-1fdbfc4d4b3c"} {
+		if _, err = resolveDonation(dir, id); err != errDonationNotFound {
+			t.Errorf("expected %q to be not found, got %v", id, err)
+		}
+	}
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	commons "github.com/bbernhard/imagemonkey-playground/commons"
+	datastructures "github.com/bbernhard/imagemonkey-playground/datastructures"
+	"github.com/garyburd/redigo/redis"
+	"github.com/gin-gonic/gin"
+	log "github.com/sirupsen/logrus"
+	"time"
+)
+
+//interval in which we send a comment to keep proxies from closing idle event streams
+const eventStreamKeepAliveInterval = 15 * time.Second
+
+//streamJobEvents sends every state change of the job as server-sent event. Once the job
+//reached a final state, a 'result' event (same payload as the GET result endpoints) is
+//sent and the stream is closed. The stream is also closed once shutdown is closed.
+func streamJobEvents(c *gin.Context, redisPool *redis.Pool, uuid string, maxDuration time.Duration, shutdown <-chan struct{}) {
+	subscription, err := commons.SubscribeJobState(redisPool, uuid)
+	if err != nil {
+		log.Debug("[Events] Couldn't subscribe to job state: ", err.Error())
+		c.JSON(500, gin.H{"error": "Couldn't check status of request - please try again later"})
+		return
+	}
+	defer subscription.Close()
+
+	//get the state only after we've subscribed - otherwise we could miss a notification
+	redisConn := redisPool.Get()
+	jobState, found, err := commons.GetJobState(redisConn, uuid)
+	redisConn.Close()
+	if err != nil {
+		log.Debug("[Events] Couldn't get state of request: ", err.Error())
+		c.JSON(500, gin.H{"error": "Couldn't check status of request - please try again later"})
+		return
+	}
+
+	if !found {
+		c.JSON(404, gin.H{"error": "Couldn't find request"})
+		return
+	}
+
+	c.Writer.Header().Set("Content-Type", "text/event-stream")
+	c.Writer.Header().Set("Cache-Control", "no-cache")
+	c.Writer.Header().Set("X-Accel-Buffering", "no") //disable response buffering in nginx
+
+	if sendJobEvents(c, redisPool, jobState) {
+		return
+	}
+
+	keepAlive := time.NewTicker(eventStreamKeepAliveInterval)
+	defer keepAlive.Stop()
+	timeout := time.NewTimer(maxDuration)
+	defer timeout.Stop()
+
+	for {
+		select {
+		case notification, ok := <-subscription.C:
+			if !ok {
+				return
+			}
+
+			//notifications only contain the changed fields
+			jobState.State = notification.State
+			jobState.Error = notification.Error
+			jobState.Updated = notification.Updated
+			if sendJobEvents(c, redisPool, jobState) {
+				return
+			}
+		case <-keepAlive.C:
+			c.Writer.WriteString(": keepalive\n\n")
+			c.Writer.Flush()
+		case <-timeout.C:
+			return
+		case <-shutdown:
+			return
+		case <-c.Request.Context().Done(): //client went away
+			return
+		}
+	}
+}
+
+//sendJobEvents sends a 'state' event and - in case the job reached a final state -
+//a 'result' event. Returns true if there won't be any further events.
+func sendJobEvents(c *gin.Context, redisPool *redis.Pool, jobState datastructures.JobState) bool {
+	defer c.Writer.Flush()
+
+	if !commons.IsFinalJobState(jobState.State) || jobState.State == commons.JobStateExpired {
+		c.SSEvent("state", jobState)
+		return jobState.State == commons.JobStateExpired
+	}
+
+	redisConn := redisPool.Get()
+	defer redisConn.Close()
+
+	data, err := redis.Bytes(redisConn.Do("GET", getResultKey(jobState.Type, jobState.Uuid)))
+	if err == redis.ErrNil {
+		if jobState.State != commons.JobStateFailed {
+			jobState.State = commons.JobStateExpired
+		}
+		c.SSEvent("state", jobState)
+		return true
+	}
+	if err != nil {
+		log.Debug("[Events] Couldn't get result: ", err.Error())
+		c.SSEvent("error", gin.H{"error": "Couldn't get status of request - please try again later"})
+		return true
+	}
+
+	var response gin.H
+	if jobState.Type == commons.JobTypeGrabcut {
+		response, err = getGrabcutMeResponse(jobState, data)
+	} else {
+		response, err = getPredictMeResponse(jobState, data)
+	}
+	if err != nil {
+		log.Debug("[Events] Couldn't unmarshal: ", err.Error())
+		c.SSEvent("error", gin.H{"error": "Couldn't get status of request - please try again later"})
+		return true
+	}
+
+	c.SSEvent("state", jobState)
+	c.SSEvent("result", response)
+	return true
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	commons "github.com/bbernhard/imagemonkey-playground/commons"
+	datastructures "github.com/bbernhard/imagemonkey-playground/datastructures"
+	"github.com/garyburd/redigo/redis"
+	"github.com/gin-gonic/gin"
+	"github.com/gofrs/uuid"
+	log "github.com/sirupsen/logrus"
+	"io"
+)
+
+//grabcutParams are the parameters of a grabcut request, shared by single
+//requests and grabcut sessions
+type grabcutParams struct {
+	Image          string
+	DonationPath   string
+	Mask           []byte
+	CallbackUrl    string
+	Simplification *datastructures.GrabcutSimplification
+	PolygonOptions *datastructures.GrabcutPolygonOptions
+}
+
+//getGrabcutParams reads the parameters of a grabcut request. The mask is either uploaded
+//as PNG or drawn by us from the strokes or the bounding box. If the parameters are invalid,
+//the response is written and false is returned.
+func getGrabcutParams(c *gin.Context, config Config) (grabcutParams, bool) {
+	var params grabcutParams
+	var ok bool
+
+	if !parseUploadForm(c, (config.MaxUploadSize + multipartOverhead)) {
+		return params, false
+	}
+
+	file, _, err := c.Request.FormFile("image")
+	rawStrokes := c.PostForm("strokes")
+	hasBoundingBox := c.PostForm("x") != "" || c.PostForm("y") != "" || c.PostForm("width") != "" || c.PostForm("height") != ""
+	numMasks := 0
+	for _, hasMask := range []bool{err == nil, rawStrokes != "", hasBoundingBox} {
+		if hasMask {
+			numMasks++
+		}
+	}
+	if numMasks == 0 {
+		log.Debug("image is missing")
+		c.JSON(400, gin.H{"error": "Picture is missing"})
+		return params, false
+	}
+	if numMasks > 1 {
+		c.JSON(422, gin.H{"error": "Couldn't process request - either upload an image, strokes or a bounding box"})
+		return params, false
+	}
+
+	params.Image = c.PostForm("uuid")
+	if params.Image == "" {
+		c.JSON(422, gin.H{"error": "Couldn't process request - parameters missing"})
+		return params, false
+	}
+
+	params.DonationPath, ok = getDonationPath(c, config.DonationsDir, params.Image)
+	if !ok {
+		return params, false
+	}
+
+	params.CallbackUrl, ok = getCallbackUrl(c, config)
+	if !ok {
+		return params, false
+	}
+
+	params.Simplification, ok = getSimplificationOptions(c)
+	if !ok {
+		return params, false
+	}
+
+	params.PolygonOptions, ok = getPolygonOptions(c)
+	if !ok {
+		return params, false
+	}
+
+	if rawStrokes != "" || hasBoundingBox {
+		imageWidth, imageHeight, err := getImageSize(params.DonationPath)
+		if err != nil {
+			log.Debug("[Grabcutme] Couldn't get size of donation: ", err.Error())
+			c.JSON(500, gin.H{"error": "Couldn't process request - please try again later"})
+			return params, false
+		}
+
+		var strokes datastructures.GrabcutStrokes
+		if hasBoundingBox {
+			strokes, err = parseGrabcutBoundingBox(c.PostForm("x"), c.PostForm("y"), c.PostForm("width"),
+				c.PostForm("height"), c.PostForm("normalized"), imageWidth, imageHeight, config.getUploadLimits())
+			if err != nil {
+				c.JSON(422, gin.H{"error": ("Invalid bounding box - " + err.Error())})
+				return params, false
+			}
+		} else {
+			strokes, err = parseGrabcutStrokes(rawStrokes, imageWidth, imageHeight, config.getUploadLimits())
+			if err != nil {
+				c.JSON(422, gin.H{"error": ("Invalid strokes - " + err.Error())})
+				return params, false
+			}
+		}
+
+		params.Mask, err = getStrokesMask(strokes)
+		if err != nil {
+			log.Debug("[Grabcutme] Couldn't draw strokes: ", err.Error())
+			c.JSON(500, gin.H{"error": "Couldn't process request - please try again later"})
+			return params, false
+		}
+	} else {
+		buf := bytes.NewBuffer(nil)
+		if _, err := io.Copy(buf, file); err != nil {
+			c.JSON(500, gin.H{"error": "Couldn't process request - please try again later"})
+			return params, false
+		}
+		params.Mask = buf.Bytes()
+	}
+
+	return params, true
+}
+
+//getDonationPath returns the path of the donation with the given id. If there is no
+//such donation, the response is written and false is returned.
+func getDonationPath(c *gin.Context, donationsDir string, id string) (string, bool) {
+	donationPath, err := resolveDonation(donationsDir, id)
+	if err != nil {
+		switch err {
+		case errInvalidDonationId:
+			c.JSON(422, gin.H{"error": "Couldn't process request - invalid uuid"})
+		case errDonationNotFound:
+			c.JSON(404, gin.H{"error": "Couldn't process request - image not found"})
+		default:
+			log.Debug("[Grabcutme] Couldn't resolve donation: ", err.Error())
+			c.JSON(500, gin.H{"error": "Couldn't process request - please try again later"})
+		}
+		return "", false
+	}
+	return donationPath, true
+}
+
+//newGrabcutRequest returns the request for the grabcut worker with a new uuid
+func newGrabcutRequest(params grabcutParams, mask []byte) (datastructures.GrabcutRequest, error) {
+	var grabcutRequest datastructures.GrabcutRequest
+
+	u, err := uuid.NewV4()
+	if err != nil {
+		return grabcutRequest, err
+	}
+
+	grabcutRequest.Filename = params.DonationPath
+	grabcutRequest.Mask = mask
+	grabcutRequest.Uuid = u.String()
+	grabcutRequest.CallbackUrl = params.CallbackUrl
+	grabcutRequest.Simplification = params.Simplification
+	grabcutRequest.PolygonOptions = params.PolygonOptions
+	return grabcutRequest, nil
+}
+
+//sendGrabcutRequest sends the commands that create the job state and add the request
+//to the queue of the grabcut worker. Meant to be used within a transaction.
+func sendGrabcutRequest(redisConn redis.Conn, grabcutRequest datastructures.GrabcutRequest) error {
+	serialized, err := json.Marshal(grabcutRequest)
+	if err != nil {
+		return err
+	}
+
+	commons.SendCreateJobState(redisConn, grabcutRequest.Uuid, commons.JobTypeGrabcut, grabcutRequest.CallbackUrl)
+	return commons.GrabcutQueue.Send(redisConn, serialized)
+}
+
+//enqueueGrabcutRequest adds the request to the queue of the grabcut worker
+func enqueueGrabcutRequest(redisConn redis.Conn, grabcutRequest datastructures.GrabcutRequest) error {
+	redisConn.Send("MULTI")
+	err := sendGrabcutRequest(redisConn, grabcutRequest)
+	if err != nil {
+		redisConn.Do("DISCARD")
+		return err
+	}
+	_, err = redisConn.Do("EXEC")
+	return err
+}
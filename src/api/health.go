@@ -0,0 +1,86 @@
+package main
+
+import (
+	commons "github.com/bbernhard/imagemonkey-playground/commons"
+	"github.com/garyburd/redigo/redis"
+	"github.com/gin-gonic/gin"
+	"net/http"
+	"time"
+)
+
+type workerHealth struct {
+	Active        int   `json:"active"`
+	LastHeartbeat int64 `json:"last_heartbeat"`
+}
+
+type health struct {
+	Status     string                  `json:"status"`
+	Redis      string                  `json:"redis"`
+	Queues     map[string]int          `json:"queues,omitempty"`
+	Processing map[string]int          `json:"processing,omitempty"`
+	Workers    map[string]workerHealth `json:"workers,omitempty"`
+}
+
+//getHealth checks the connection to Redis and reports the length of the queues (and the
+//number of jobs the workers took from them, but didn't finish yet). If
+//checkWorkers is set, it also reports whether the workers sent a heartbeat within
+//heartbeatTimeout. Returns false if the service can't serve predictions.
+func getHealth(redisPool *redis.Pool, checkWorkers bool, heartbeatTimeout time.Duration) (health, bool) {
+	h := health{Status: "ok", Redis: "ok"}
+
+	redisConn := redisPool.Get()
+	defer redisConn.Close()
+
+	_, err := redisConn.Do("PING")
+	if err != nil {
+		h.Status = "unavailable"
+		h.Redis = err.Error()
+		return h, false
+	}
+
+	h.Queues = map[string]int{}
+	h.Processing = map[string]int{}
+	for _, queue := range []commons.ReliableQueue{commons.PredictionQueue, commons.NSFWPredictionQueue, commons.GrabcutQueue} {
+		queued, processing, err := queue.Len(redisConn)
+		if err != nil {
+			h.Status = "unavailable"
+			h.Redis = err.Error()
+			return h, false
+		}
+		h.Queues[queue.Name] = queued
+		h.Processing[queue.Name] = processing
+	}
+
+	if !checkWorkers {
+		return h, true
+	}
+
+	h.Workers = map[string]workerHealth{}
+	for _, jobType := range []string{commons.JobTypePrediction, commons.JobTypeGrabcut} {
+		active, lastHeartbeat, err := commons.GetWorkerStatus(redisConn, jobType, heartbeatTimeout)
+		if err != nil {
+			h.Status = "unavailable"
+			h.Redis = err.Error()
+			return h, false
+		}
+		h.Workers[jobType] = workerHealth{Active: active, LastHeartbeat: lastHeartbeat}
+	}
+
+	//without predict workers, predictions would stay queued forever. The grabcut
+	//worker is only reported, as predictions don't depend on it.
+	if h.Workers[commons.JobTypePrediction].Active == 0 {
+		h.Status = "unavailable"
+		return h, false
+	}
+
+	return h, true
+}
+
+func writeHealth(c *gin.Context, h health, ok bool) {
+	c.Writer.Header().Set("Cache-Control", "no-cache")
+	if !ok {
+		c.JSON(http.StatusServiceUnavailable, h)
+		return
+	}
+	c.JSON(http.StatusOK, h)
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	commons "github.com/bbernhard/imagemonkey-playground/commons"
+	datastructures "github.com/bbernhard/imagemonkey-playground/datastructures"
+	"github.com/garyburd/redigo/redis"
+	"github.com/gin-gonic/gin"
+	log "github.com/sirupsen/logrus"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+//getResultKey returns the key under which the worker stores the result of the job
+func getResultKey(jobType string, uuid string) string {
+	if jobType == commons.JobTypeGrabcut {
+		return "grabcut" + uuid
+	}
+	return "predict" + uuid
+}
+
+//waitForJobIfRequested blocks until the job reached a final state, in case the client
+//asked for it with the 'wait' query parameter (in seconds). If the parameter is invalid,
+//the response is written and false is returned.
+func waitForJobIfRequested(c *gin.Context, redisPool *redis.Pool, uuid string, maxWait int) bool {
+	if c.Query("wait") == "" {
+		return true
+	}
+
+	wait, err := strconv.Atoi(c.Query("wait"))
+	if err != nil || wait < 0 {
+		c.JSON(422, gin.H{"error": "Invalid wait - needs to be a positive number of seconds"})
+		return false
+	}
+
+	if wait > maxWait {
+		wait = maxWait
+	}
+
+	err = commons.WaitForFinalJobState(redisPool, uuid, time.Duration(wait)*time.Second)
+	if err != nil { //not fatal, we just answer with the current state
+		log.Debug("[Job] Couldn't wait for request: ", err.Error())
+	}
+
+	return true
+}
+
+//getJobResult fetches the result of the job with the given uuid. In case the result
+//isn't available (unknown job, job still in progress, result expired) the response
+//is written and ok is false. Otherwise the caller is responsible for the response.
+func getJobResult(c *gin.Context, redisConn redis.Conn, uuid string, resultKey string) (jobState datastructures.JobState, data []byte, ok bool) {
+	jobState, found, err := commons.GetJobState(redisConn, uuid)
+	if err != nil {
+		log.Debug("[Job] Couldn't get state of request: ", err.Error())
+		c.JSON(500, gin.H{"error": "Couldn't check status of request - please try again later"})
+		return jobState, nil, false
+	}
+
+	if !found {
+		c.JSON(404, gin.H{"error": "Couldn't find request"})
+		return jobState, nil, false
+	}
+
+	if !commons.IsFinalJobState(jobState.State) {
+		c.JSON(202, gin.H{"state": jobState.State})
+		return jobState, nil, false
+	}
+
+	if jobState.State == commons.JobStateExpired {
+		c.JSON(http.StatusGone, gin.H{"state": jobState.State})
+		return jobState, nil, false
+	}
+
+	data, err = redis.Bytes(redisConn.Do("GET", resultKey))
+	if err == redis.ErrNil {
+		if jobState.State == commons.JobStateFailed {
+			c.JSON(http.StatusOK, gin.H{"state": jobState.State, "error": jobState.Error})
+			return jobState, nil, false
+		}
+
+		//the result has a shorter lifetime than the job state, so we end up here if the result expired
+		err = commons.UpdateJobState(redisConn, uuid, commons.JobStateExpired, "")
+		if err != nil {
+			log.Debug("[Job] Couldn't mark request as expired: ", err.Error())
+		}
+		c.JSON(http.StatusGone, gin.H{"state": commons.JobStateExpired})
+		return jobState, nil, false
+	}
+	if err != nil {
+		log.Debug("[Job] Couldn't get status of request: ", err.Error())
+		c.JSON(500, gin.H{"error": "Couldn't get status of request - please try again later"})
+		return jobState, nil, false
+	}
+
+	return jobState, data, true
+}
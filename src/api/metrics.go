@@ -0,0 +1,85 @@
+package main
+
+import (
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	log "github.com/sirupsen/logrus"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+var (
+	httpRequestsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "playground_api_http_requests_total",
+		Help: "Number of handled HTTP requests",
+	}, []string{"route", "method", "status"})
+
+	httpRequestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "playground_api_http_request_duration_seconds",
+		Help:    "Time it took to handle a HTTP request",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"route", "method"})
+
+	enqueueFailuresTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "playground_api_enqueue_failures_total",
+		Help: "Number of jobs that couldn't be queued",
+	}, []string{"queue"})
+
+	requeuedJobsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "playground_api_requeued_jobs_total",
+		Help: "Number of jobs that were put back into their queue, as their worker didn't finish them in time",
+	}, []string{"queue"})
+
+	deadJobsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "playground_api_dead_jobs_total",
+		Help: "Number of jobs that were given up on after too many deliveries",
+	}, []string{"queue"})
+)
+
+func init() {
+	prometheus.MustRegister(httpRequestsTotal, httpRequestDuration, enqueueFailuresTotal, requeuedJobsTotal, deadJobsTotal)
+}
+
+//MetricsMiddleware counts the requests and measures their latency. As this version of gin
+//doesn't tell us which route matched, the route is looked up by the name of its handler
+//(routes maps handler names to paths and is filled once all routes are registered).
+//Requests that didn't match any route are reported as 'unmatched', so that random urls
+//don't blow up the number of time series.
+func MetricsMiddleware(routes map[string]string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		start := time.Now()
+		c.Next()
+
+		route, found := routes[c.HandlerName()]
+		if !found {
+			route = "unmatched"
+		}
+
+		httpRequestsTotal.WithLabelValues(route, c.Request.Method, strconv.Itoa(c.Writer.Status())).Inc()
+		httpRequestDuration.WithLabelValues(route, c.Request.Method).Observe(time.Since(start).Seconds())
+	}
+}
+
+//getRouteNames returns the path of every route, indexed by the name of its handler
+func getRouteNames(router *gin.Engine) map[string]string {
+	routes := map[string]string{}
+	for _, route := range router.Routes() {
+		routes[route.Handler] = route.Path
+	}
+	return routes
+}
+
+//serveMetrics exposes the metrics at http://<address>/metrics. They are served on their own
+//listener, so that they aren't reachable through the public api.
+func serveMetrics(address string) {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+
+	log.Info("[Metrics] Serving metrics on ", address)
+	err := http.ListenAndServe(address, mux)
+	if err != nil {
+		log.Error("[Metrics] Couldn't serve metrics: ", err.Error())
+	}
+}
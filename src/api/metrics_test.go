@@ -0,0 +1,27 @@
+package main
+
+import (
+	"github.com/gin-gonic/gin"
+	"testing"
+)
+
+func TestGetRouteNames(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	router := gin.New()
+	router.GET("/v1/predict/:uuid", func(c *gin.Context) {})
+	router.POST("/v1/predict", func(c *gin.Context) {})
+
+	routes := getRouteNames(router)
+	if len(routes) != 2 {
+		t.Fatalf("expected 2 routes, got %d", len(routes))
+	}
+
+	paths := map[string]bool{}
+	for _, path := range routes {
+		paths[path] = true
+	}
+	if !paths["/v1/predict/:uuid"] || !paths["/v1/predict"] {
+		t.Errorf("unexpected routes: %v", routes)
+	}
+}
@@ -0,0 +1,841 @@
+package main
+
+//OpenAPI 3 description of all routes, served at /v1/openapi.json. Keep it in sync
+//with setupRouter (openapi_test.go fails if a route is missing) and with the types in
+//the datastructures package.
+const openApiSpec = `{
+  "openapi": "3.0.2",
+  "info": {
+    "title": "ImageMonkey Playground API",
+    "description": "Image classification and grabcut based image segmentation. All jobs are processed asynchronously: a POST request queues the job and returns its uuid in the Location header, the result can be polled, streamed or delivered to a callback url.",
+    "version": "1.0.0"
+  },
+  "tags": [
+    {"name": "predict", "description": "Image classification"},
+    {"name": "grabcut", "description": "Image segmentation"},
+    {"name": "jobs", "description": "State of queued jobs"},
+    {"name": "health", "description": "Health of the service"},
+    {"name": "admin", "description": "Administration (only available if the api runs with -use_admin_api)"}
+  ],
+  "paths": {
+    "/v1/predict": {
+      "post": {
+        "tags": ["predict"],
+        "summary": "Queue a prediction",
+        "security": [{}, {"ApiKey": []}],
+        "requestBody": {
+          "required": true,
+          "content": {
+            "multipart/form-data": {
+              "schema": {"$ref": "#/components/schemas/PredictionRequest"}
+            }
+          }
+        },
+        "responses": {
+          "202": {"$ref": "#/components/responses/Accepted"},
+          "400": {"$ref": "#/components/responses/Error"},
+          "401": {"$ref": "#/components/responses/Error"},
+          "403": {"$ref": "#/components/responses/Error"},
+          "413": {"$ref": "#/components/responses/UploadError"},
+          "415": {"$ref": "#/components/responses/UploadError"},
+          "422": {"$ref": "#/components/responses/UploadError"},
+          "429": {"$ref": "#/components/responses/TooManyRequests"},
+          "500": {"$ref": "#/components/responses/Error"}
+        }
+      }
+    },
+    "/v1/predict/{uuid}": {
+      "get": {
+        "tags": ["predict"],
+        "summary": "Get the result of a prediction",
+        "security": [{}, {"ApiKey": []}],
+        "parameters": [
+          {"$ref": "#/components/parameters/Uuid"},
+          {"$ref": "#/components/parameters/Wait"}
+        ],
+        "responses": {
+          "200": {
+            "description": "Prediction finished (successfully or not)",
+            "content": {
+              "application/json": {
+                "schema": {"$ref": "#/components/schemas/PredictMeResult"}
+              }
+            }
+          },
+          "202": {"$ref": "#/components/responses/InProgress"},
+          "401": {"$ref": "#/components/responses/Error"},
+          "403": {"$ref": "#/components/responses/Error"},
+          "404": {"$ref": "#/components/responses/Error"},
+          "410": {"$ref": "#/components/responses/Expired"},
+          "422": {"$ref": "#/components/responses/Error"},
+          "429": {"$ref": "#/components/responses/TooManyRequests"},
+          "500": {"$ref": "#/components/responses/Error"}
+        }
+      }
+    },
+    "/v1/batch/predict": {
+      "post": {
+        "tags": ["predict"],
+        "summary": "Queue a prediction for every uploaded picture",
+        "security": [{}, {"ApiKey": []}],
+        "requestBody": {
+          "required": true,
+          "content": {
+            "multipart/form-data": {
+              "schema": {"$ref": "#/components/schemas/PredictionBatchRequest"}
+            }
+          }
+        },
+        "responses": {
+          "202": {
+            "description": "Batch accepted, the Location header contains the uuid of the batch",
+            "headers": {"Location": {"$ref": "#/components/headers/Location"}},
+            "content": {
+              "application/json": {
+                "schema": {
+                  "type": "object",
+                  "properties": {
+                    "uuid": {"type": "string", "format": "uuid"},
+                    "predictions": {"type": "array", "items": {"$ref": "#/components/schemas/PredictionBatchItem"}}
+                  }
+                }
+              }
+            }
+          },
+          "400": {"$ref": "#/components/responses/Error"},
+          "401": {"$ref": "#/components/responses/Error"},
+          "403": {"$ref": "#/components/responses/Error"},
+          "413": {"$ref": "#/components/responses/UploadError"},
+          "415": {"$ref": "#/components/responses/UploadError"},
+          "422": {"$ref": "#/components/responses/UploadError"},
+          "429": {"$ref": "#/components/responses/TooManyRequests"},
+          "500": {"$ref": "#/components/responses/Error"}
+        }
+      }
+    },
+    "/v1/batch/predict/{uuid}": {
+      "get": {
+        "tags": ["predict"],
+        "summary": "Get the progress and the results of a batch prediction",
+        "security": [{}, {"ApiKey": []}],
+        "parameters": [{"$ref": "#/components/parameters/Uuid"}],
+        "responses": {
+          "200": {
+            "description": "State of the batch",
+            "content": {
+              "application/json": {
+                "schema": {"$ref": "#/components/schemas/PredictionBatchResult"}
+              }
+            }
+          },
+          "401": {"$ref": "#/components/responses/Error"},
+          "403": {"$ref": "#/components/responses/Error"},
+          "404": {"$ref": "#/components/responses/Error"},
+          "429": {"$ref": "#/components/responses/TooManyRequests"},
+          "500": {"$ref": "#/components/responses/Error"}
+        }
+      }
+    },
+    "/v1/grabcut": {
+      "post": {
+        "tags": ["grabcut"],
+        "summary": "Queue a grabcut request",
+        "security": [{}, {"ApiKey": []}],
+        "requestBody": {
+          "required": true,
+          "content": {
+            "multipart/form-data": {
+              "schema": {"$ref": "#/components/schemas/GrabcutRequest"}
+            }
+          }
+        },
+        "responses": {
+          "202": {"$ref": "#/components/responses/Accepted"},
+          "400": {"$ref": "#/components/responses/Error"},
+          "401": {"$ref": "#/components/responses/Error"},
+          "403": {"$ref": "#/components/responses/Error"},
+          "404": {"$ref": "#/components/responses/Error"},
+          "413": {"$ref": "#/components/responses/UploadError"},
+          "422": {"$ref": "#/components/responses/Error"},
+          "429": {"$ref": "#/components/responses/TooManyRequests"},
+          "500": {"$ref": "#/components/responses/Error"}
+        }
+      }
+    },
+    "/v1/grabcut/{uuid}": {
+      "get": {
+        "tags": ["grabcut"],
+        "summary": "Get the result of a grabcut request",
+        "security": [{}, {"ApiKey": []}],
+        "parameters": [
+          {"$ref": "#/components/parameters/Uuid"},
+          {"$ref": "#/components/parameters/Wait"},
+          {
+            "name": "format",
+            "in": "query",
+            "required": false,
+            "description": "Format of the result. Failed requests are always reported as json. coco can't represent holes, use coco-rle for a mask of the whole image (images with more than 100000000 pixels are refused with 422).",
+            "schema": {"type": "string", "enum": ["json", "geojson", "coco", "coco-rle", "svg"], "default": "json"}
+          }
+        ],
+        "responses": {
+          "200": {
+            "description": "Grabcut request finished (successfully or not)",
+            "content": {
+              "application/json": {
+                "schema": {
+                  "oneOf": [
+                    {"$ref": "#/components/schemas/GrabcutResponse"},
+                    {"$ref": "#/components/schemas/COCOAnnotation"}
+                  ]
+                }
+              },
+              "application/geo+json": {
+                "schema": {"$ref": "#/components/schemas/GeoJSONFeature"}
+              },
+              "image/svg+xml": {
+                "schema": {"type": "string"}
+              }
+            }
+          },
+          "202": {"$ref": "#/components/responses/InProgress"},
+          "401": {"$ref": "#/components/responses/Error"},
+          "403": {"$ref": "#/components/responses/Error"},
+          "404": {"$ref": "#/components/responses/Error"},
+          "410": {"$ref": "#/components/responses/Expired"},
+          "422": {"$ref": "#/components/responses/Error"},
+          "429": {"$ref": "#/components/responses/TooManyRequests"},
+          "500": {"$ref": "#/components/responses/Error"}
+        }
+      }
+    },
+    "/v1/grabcut-sessions": {
+      "post": {
+        "tags": ["grabcut"],
+        "summary": "Start a grabcut session, which can be refined with corrections afterwards",
+        "description": "Takes the same parameters as /v1/grabcut, the first round is queued right away",
+        "security": [{}, {"ApiKey": []}],
+        "requestBody": {
+          "required": true,
+          "content": {
+            "multipart/form-data": {
+              "schema": {"$ref": "#/components/schemas/GrabcutRequest"}
+            }
+          }
+        },
+        "responses": {
+          "202": {"$ref": "#/components/responses/GrabcutSessionRoundAccepted"},
+          "400": {"$ref": "#/components/responses/Error"},
+          "401": {"$ref": "#/components/responses/Error"},
+          "403": {"$ref": "#/components/responses/Error"},
+          "404": {"$ref": "#/components/responses/Error"},
+          "413": {"$ref": "#/components/responses/UploadError"},
+          "422": {"$ref": "#/components/responses/Error"},
+          "429": {"$ref": "#/components/responses/TooManyRequests"},
+          "500": {"$ref": "#/components/responses/Error"}
+        }
+      }
+    },
+    "/v1/grabcut-sessions/{uuid}": {
+      "get": {
+        "tags": ["grabcut"],
+        "summary": "Get the state and the results of every round of a grabcut session",
+        "security": [{}, {"ApiKey": []}],
+        "parameters": [{"$ref": "#/components/parameters/Uuid"}],
+        "responses": {
+          "200": {
+            "description": "State of the session",
+            "content": {
+              "application/json": {
+                "schema": {"$ref": "#/components/schemas/GrabcutSession"}
+              }
+            }
+          },
+          "401": {"$ref": "#/components/responses/Error"},
+          "403": {"$ref": "#/components/responses/Error"},
+          "404": {"$ref": "#/components/responses/Error"},
+          "429": {"$ref": "#/components/responses/TooManyRequests"},
+          "500": {"$ref": "#/components/responses/Error"}
+        }
+      }
+    },
+    "/v1/grabcut-sessions/{uuid}/rounds": {
+      "post": {
+        "tags": ["grabcut"],
+        "summary": "Refine a grabcut session",
+        "description": "The corrections are drawn on the mask of the previous round and the merged mask is queued as new round",
+        "security": [{}, {"ApiKey": []}],
+        "parameters": [{"$ref": "#/components/parameters/Uuid"}],
+        "requestBody": {
+          "required": true,
+          "content": {
+            "multipart/form-data": {
+              "schema": {
+                "type": "object",
+                "required": ["strokes"],
+                "properties": {
+                  "strokes": {"type": "string", "description": "Corrections as JSON encoded GrabcutStrokes. The coordinates are relative to the size of the image (or the given width and height) and scaled to the size of the mask."}
+                }
+              }
+            }
+          }
+        },
+        "responses": {
+          "202": {"$ref": "#/components/responses/GrabcutSessionRoundAccepted"},
+          "400": {"$ref": "#/components/responses/Error"},
+          "401": {"$ref": "#/components/responses/Error"},
+          "403": {"$ref": "#/components/responses/Error"},
+          "404": {"$ref": "#/components/responses/Error"},
+          "409": {"$ref": "#/components/responses/Error"},
+          "413": {"$ref": "#/components/responses/UploadError"},
+          "422": {"$ref": "#/components/responses/Error"},
+          "429": {"$ref": "#/components/responses/TooManyRequests"},
+          "500": {"$ref": "#/components/responses/Error"}
+        }
+      }
+    },
+    "/v1/grabcut-sessions/{uuid}/mask": {
+      "get": {
+        "tags": ["grabcut"],
+        "summary": "Get the mask of the latest round of a grabcut session",
+        "security": [{}, {"ApiKey": []}],
+        "parameters": [{"$ref": "#/components/parameters/Uuid"}],
+        "responses": {
+          "200": {
+            "description": "Grayscale PNG (0 = background, 255 = foreground, 128 = probable foreground)",
+            "content": {
+              "image/png": {
+                "schema": {"type": "string", "format": "binary"}
+              }
+            }
+          },
+          "401": {"$ref": "#/components/responses/Error"},
+          "403": {"$ref": "#/components/responses/Error"},
+          "404": {"$ref": "#/components/responses/Error"},
+          "429": {"$ref": "#/components/responses/TooManyRequests"},
+          "500": {"$ref": "#/components/responses/Error"}
+        }
+      }
+    },
+    "/v1/jobs/{uuid}/events": {
+      "get": {
+        "tags": ["jobs"],
+        "summary": "Stream the state changes of a job",
+        "description": "Server-sent events: a 'state' event (JobState) for every state change and a final 'result' event with the same payload as the corresponding GET result endpoint.",
+        "security": [{}, {"ApiKey": []}],
+        "parameters": [{"$ref": "#/components/parameters/Uuid"}],
+        "responses": {
+          "200": {
+            "description": "Event stream",
+            "content": {
+              "text/event-stream": {
+                "schema": {"type": "string"}
+              }
+            }
+          },
+          "401": {"$ref": "#/components/responses/Error"},
+          "403": {"$ref": "#/components/responses/Error"},
+          "404": {"$ref": "#/components/responses/Error"},
+          "429": {"$ref": "#/components/responses/TooManyRequests"},
+          "500": {"$ref": "#/components/responses/Error"}
+        }
+      }
+    },
+    "/v1/jobs/{uuid}/webhook": {
+      "get": {
+        "tags": ["jobs"],
+        "summary": "Get the delivery attempts of the job's webhook",
+        "security": [{}, {"ApiKey": []}],
+        "parameters": [{"$ref": "#/components/parameters/Uuid"}],
+        "responses": {
+          "200": {
+            "description": "Delivery log",
+            "content": {
+              "application/json": {
+                "schema": {
+                  "type": "object",
+                  "properties": {
+                    "attempts": {"type": "array", "items": {"$ref": "#/components/schemas/WebhookDeliveryAttempt"}}
+                  }
+                }
+              }
+            }
+          },
+          "401": {"$ref": "#/components/responses/Error"},
+          "403": {"$ref": "#/components/responses/Error"},
+          "404": {"$ref": "#/components/responses/Error"},
+          "429": {"$ref": "#/components/responses/TooManyRequests"},
+          "500": {"$ref": "#/components/responses/Error"}
+        }
+      }
+    },
+    "/healthz": {
+      "get": {
+        "tags": ["health"],
+        "summary": "Check the connection to Redis and report the queue lengths",
+        "responses": {
+          "200": {"$ref": "#/components/responses/Health"},
+          "503": {"$ref": "#/components/responses/Health"}
+        }
+      }
+    },
+    "/readyz": {
+      "get": {
+        "tags": ["health"],
+        "summary": "Like /healthz, but also checks that predict workers sent a recent heartbeat",
+        "responses": {
+          "200": {"$ref": "#/components/responses/Health"},
+          "503": {"$ref": "#/components/responses/Health"}
+        }
+      }
+    },
+    "/v1/openapi.json": {
+      "get": {
+        "summary": "This document",
+        "responses": {
+          "200": {
+            "description": "OpenAPI 3 document",
+            "content": {"application/json": {"schema": {"type": "object"}}}
+          }
+        }
+      }
+    },
+    "/v1/admin/apikeys": {
+      "get": {
+        "tags": ["admin"],
+        "summary": "List all api keys together with their usage",
+        "security": [{"AdminToken": []}],
+        "responses": {
+          "200": {
+            "description": "Api keys",
+            "content": {
+              "application/json": {
+                "schema": {
+                  "type": "object",
+                  "properties": {
+                    "api_keys": {"type": "array", "items": {"$ref": "#/components/schemas/ApiKeyUsage"}}
+                  }
+                }
+              }
+            }
+          },
+          "401": {"$ref": "#/components/responses/Error"},
+          "500": {"$ref": "#/components/responses/Error"}
+        }
+      }
+    }
+  },
+  "components": {
+    "securitySchemes": {
+      "ApiKey": {"type": "apiKey", "in": "header", "name": "X-Api-Key"},
+      "AdminToken": {"type": "apiKey", "in": "header", "name": "X-Admin-Token"}
+    },
+    "parameters": {
+      "Uuid": {
+        "name": "uuid",
+        "in": "path",
+        "required": true,
+        "description": "uuid of the job (as returned in the Location header)",
+        "schema": {"type": "string", "format": "uuid"}
+      },
+      "Wait": {
+        "name": "wait",
+        "in": "query",
+        "required": false,
+        "description": "Number of seconds to wait for the job to finish before answering (capped by the server)",
+        "schema": {"type": "integer", "minimum": 0}
+      }
+    },
+    "headers": {
+      "Location": {"description": "uuid of the job", "schema": {"type": "string", "format": "uuid"}},
+      "RetryAfter": {"description": "Seconds to wait before retrying", "schema": {"type": "integer"}}
+    },
+    "responses": {
+      "Accepted": {
+        "description": "Job queued, the Location header contains the uuid of the job",
+        "headers": {"Location": {"$ref": "#/components/headers/Location"}},
+        "content": {"application/json": {"schema": {"type": "object"}}}
+      },
+      "GrabcutSessionRoundAccepted": {
+        "description": "Round queued, the Location header contains the uuid of the session",
+        "headers": {"Location": {"$ref": "#/components/headers/Location"}},
+        "content": {
+          "application/json": {
+            "schema": {
+              "type": "object",
+              "properties": {
+                "uuid": {"type": "string", "format": "uuid", "description": "uuid of the session"},
+                "round": {"type": "integer"},
+                "job": {"type": "string", "format": "uuid", "description": "uuid of the grabcut request of the round"}
+              }
+            }
+          }
+        }
+      },
+      "InProgress": {
+        "description": "Job is still queued or processing",
+        "content": {"application/json": {"schema": {"$ref": "#/components/schemas/JobStateResponse"}}}
+      },
+      "Expired": {
+        "description": "Result isn't available anymore",
+        "content": {"application/json": {"schema": {"$ref": "#/components/schemas/JobStateResponse"}}}
+      },
+      "TooManyRequests": {
+        "description": "Rate limit or daily quota exceeded",
+        "headers": {"Retry-After": {"$ref": "#/components/headers/RetryAfter"}},
+        "content": {"application/json": {"schema": {"$ref": "#/components/schemas/Error"}}}
+      },
+      "UploadError": {
+        "description": "Picture was rejected",
+        "content": {"application/json": {"schema": {"$ref": "#/components/schemas/UploadError"}}}
+      },
+      "Health": {
+        "description": "Health of the service (503 if it can't serve predictions)",
+        "content": {"application/json": {"schema": {"$ref": "#/components/schemas/Health"}}}
+      },
+      "Error": {
+        "description": "Error",
+        "content": {"application/json": {"schema": {"$ref": "#/components/schemas/Error"}}}
+      }
+    },
+    "schemas": {
+      "Error": {
+        "type": "object",
+        "properties": {
+          "error": {"type": "string"}
+        }
+      },
+      "UploadError": {
+        "type": "object",
+        "properties": {
+          "error": {"type": "string"},
+          "reason": {"type": "string", "enum": ["file_too_large", "unreadable_file", "unsupported_media_type", "invalid_image", "image_dimensions_too_large"]},
+          "filename": {"type": "string", "description": "Only set for batch predictions"}
+        }
+      },
+      "JobStateName": {
+        "type": "string",
+        "enum": ["queued", "processing", "done", "failed", "expired"]
+      },
+      "JobStateResponse": {
+        "type": "object",
+        "properties": {
+          "state": {"$ref": "#/components/schemas/JobStateName"}
+        }
+      },
+      "PredictionRequest": {
+        "type": "object",
+        "required": ["image"],
+        "properties": {
+          "image": {"type": "string", "format": "binary", "description": "JPEG, PNG or GIF"},
+          "classification_type": {"type": "string", "enum": ["classification", "nsfw"], "default": "classification"},
+          "top_k": {"type": "integer", "minimum": 1, "default": 1, "description": "Number of labels to return"},
+          "callback_url": {"type": "string", "format": "uri", "description": "Url the result is posted to (if webhooks are enabled). Needs to point to a public address, redirects aren't followed"}
+        }
+      },
+      "PredictionBatchRequest": {
+        "type": "object",
+        "required": ["image"],
+        "properties": {
+          "image": {"type": "array", "items": {"type": "string", "format": "binary"}, "description": "JPEG, PNG or GIF pictures"},
+          "classification_type": {"type": "string", "enum": ["classification", "nsfw"], "default": "classification"},
+          "top_k": {"type": "integer", "minimum": 1, "default": 1},
+          "callback_url": {"type": "string", "format": "uri"}
+        }
+      },
+      "GrabcutRequest": {
+        "type": "object",
+        "required": ["uuid"],
+        "description": "Either image, strokes or a bounding box (x, y, width and height) is required",
+        "properties": {
+          "image": {"type": "string", "format": "binary", "description": "Mask (grayscale PNG, 0 = background, 255 = foreground, other values = probable foreground)"},
+          "strokes": {"type": "string", "description": "Mask as JSON encoded GrabcutStrokes, which is drawn by the server"},
+          "x": {"type": "number", "description": "Left of the bounding box of the object (everything outside of the bounding box is background)"},
+          "y": {"type": "number", "description": "Top of the bounding box of the object"},
+          "width": {"type": "number", "description": "Width of the bounding box of the object"},
+          "height": {"type": "number", "description": "Height of the bounding box of the object"},
+          "normalized": {"type": "boolean", "default": false, "description": "The bounding box is relative to the size of the image (0 - 1) instead of in pixels"},
+          "uuid": {"type": "string", "pattern": "^[a-zA-Z0-9][a-zA-Z0-9_.-]{0,127}$", "description": "uuid of the ImageMonkey donation (a file in the donations directory)"},
+          "callback_url": {"type": "string", "format": "uri", "description": "Url the result is posted to (if webhooks are enabled). Needs to point to a public address, redirects aren't followed"},
+          "tolerance": {"type": "number", "minimum": 0, "maximum": 100, "default": 1.5, "description": "Tolerance (in pixels) of the polygon simplification"},
+          "high_quality": {"type": "boolean", "default": false, "description": "Skip the radial distance pre-processing of the simplification (slower, more accurate)"},
+          "max_vertices": {"type": "integer", "minimum": 3, "maximum": 10000, "description": "Max number of vertices of the polygon (with polygons=all: of all polygons and holes together, smaller polygons are dropped first), the tolerance is chosen automatically (can't be combined with tolerance)"},
+          "polygons": {"type": "string", "enum": ["largest", "all"], "default": "largest", "description": "Return only the biggest polygon (in points) or additionally all polygons with their holes (in polygons)"},
+          "min_area": {"type": "number", "minimum": 0, "default": 0, "description": "Min area (in pixels) of a polygon"}
+        }
+      },
+      "GrabcutStrokes": {
+        "type": "object",
+        "description": "Rectangles and strokes, drawn in that order on a mask of probable foreground",
+        "properties": {
+          "width": {"type": "integer", "description": "Width of the canvas the coordinates are relative to (default: width of the image, mustn't be bigger)"},
+          "height": {"type": "integer", "description": "Height of the canvas the coordinates are relative to (default: height of the image, mustn't be bigger)"},
+          "strokes": {"type": "array", "maxItems": 10000, "items": {"$ref": "#/components/schemas/GrabcutStroke"}},
+          "rectangles": {"type": "array", "items": {"$ref": "#/components/schemas/GrabcutRectangle"}}
+        }
+      },
+      "GrabcutStroke": {
+        "type": "object",
+        "required": ["type", "width", "points"],
+        "properties": {
+          "type": {"$ref": "#/components/schemas/GrabcutMaskType"},
+          "width": {"type": "number", "minimum": 0, "maximum": 500, "exclusiveMinimum": true, "description": "Brush width (in pixels)"},
+          "points": {
+            "type": "array",
+            "minItems": 1,
+            "items": {"type": "array", "items": {"type": "number"}, "minItems": 2, "maxItems": 2},
+            "description": "Polyline of [x, y] points (a single point draws a dot)"
+          }
+        }
+      },
+      "GrabcutRectangle": {
+        "type": "object",
+        "required": ["type", "x", "y", "width", "height"],
+        "properties": {
+          "type": {"$ref": "#/components/schemas/GrabcutMaskType"},
+          "x": {"type": "number"},
+          "y": {"type": "number"},
+          "width": {"type": "number"},
+          "height": {"type": "number"}
+        }
+      },
+      "GrabcutMaskType": {"type": "string", "enum": ["foreground", "background", "probable"]},
+      "TFResult": {
+        "type": "object",
+        "properties": {
+          "label": {"type": "string"},
+          "score": {"type": "number", "format": "float"}
+        }
+      },
+      "ModelInfo": {
+        "type": "object",
+        "properties": {
+          "build": {"type": "integer", "format": "int32"},
+          "created": {"type": "string"},
+          "trained_on": {"type": "array", "items": {"type": "string"}},
+          "based_on": {"type": "string"}
+        }
+      },
+      "PredictionFailure": {
+        "type": "object",
+        "properties": {
+          "code": {"type": "string", "enum": ["model_not_loaded", "image_unavailable", "invalid_image", "inference_failed", "internal_error"]},
+          "message": {"type": "string"},
+          "model_build": {"type": "integer", "format": "int32"}
+        }
+      },
+      "PredictMeResult": {
+        "type": "object",
+        "properties": {
+          "label": {"type": "string", "description": "Best label (not set if the prediction failed)"},
+          "score": {"type": "number", "format": "float"},
+          "predictions": {"type": "array", "items": {"$ref": "#/components/schemas/TFResult"}, "description": "Best labels, ordered by score"},
+          "model_info": {"$ref": "#/components/schemas/ModelInfo"},
+          "error": {"$ref": "#/components/schemas/PredictionFailure"},
+          "state": {"$ref": "#/components/schemas/JobStateName"}
+        }
+      },
+      "GrabcutMeResultPoint": {
+        "type": "object",
+        "properties": {
+          "x": {"type": "number", "format": "float"},
+          "y": {"type": "number", "format": "float"}
+        }
+      },
+      "GrabcutMePolygon": {
+        "type": "object",
+        "properties": {
+          "points": {"type": "array", "items": {"$ref": "#/components/schemas/GrabcutMeResultPoint"}},
+          "holes": {
+            "type": "array",
+            "items": {"type": "array", "items": {"$ref": "#/components/schemas/GrabcutMeResultPoint"}}
+          },
+          "area": {"type": "number", "description": "Area (in pixels) of the polygon without its holes"}
+        }
+      },
+      "GrabcutMeResult": {
+        "type": "object",
+        "properties": {
+          "points": {"type": "array", "items": {"$ref": "#/components/schemas/GrabcutMeResultPoint"}, "description": "Biggest polygon"},
+          "polygons": {
+            "type": "array",
+            "items": {"$ref": "#/components/schemas/GrabcutMePolygon"},
+            "description": "All polygons, sorted by area (only if requested with polygons=all)"
+          },
+          "type": {"type": "string", "enum": ["polygon"]},
+          "angle": {"type": "number", "format": "float"},
+          "original_vertices": {"type": "integer", "description": "Number of vertices before the simplification (of all polygons, if requested with polygons=all)"},
+          "vertices": {"type": "integer", "description": "Number of vertices after the simplification (of all polygons, if requested with polygons=all)"},
+          "tolerance": {"type": "number", "description": "Tolerance that was used for the simplification"},
+          "width": {"type": "integer", "description": "Width (in pixels) of the image"},
+          "height": {"type": "integer", "description": "Height (in pixels) of the image"}
+        }
+      },
+      "GeoJSONFeature": {
+        "type": "object",
+        "description": "Polygon (or MultiPolygon) in image coordinates, see RFC 7946",
+        "properties": {
+          "type": {"type": "string", "enum": ["Feature"]},
+          "geometry": {
+            "type": "object",
+            "nullable": true,
+            "properties": {
+              "type": {"type": "string", "enum": ["Polygon", "MultiPolygon"]},
+              "coordinates": {"type": "array", "items": {}}
+            }
+          },
+          "properties": {"type": "object", "additionalProperties": true}
+        }
+      },
+      "COCOAnnotation": {
+        "type": "object",
+        "properties": {
+          "segmentation": {
+            "oneOf": [
+              {"type": "array", "items": {"type": "array", "items": {"type": "number"}}},
+              {
+                "type": "object",
+                "properties": {
+                  "size": {"type": "array", "items": {"type": "integer"}, "description": "height, width"},
+                  "counts": {"type": "array", "items": {"type": "integer"}, "description": "Uncompressed RLE (column-major)"}
+                }
+              }
+            ]
+          },
+          "area": {"type": "number"},
+          "bbox": {"type": "array", "items": {"type": "number"}, "description": "x, y, width, height"},
+          "iscrowd": {"type": "integer"}
+        }
+      },
+      "GrabcutSession": {
+        "type": "object",
+        "properties": {
+          "uuid": {"type": "string", "format": "uuid"},
+          "image": {"type": "string", "description": "uuid of the ImageMonkey donation"},
+          "created": {"type": "integer", "format": "int64"},
+          "updated": {"type": "integer", "format": "int64"},
+          "rounds": {"type": "array", "items": {"$ref": "#/components/schemas/GrabcutSessionRound"}}
+        }
+      },
+      "GrabcutSessionRound": {
+        "type": "object",
+        "properties": {
+          "round": {"type": "integer", "description": "Starts with 1"},
+          "uuid": {"type": "string", "format": "uuid", "description": "uuid of the grabcut request of the round"},
+          "created": {"type": "integer", "format": "int64"},
+          "strokes": {"$ref": "#/components/schemas/GrabcutStrokes"},
+          "state": {"$ref": "#/components/schemas/JobStateName"},
+          "error": {"type": "string"},
+          "result": {"$ref": "#/components/schemas/GrabcutResponse"}
+        }
+      },
+      "GrabcutResponse": {
+        "type": "object",
+        "properties": {
+          "result": {"$ref": "#/components/schemas/GrabcutMeResult"},
+          "error": {"type": "string"},
+          "state": {"$ref": "#/components/schemas/JobStateName"}
+        }
+      },
+      "JobState": {
+        "type": "object",
+        "properties": {
+          "uuid": {"type": "string", "format": "uuid"},
+          "type": {"type": "string", "enum": ["predict", "grabcut"]},
+          "state": {"$ref": "#/components/schemas/JobStateName"},
+          "error": {"type": "string"},
+          "created": {"type": "integer", "format": "int64"},
+          "updated": {"type": "integer", "format": "int64"}
+        }
+      },
+      "WebhookDeliveryAttempt": {
+        "type": "object",
+        "properties": {
+          "attempt": {"type": "integer"},
+          "timestamp": {"type": "integer", "format": "int64"},
+          "status_code": {"type": "integer"},
+          "error": {"type": "string"}
+        }
+      },
+      "PredictionBatchItem": {
+        "type": "object",
+        "properties": {
+          "uuid": {"type": "string", "format": "uuid"},
+          "filename": {"type": "string"}
+        }
+      },
+      "PredictionBatchResult": {
+        "type": "object",
+        "properties": {
+          "uuid": {"type": "string", "format": "uuid"},
+          "created": {"type": "integer", "format": "int64"},
+          "progress": {
+            "type": "object",
+            "properties": {
+              "total": {"type": "integer"},
+              "queued": {"type": "integer"},
+              "processing": {"type": "integer"},
+              "done": {"type": "integer"},
+              "failed": {"type": "integer"},
+              "expired": {"type": "integer"},
+              "finished": {"type": "integer"}
+            }
+          },
+          "predictions": {
+            "type": "array",
+            "items": {
+              "type": "object",
+              "properties": {
+                "uuid": {"type": "string", "format": "uuid"},
+                "filename": {"type": "string"},
+                "state": {"$ref": "#/components/schemas/JobStateName"},
+                "error": {"type": "string"},
+                "result": {"$ref": "#/components/schemas/PredictMeResult"}
+              }
+            }
+          }
+        }
+      },
+      "Health": {
+        "type": "object",
+        "properties": {
+          "status": {"type": "string", "enum": ["ok", "unavailable"]},
+          "redis": {"type": "string", "description": "'ok' or the error"},
+          "queues": {"type": "object", "additionalProperties": {"type": "integer"}, "description": "Number of queued jobs per queue"},
+          "processing": {"type": "object", "additionalProperties": {"type": "integer"}, "description": "Number of jobs per queue that a worker took, but didn't finish yet"},
+          "workers": {
+            "type": "object",
+            "description": "Only reported by /readyz",
+            "additionalProperties": {
+              "type": "object",
+              "properties": {
+                "active": {"type": "integer", "description": "Number of workers with a recent heartbeat"},
+                "last_heartbeat": {"type": "integer", "format": "int64"}
+              }
+            }
+          }
+        }
+      },
+      "ApiKey": {
+        "type": "object",
+        "properties": {
+          "id": {"type": "string"},
+          "name": {"type": "string"},
+          "daily_quota": {"type": "integer", "description": "0 = unlimited"},
+          "endpoints": {"type": "string", "description": "Comma separated list of allowed endpoints (empty = all)"},
+          "created": {"type": "integer", "format": "int64"},
+          "revoked": {"type": "boolean"},
+          "total_requests": {"type": "integer", "format": "int64"}
+        }
+      },
+      "ApiKeyUsage": {
+        "type": "object",
+        "properties": {
+          "api_key": {"$ref": "#/components/schemas/ApiKey"},
+          "usage_today": {"type": "integer"},
+          "usage_yesterday": {"type": "integer"}
+        }
+      }
+    }
+  }
+}`
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"encoding/json"
+	datastructures "github.com/bbernhard/imagemonkey-playground/datastructures"
+	exporter "github.com/bbernhard/imagemonkey-playground/exporter"
+	"github.com/garyburd/redigo/redis"
+	"github.com/gin-gonic/gin"
+	"reflect"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+type openApiDocument struct {
+	Paths      map[string]map[string]interface{} `json:"paths"`
+	Components struct {
+		Schemas map[string]struct {
+			Properties map[string]interface{} `json:"properties"`
+		} `json:"schemas"`
+	} `json:"components"`
+}
+
+func parseOpenApiSpec(t *testing.T) openApiDocument {
+	var spec openApiDocument
+	err := json.Unmarshal([]byte(openApiSpec), &spec)
+	if err != nil {
+		t.Fatalf("couldn't parse openapi spec: %s", err.Error())
+	}
+	return spec
+}
+
+func TestOpenApiSpecContainsAllRoutes(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	//routes are only registered, so we never connect to redis or use the storage
+	redisPool := redis.NewPool(func() (redis.Conn, error) {
+		return nil, nil
+	}, 1)
+	defer redisPool.Close()
+
+	router := setupRouter(redisPool, nil, Config{UseWebhooks: true, UseAdminApi: true, AdminToken: "test"}, make(chan struct{}))
+	spec := parseOpenApiSpec(t)
+
+	//gin uses :param, openapi {param}
+	param := regexp.MustCompile(`:([^/]+)`)
+
+	routes := router.Routes()
+	if len(routes) == 0 {
+		t.Fatalf("no routes registered")
+	}
+
+	for _, route := range routes {
+		path := param.ReplaceAllString(route.Path, "{$1}")
+		operations, found := spec.Paths[path]
+		if !found {
+			t.Errorf("route %s %s is missing in the openapi spec", route.Method, path)
+			continue
+		}
+		if _, found := operations[strings.ToLower(route.Method)]; !found {
+			t.Errorf("route %s %s is missing in the openapi spec", route.Method, path)
+		}
+	}
+}
+
+func TestOpenApiSpecMatchesDatastructures(t *testing.T) {
+	spec := parseOpenApiSpec(t)
+
+	types := map[string]interface{}{
+		"TFResult":               datastructures.TFResult{},
+		"ModelInfo":              datastructures.ModelInfo{},
+		"PredictionFailure":      datastructures.PredictionFailure{},
+		"GrabcutMeResultPoint":   datastructures.GrabcutMeResultPoint{},
+		"GrabcutMePolygon":       datastructures.GrabcutMePolygon{},
+		"GrabcutStrokes":         datastructures.GrabcutStrokes{},
+		"GrabcutStroke":          datastructures.GrabcutStroke{},
+		"GrabcutRectangle":       datastructures.GrabcutRectangle{},
+		"GrabcutMeResult":        datastructures.GrabcutMeResult{},
+		"GrabcutSession":         datastructures.GrabcutMeSession{},
+		"GrabcutSessionRound":    datastructures.GrabcutMeSessionRound{},
+		"JobState":               datastructures.JobState{},
+		"WebhookDeliveryAttempt": datastructures.WebhookDeliveryAttempt{},
+		"PredictionBatchItem":    datastructures.PredictionBatchItem{},
+		"ApiKey":                 ApiKey{},
+		"GeoJSONFeature":         exporter.GeoJSONFeature{},
+		"COCOAnnotation":         exporter.COCOAnnotation{},
+	}
+
+	for name, value := range types {
+		schema, found := spec.Components.Schemas[name]
+		if !found {
+			t.Errorf("schema %s is missing in the openapi spec", name)
+			continue
+		}
+
+		fields := map[string]bool{}
+		valueType := reflect.TypeOf(value)
+		for i := 0; i < valueType.NumField(); i++ {
+			field := strings.Split(valueType.Field(i).Tag.Get("json"), ",")[0]
+			if field == "" || field == "-" {
+				continue
+			}
+			fields[field] = true
+
+			if _, found := schema.Properties[field]; !found {
+				t.Errorf("property %s of schema %s is missing in the openapi spec", field, name)
+			}
+		}
+
+		for property := range schema.Properties {
+			if !fields[property] {
+				t.Errorf("property %s of schema %s doesn't exist in %s", property, name, valueType.Name())
+			}
+		}
+	}
+}
+
+//findOpenApiRefs returns the targets of all $refs within the value
+func findOpenApiRefs(value interface{}) []string {
+	var refs []string
+	switch v := value.(type) {
+	case map[string]interface{}:
+		for key, child := range v {
+			if ref, ok := child.(string); ok && key == "$ref" {
+				refs = append(refs, ref)
+				continue
+			}
+			refs = append(refs, findOpenApiRefs(child)...)
+		}
+	case []interface{}:
+		for _, child := range v {
+			refs = append(refs, findOpenApiRefs(child)...)
+		}
+	}
+	return refs
+}
+
+func TestOpenApiSpecRefsResolve(t *testing.T) {
+	var spec map[string]interface{}
+	if err := json.Unmarshal([]byte(openApiSpec), &spec); err != nil {
+		t.Fatalf("couldn't parse openapi spec: %s", err.Error())
+	}
+
+	for _, ref := range findOpenApiRefs(spec) {
+		if !strings.HasPrefix(ref, "#/") {
+			t.Errorf("$ref %s isn't local", ref)
+			continue
+		}
+
+		var target interface{} = spec
+		for _, name := range strings.Split(strings.TrimPrefix(ref, "#/"), "/") {
+			object, ok := target.(map[string]interface{})
+			if !ok {
+				target = nil
+				break
+			}
+			target = object[name]
+		}
+		if target == nil {
+			t.Errorf("$ref %s points at nothing", ref)
+		}
+	}
+
+	//every response object needs a description
+	responses, _ := spec["components"].(map[string]interface{})["responses"].(map[string]interface{})
+	for name, response := range responses {
+		if description, _ := response.(map[string]interface{})["description"].(string); description == "" {
+			t.Errorf("response %s has no description", name)
+		}
+	}
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	datastructures "github.com/bbernhard/imagemonkey-playground/datastructures"
+	"github.com/gin-gonic/gin"
+	"github.com/yrsh/simplify-go"
+	"math"
+	"sort"
+	"strconv"
+)
+
+//getPolygonOptions parses the polygon form values of a grabcut request. By default only the
+//biggest polygon is returned (as before multiple polygons were supported). In case a value
+//is invalid, the response is written and ok is false.
+func getPolygonOptions(c *gin.Context) (options *datastructures.GrabcutPolygonOptions, ok bool) {
+	rawPolygons := c.PostForm("polygons")
+	rawMinArea := c.PostForm("min_area")
+	if rawPolygons == "" && rawMinArea == "" {
+		return nil, true
+	}
+
+	options = &datastructures.GrabcutPolygonOptions{}
+	switch rawPolygons {
+	case "", "largest":
+	case "all":
+		options.All = true
+	default:
+		c.JSON(422, gin.H{"error": "Invalid polygons - needs to be largest or all"})
+		return nil, false
+	}
+
+	if rawMinArea != "" {
+		minArea, err := strconv.ParseFloat(rawMinArea, 64)
+		if err != nil || math.IsNaN(minArea) || math.IsInf(minArea, 0) || minArea < 0 {
+			c.JSON(422, gin.H{"error": "Invalid min_area - needs to be a positive number"})
+			return nil, false
+		}
+		options.MinArea = minArea
+	}
+
+	return options, true
+}
+
+//getPolygonArea returns the area of the (closed) polygon
+func getPolygonArea(points [][]float64) float64 {
+	area := 0.0
+	for i := range points {
+		j := (i + 1) % len(points)
+		area += points[i][0]*points[j][1] - points[j][0]*points[i][1]
+	}
+	return math.Abs(area) / 2
+}
+
+//getGrabcutPolygons returns the polygons of the grabcut result with at least minArea,
+//sorted by area (biggest first)
+func getGrabcutPolygons(grabcutResult datastructures.GrabcutResult, minArea float64) []datastructures.GrabcutPolygon {
+	polygons := grabcutResult.Polygons
+	if len(polygons) == 0 && len(grabcutResult.Points) > 0 {
+		//results of older workers only contain a single point list
+		polygons = []datastructures.GrabcutPolygon{{Points: grabcutResult.Points, Area: getPolygonArea(grabcutResult.Points)}}
+	}
+
+	var filtered []datastructures.GrabcutPolygon
+	for _, polygon := range polygons {
+		if polygon.Area >= minArea && len(polygon.Points) > 0 {
+			filtered = append(filtered, polygon)
+		}
+	}
+
+	sort.SliceStable(filtered, func(i, j int) bool {
+		return filtered[i].Area > filtered[j].Area
+	})
+	return filtered
+}
+
+func getGrabcutMeResultPoints(points [][]float64) []datastructures.GrabcutMeResultPoint {
+	var result []datastructures.GrabcutMeResultPoint
+	for _, point := range points {
+		result = append(result, datastructures.GrabcutMeResultPoint{X: float32(point[0]), Y: float32(point[1])})
+	}
+	return result
+}
+
+//simplifyGrabcutPolygons simplifies all rings of the polygons with the given tolerance.
+//Rings with less than 3 vertices are dropped. Returns the polygons and the number of
+//vertices before and after the simplification.
+func simplifyGrabcutPolygons(polygons []datastructures.GrabcutPolygon, tolerance float64,
+	highQuality bool) ([]datastructures.GrabcutMePolygon, int, int) {
+	var result []datastructures.GrabcutMePolygon
+	originalVertices, vertices := 0, 0
+
+	for _, polygon := range polygons {
+		//the original vertices don't depend on which polygons survive the simplification
+		originalVertices += len(polygon.Points)
+		for _, hole := range polygon.Holes {
+			originalVertices += len(hole)
+		}
+
+		points := simplifier.Simplify(polygon.Points, tolerance, highQuality)
+		if len(points) < 3 {
+			continue
+		}
+
+		mePolygon := datastructures.GrabcutMePolygon{Points: getGrabcutMeResultPoints(points),
+			Holes: [][]datastructures.GrabcutMeResultPoint{}, Area: polygon.Area}
+		vertices += len(points)
+
+		for _, hole := range polygon.Holes {
+			holePoints := simplifier.Simplify(hole, tolerance, highQuality)
+			if len(holePoints) < 3 {
+				continue
+			}
+			mePolygon.Holes = append(mePolygon.Holes, getGrabcutMeResultPoints(holePoints))
+			vertices += len(holePoints)
+		}
+
+		result = append(result, mePolygon)
+	}
+
+	return result, originalVertices, vertices
+}
+
+//simplifyAllGrabcutPolygons simplifies all polygons. Without MaxVertices the tolerance that
+//was used for the biggest polygon is used for all polygons. With MaxVertices the tolerance is
+//searched, so that all polygons together have at most MaxVertices vertices (the smaller
+//polygons vanish first). If that isn't possible, only the simplified biggest polygon is
+//returned. Returns the polygons, the number of vertices before and after the simplification
+//and the tolerance that was used.
+func simplifyAllGrabcutPolygons(polygons []datastructures.GrabcutPolygon, biggest [][]float64, tolerance float64,
+	simplification datastructures.GrabcutSimplification) ([]datastructures.GrabcutMePolygon, int, int, float64) {
+	if simplification.MaxVertices <= 0 {
+		result, originalVertices, vertices := simplifyGrabcutPolygons(polygons, tolerance, simplification.HighQuality)
+		return result, originalVertices, vertices, tolerance
+	}
+
+	maxTolerance := 0.0
+	for _, polygon := range polygons {
+		maxTolerance = math.Max(maxTolerance, getMaxSimplifyTolerance(polygon.Points))
+	}
+
+	//without simplification at all there might be less vertices than allowed
+	result, originalVertices, vertices := simplifyGrabcutPolygons(polygons, 0, simplification.HighQuality)
+	if vertices <= simplification.MaxVertices {
+		return result, originalVertices, vertices, 0
+	}
+
+	allTolerance, found := searchSimplifyTolerance(maxTolerance, simplification.MaxVertices, func(tolerance float64) int {
+		_, _, vertices := simplifyGrabcutPolygons(polygons, tolerance, simplification.HighQuality)
+		return vertices
+	})
+	if found {
+		result, _, vertices = simplifyGrabcutPolygons(polygons, allTolerance, simplification.HighQuality)
+		return result, originalVertices, vertices, allTolerance
+	}
+
+	result = []datastructures.GrabcutMePolygon{{Points: getGrabcutMeResultPoints(biggest),
+		Holes: [][]datastructures.GrabcutMeResultPoint{}, Area: polygons[0].Area}}
+	return result, originalVertices, len(biggest), tolerance
+}
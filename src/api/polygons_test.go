@@ -0,0 +1,136 @@
+package main
+
+import (
+	"encoding/json"
+	datastructures "github.com/bbernhard/imagemonkey-playground/datastructures"
+	"github.com/gin-gonic/gin"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func getSquare(x, y, size float64) [][]float64 {
+	return [][]float64{{x, y}, {x + size, y}, {x + size, y + size}, {x, y + size}}
+}
+
+func getTestGrabcutResult(polygonOptions *datastructures.GrabcutPolygonOptions) datastructures.GrabcutResult {
+	return datastructures.GrabcutResult{
+		Points: getSquare(0, 0, 100),
+		Polygons: []datastructures.GrabcutPolygon{
+			{Points: getSquare(300, 300, 10), Holes: [][][]float64{}, Area: 100},
+			{Points: getSquare(0, 0, 100), Holes: [][][]float64{getSquare(40, 40, 20)}, Area: 9600},
+			{Points: getSquare(200, 0, 50), Holes: [][][]float64{}, Area: 2500},
+		},
+		PolygonOptions: polygonOptions,
+	}
+}
+
+func getTestGrabcutMeResult(t *testing.T, grabcutResult datastructures.GrabcutResult) datastructures.GrabcutMeResult {
+	data, _ := json.Marshal(grabcutResult)
+	response, err := getGrabcutMeResponse(datastructures.JobState{State: "done"}, data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return response["result"].(datastructures.GrabcutMeResult)
+}
+
+func TestGetPolygonArea(t *testing.T) {
+	if area := getPolygonArea(getSquare(10, 10, 5)); area != 25 {
+		t.Errorf("expected area 25, got %f", area)
+	}
+	if area := getPolygonArea([][]float64{{0, 0}, {0, 10}, {10, 0}}); area != 50 {
+		t.Errorf("expected area 50 (independent of the orientation), got %f", area)
+	}
+}
+
+func TestGetGrabcutPolygons(t *testing.T) {
+	polygons := getGrabcutPolygons(getTestGrabcutResult(nil), 0)
+	if len(polygons) != 3 || polygons[0].Area != 9600 || polygons[1].Area != 2500 || polygons[2].Area != 100 {
+		t.Errorf("expected polygons sorted by area, got %+v", polygons)
+	}
+
+	polygons = getGrabcutPolygons(getTestGrabcutResult(nil), 1000)
+	if len(polygons) != 2 {
+		t.Errorf("expected small polygon to be filtered, got %+v", polygons)
+	}
+
+	//results of older workers only contain points
+	polygons = getGrabcutPolygons(datastructures.GrabcutResult{Points: getSquare(0, 0, 10)}, 0)
+	if len(polygons) != 1 || polygons[0].Area != 100 {
+		t.Errorf("expected points to be converted into a polygon, got %+v", polygons)
+	}
+}
+
+func TestGrabcutMeResponsePolygons(t *testing.T) {
+	//compatibility mode: only the biggest polygon
+	result := getTestGrabcutMeResult(t, getTestGrabcutResult(nil))
+	if len(result.Points) != 4 || result.Points[1].X != 100 || result.Polygons != nil {
+		t.Errorf("expected only the biggest polygon, got %+v", result)
+	}
+
+	result = getTestGrabcutMeResult(t, getTestGrabcutResult(&datastructures.GrabcutPolygonOptions{All: true, MinArea: 1000}))
+	if len(result.Polygons) != 2 || len(result.Points) != 4 {
+		t.Fatalf("expected two polygons, got %+v", result)
+	}
+	if result.Polygons[0].Area != 9600 || len(result.Polygons[0].Holes) != 1 || len(result.Polygons[1].Holes) != 0 {
+		t.Errorf("unexpected polygons %+v", result.Polygons)
+	}
+	if result.OriginalVertices != 12 || result.Vertices != 12 {
+		t.Errorf("expected vertices of all rings to be counted, got %d/%d", result.Vertices, result.OriginalVertices)
+	}
+
+	result = getTestGrabcutMeResult(t, getTestGrabcutResult(&datastructures.GrabcutPolygonOptions{MinArea: 10000}))
+	if len(result.Points) != 0 || result.Vertices != 0 {
+		t.Errorf("expected no polygon, got %+v", result)
+	}
+}
+
+func TestSimplifyGrabcutPolygonsCountsDroppedPolygons(t *testing.T) {
+	polygons := []datastructures.GrabcutPolygon{
+		{Points: getSquare(0, 0, 100), Holes: [][][]float64{getSquare(40, 40, 1)}, Area: 9999},
+		{Points: getSquare(300, 300, 1), Holes: [][][]float64{}, Area: 1},
+	}
+
+	for _, tolerance := range []float64{0, 5} {
+		result, originalVertices, _ := simplifyGrabcutPolygons(polygons, tolerance, false)
+		if originalVertices != 12 {
+			t.Errorf("expected 12 original vertices with tolerance %f, got %d", tolerance, originalVertices)
+		}
+		if tolerance > 0 && (len(result) != 1 || len(result[0].Holes) != 0) {
+			t.Errorf("expected the small polygon and the hole to be dropped, got %+v", result)
+		}
+	}
+}
+
+func TestGetPolygonOptions(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	parse := func(form url.Values) (*datastructures.GrabcutPolygonOptions, bool, int) {
+		w := httptest.NewRecorder()
+		c, _ := gin.CreateTestContext(w)
+		c.Request = httptest.NewRequest("POST", "/v1/grabcut", strings.NewReader(form.Encode()))
+		c.Request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		options, ok := getPolygonOptions(c)
+		return options, ok, w.Code
+	}
+
+	if options, ok, _ := parse(url.Values{}); !ok || options != nil {
+		t.Errorf("expected no options, got %+v", options)
+	}
+
+	options, ok, _ := parse(url.Values{"polygons": {"all"}, "min_area": {"50.5"}})
+	if !ok || !options.All || options.MinArea != 50.5 {
+		t.Errorf("unexpected options %+v", options)
+	}
+
+	for _, form := range []url.Values{
+		{"polygons": {"some"}},
+		{"min_area": {"-1"}},
+		{"min_area": {"Inf"}},
+	} {
+		if _, ok, code := parse(form); ok || code != 422 {
+			t.Errorf("expected %v to be rejected with 422, got %d", form, code)
+		}
+	}
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"encoding/json"
+	commons "github.com/bbernhard/imagemonkey-playground/commons"
+	datastructures "github.com/bbernhard/imagemonkey-playground/datastructures"
+	"github.com/garyburd/redigo/redis"
+	"github.com/gin-gonic/gin"
+	"github.com/gofrs/uuid"
+	"mime/multipart"
+	"strconv"
+	"time"
+)
+
+type predictionOptions struct {
+	Type        string
+	TopK        int
+	CallbackUrl string
+}
+
+//getPredictionOptions parses the form values that are shared by all prediction endpoints.
+//In case a value is invalid, the response is written and ok is false.
+func getPredictionOptions(c *gin.Context, config Config) (options predictionOptions, ok bool) {
+	if c.PostForm("classification_type") == "nsfw" {
+		options.Type = "nsfw-classification"
+	} else {
+		options.Type = "classification"
+	}
+
+	options.TopK = 1
+	if c.PostForm("top_k") != "" {
+		topK, err := strconv.Atoi(c.PostForm("top_k"))
+		if err != nil || topK < 1 || topK > config.MaxTopK {
+			c.JSON(422, gin.H{"error": ("Invalid top_k - needs to be a number between 1 and " + strconv.Itoa(config.MaxTopK))})
+			return options, false
+		}
+		options.TopK = topK
+	}
+
+	options.CallbackUrl, ok = getCallbackUrl(c, config)
+	return options, ok
+}
+
+//enqueuePrediction puts the uploaded image into the storage and adds a prediction request to the
+//REDIS queue of its model (see commons.GetPredictionQueue). Returns the uuid of the prediction request.
+func enqueuePrediction(redisConn redis.Conn, header *multipart.FileHeader, storage commons.Storage,
+	options predictionOptions) (string, error) {
+	predictionRequest, err := storePrediction(header, storage, options)
+	if err != nil {
+		return "", err
+	}
+
+	redisConn.Send("MULTI")
+	err = sendPredictionRequest(redisConn, predictionRequest)
+	if err != nil {
+		redisConn.Do("DISCARD")
+		storage.Delete(predictionRequest.Filename)
+		return "", err
+	}
+
+	_, err = redisConn.Do("EXEC")
+	if err != nil {
+		//nobody is going to process the image
+		storage.Delete(predictionRequest.Filename)
+		return "", err
+	}
+
+	return predictionRequest.Uuid, nil
+}
+
+//storePrediction puts the uploaded image into the storage and returns the prediction request for it
+func storePrediction(header *multipart.FileHeader, storage commons.Storage, options predictionOptions) (datastructures.PredictionRequest, error) {
+	var predictionRequest datastructures.PredictionRequest
+
+	u, err := uuid.NewV4()
+	if err != nil {
+		return predictionRequest, err
+	}
+
+	predictionRequest.Uuid = u.String()
+	predictionRequest.Created = int64(time.Now().Unix())
+	predictionRequest.Filename = predictionRequest.Uuid //the storage key of the image
+	predictionRequest.Type = options.Type
+	predictionRequest.TopK = options.TopK
+	predictionRequest.CallbackUrl = options.CallbackUrl
+
+	file, err := header.Open()
+	if err != nil {
+		return predictionRequest, err
+	}
+	defer file.Close()
+
+	err = storage.Put(predictionRequest.Filename, file, header.Size)
+	return predictionRequest, err
+}
+
+//sendPredictionRequest sends the commands that create the job state of the prediction request
+//and add it to the queue. Meant to be used within a transaction.
+func sendPredictionRequest(redisConn redis.Conn, predictionRequest datastructures.PredictionRequest) error {
+	serialized, err := json.Marshal(predictionRequest)
+	if err != nil {
+		return err
+	}
+
+	commons.SendCreateJobState(redisConn, predictionRequest.Uuid, commons.JobTypePrediction, predictionRequest.CallbackUrl)
+	return commons.GetPredictionQueue(predictionRequest.Type).Send(redisConn, serialized)
+}
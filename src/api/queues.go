@@ -0,0 +1,71 @@
+package main
+
+import (
+	"encoding/json"
+	commons "github.com/bbernhard/imagemonkey-playground/commons"
+	"github.com/garyburd/redigo/redis"
+	log "github.com/sirupsen/logrus"
+	"time"
+)
+
+//runQueueReaper periodically puts the jobs back into their queue, whose worker died (or
+//took too long) while processing them. Jobs that were given up on are marked as failed.
+func runQueueReaper(redisPool *redis.Pool, storage commons.Storage, interval time.Duration, orphanTimeout time.Duration,
+	maxDeliveries int) {
+	for {
+		time.Sleep(interval)
+
+		for _, queue := range []commons.ReliableQueue{commons.PredictionQueue, commons.NSFWPredictionQueue, commons.GrabcutQueue} {
+			redisConn := redisPool.Get()
+			err := reapQueue(redisConn, queue, storage, orphanTimeout, maxDeliveries)
+			if err != nil {
+				log.Error("[Queues] Couldn't reap queue ", queue.Name, ": ", err.Error())
+			}
+			redisConn.Close()
+		}
+	}
+}
+
+func reapQueue(redisConn redis.Conn, queue commons.ReliableQueue, storage commons.Storage, orphanTimeout time.Duration,
+	maxDeliveries int) error {
+	requeued, dead, err := queue.Reap(redisConn, orphanTimeout, maxDeliveries)
+	if err != nil {
+		return err
+	}
+
+	if requeued > 0 {
+		log.Info("[Queues] Put ", requeued, " unfinished job(s) back into queue ", queue.Name)
+		requeuedJobsTotal.WithLabelValues(queue.Name).Add(float64(requeued))
+	}
+
+	for _, item := range dead {
+		deadJobsTotal.WithLabelValues(queue.Name).Inc()
+
+		//the fields that prediction and grabcut requests have in common
+		var request struct {
+			Uuid     string `json:"uuid"`
+			Filename string `json:"filename"`
+		}
+		err = json.Unmarshal(item, &request)
+		if err != nil {
+			log.Error("[Queues] Gave up on invalid job in queue ", queue.Name, ": ", err.Error())
+			continue
+		}
+
+		log.Error("[Queues] Gave up on job ", request.Uuid, " in queue ", queue.Name, " after ", maxDeliveries, " deliveries")
+		err = commons.UpdateJobState(redisConn, request.Uuid, commons.JobStateFailed, "Couldn't process request")
+		if err != nil {
+			return err
+		}
+
+		//the image of a prediction is only needed by the worker (grabcut requests refer to the donation)
+		if queue != commons.GrabcutQueue {
+			err = storage.Delete(request.Filename)
+			if err != nil {
+				log.Error("[Queues] Couldn't remove image of job ", request.Uuid, ": ", err.Error())
+			}
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"github.com/garyburd/redigo/redis"
+	"github.com/gin-gonic/gin"
+	log "github.com/sirupsen/logrus"
+	"math"
+	"strconv"
+	"time"
+)
+
+//Token bucket per client: the bucket holds at most ARGV[1] tokens and is refilled with
+//ARGV[2] tokens per second. Every request takes one token. The script returns whether
+//the request is allowed and the number of tokens left (as string, as Redis would
+//truncate a float to an integer).
+var tokenBucketScript = redis.NewScript(1, `
+local capacity = tonumber(ARGV[1])
+local refill_rate = tonumber(ARGV[2])
+local now = tonumber(ARGV[3])
+
+local bucket = redis.call("HMGET", KEYS[1], "tokens", "timestamp")
+local tokens = tonumber(bucket[1])
+local timestamp = tonumber(bucket[2])
+if tokens == nil or timestamp == nil then
+	tokens = capacity
+	timestamp = now
+end
+
+tokens = math.min(capacity, tokens + (math.max(0, now - timestamp) / 1000.0) * refill_rate)
+
+local allowed = 0
+if tokens >= 1 then
+	tokens = tokens - 1
+	allowed = 1
+end
+
+redis.call("HMSET", KEYS[1], "tokens", tostring(tokens), "timestamp", now)
+redis.call("PEXPIRE", KEYS[1], math.ceil((capacity / refill_rate) * 1000))
+return {allowed, tostring(tokens)}
+`)
+
+//RateLimitMiddleware allows every client (identified by its IP address, see trustedProxies) at most
+//limitPerMinute requests per minute on the routes it is used on (bursts up to
+//limitPerMinute requests are allowed). A limit of 0 disables rate limiting. Clients
+//that authenticated with an api key are limited by the key's quota instead.
+func RateLimitMiddleware(redisPool *redis.Pool, proxies trustedProxies, name string, limitPerMinute int) gin.HandlerFunc {
+	refillRate := float64(limitPerMinute) / 60.0
+
+	return func(c *gin.Context) {
+		_, authenticated := c.Get("apiKey")
+		if limitPerMinute <= 0 || authenticated {
+			c.Next()
+			return
+		}
+
+		redisConn := redisPool.Get()
+		key := "ratelimit" + name + proxies.clientIp(c.Request)
+		values, err := redis.Values(tokenBucketScript.Do(redisConn, key, limitPerMinute, refillRate,
+			(time.Now().UnixNano() / int64(time.Millisecond))))
+		redisConn.Close()
+		if err != nil { //better to serve the request than to fail because of the rate limiter
+			log.Error("[Rate Limit] Couldn't check rate limit: ", err.Error())
+			c.Next()
+			return
+		}
+
+		var allowed int
+		var remainingStr string
+		_, err = redis.Scan(values, &allowed, &remainingStr)
+		if err != nil {
+			log.Error("[Rate Limit] Couldn't parse rate limit: ", err.Error())
+			c.Next()
+			return
+		}
+
+		remaining, err := strconv.ParseFloat(remainingStr, 64)
+		if err != nil {
+			log.Error("[Rate Limit] Couldn't parse rate limit: ", err.Error())
+			c.Next()
+			return
+		}
+
+		//seconds until the bucket is full again
+		reset := int(math.Ceil((float64(limitPerMinute) - remaining) / refillRate))
+
+		c.Writer.Header().Set("RateLimit-Limit", strconv.Itoa(limitPerMinute))
+		c.Writer.Header().Set("RateLimit-Remaining", strconv.Itoa(int(math.Floor(remaining))))
+		c.Writer.Header().Set("RateLimit-Reset", strconv.Itoa(reset))
+
+		if allowed != 1 {
+			//seconds until the next token is available
+			retryAfter := int(math.Ceil((1.0 - remaining) / refillRate))
+			c.Writer.Header().Set("Retry-After", strconv.Itoa(retryAfter))
+			c.AbortWithStatusJSON(429, gin.H{"error": "Too many requests - please try again later"})
+			return
+		}
+
+		c.Next()
+	}
+}
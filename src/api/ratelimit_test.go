@@ -0,0 +1,141 @@
+package main
+
+import (
+	"github.com/alicebob/miniredis"
+	"github.com/garyburd/redigo/redis"
+	"github.com/gin-gonic/gin"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// newTestRedisPool starts an in-memory redis server and returns a pool that connects to it
+func newTestRedisPool(t *testing.T) (*miniredis.Miniredis, *redis.Pool) {
+	server, err := miniredis.Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	redisPool := redis.NewPool(func() (redis.Conn, error) {
+		return redis.Dial("tcp", server.Addr())
+	}, 5)
+	return server, redisPool
+}
+
+func newRateLimitedRouter(redisPool *redis.Pool, proxies trustedProxies, limitPerMinute int) *gin.Engine {
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.GET("/", RateLimitMiddleware(redisPool, proxies, "test", limitPerMinute), func(c *gin.Context) {
+		c.String(200, "ok")
+	})
+	return router
+}
+
+func doRateLimitedRequest(router *gin.Engine, remoteAddr string, headers map[string]string) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("GET", "/", nil)
+	r.RemoteAddr = remoteAddr
+	for name, value := range headers {
+		r.Header.Set(name, value)
+	}
+	router.ServeHTTP(w, r)
+	return w
+}
+
+func TestRateLimitRefillsTokens(t *testing.T) {
+	server, redisPool := newTestRedisPool(t)
+	defer server.Close()
+	defer redisPool.Close()
+
+	//2 tokens per second
+	router := newRateLimitedRouter(redisPool, nil, 120)
+	for i := 0; i < 120; i++ {
+		if w := doRateLimitedRequest(router, "192.0.2.1:1234", nil); w.Code != 200 {
+			t.Fatalf("expected request %d to be allowed, got %d", i+1, w.Code)
+		}
+	}
+
+	w := doRateLimitedRequest(router, "192.0.2.1:1234", nil)
+	if w.Code != 429 || w.Header().Get("Retry-After") != "1" || w.Header().Get("RateLimit-Remaining") != "0" {
+		t.Fatalf("expected 429 with Retry-After 1, got %d (Retry-After %q, RateLimit-Remaining %q)", w.Code,
+			w.Header().Get("Retry-After"), w.Header().Get("RateLimit-Remaining"))
+	}
+
+	//other clients have their own bucket
+	if w := doRateLimitedRequest(router, "192.0.2.2:1234", nil); w.Code != 200 {
+		t.Errorf("expected request of another client to be allowed, got %d", w.Code)
+	}
+
+	time.Sleep(600 * time.Millisecond)
+	if w := doRateLimitedRequest(router, "192.0.2.1:1234", nil); w.Code != 200 {
+		t.Errorf("expected request to be allowed after the refill, got %d", w.Code)
+	}
+	if w := doRateLimitedRequest(router, "192.0.2.1:1234", nil); w.Code != 429 {
+		t.Errorf("expected only one token to be refilled, got %d", w.Code)
+	}
+}
+
+func TestRateLimitIgnoresForwardingHeadersOfClients(t *testing.T) {
+	server, redisPool := newTestRedisPool(t)
+	defer server.Close()
+	defer redisPool.Close()
+
+	proxies, err := parseTrustedProxies("10.0.0.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	router := newRateLimitedRouter(redisPool, proxies, 1)
+	if w := doRateLimitedRequest(router, "192.0.2.1:1234", nil); w.Code != 200 {
+		t.Fatalf("expected first request to be allowed, got %d", w.Code)
+	}
+	for _, header := range []string{"X-Forwarded-For", "X-Real-Ip"} {
+		w := doRateLimitedRequest(router, "192.0.2.1:1234", map[string]string{header: "198.51.100.1"})
+		if w.Code != 429 {
+			t.Errorf("expected %s of a client to be ignored, got %d", header, w.Code)
+		}
+	}
+
+	//the headers of the proxy are used
+	for header, ip := range map[string]string{"X-Forwarded-For": "198.51.100.1", "X-Real-Ip": "198.51.100.2"} {
+		w := doRateLimitedRequest(router, "10.0.0.1:1234", map[string]string{header: ip})
+		if w.Code != 200 {
+			t.Errorf("expected %s of the proxy to be used, got %d", header, w.Code)
+		}
+	}
+}
+
+func TestClientIp(t *testing.T) {
+	proxies, err := parseTrustedProxies("10.0.0.0/8, ::1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		remoteAddr   string
+		forwardedFor string
+		realIp       string
+		expectedIp   string
+	}{
+		{"192.0.2.1:1234", "198.51.100.1", "198.51.100.2", "192.0.2.1"},
+		{"10.1.2.3:1234", "", "", "10.1.2.3"},
+		{"10.1.2.3:1234", "198.51.100.1", "198.51.100.2", "198.51.100.1"},
+		{"10.1.2.3:1234", "", "198.51.100.2", "198.51.100.2"},
+		{"[::1]:1234", "203.0.113.9, 198.51.100.1, 10.0.0.2", "", "198.51.100.1"},
+		{"10.1.2.3:1234", "garbage", "", "10.1.2.3"},
+	}
+
+	for _, test := range tests {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.RemoteAddr = test.remoteAddr
+		r.Header.Set("X-Forwarded-For", test.forwardedFor)
+		r.Header.Set("X-Real-Ip", test.realIp)
+		if ip := proxies.clientIp(r); ip != test.expectedIp {
+			t.Errorf("expected ip %s for %+v, got %s", test.expectedIp, test, ip)
+		}
+	}
+
+	if _, err := parseTrustedProxies("10.0.0.0/33"); err == nil {
+		t.Errorf("expected invalid CIDR range to be rejected")
+	}
+}
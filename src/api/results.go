@@ -0,0 +1,78 @@
+package main
+
+import (
+	"encoding/json"
+	datastructures "github.com/bbernhard/imagemonkey-playground/datastructures"
+	"github.com/gin-gonic/gin"
+)
+
+//getPredictMeResponse converts the prediction result which was stored by the predict
+//worker into the response that we send to the client.
+func getPredictMeResponse(jobState datastructures.JobState, data []byte) (gin.H, error) {
+	var predictionResult datastructures.PredictionResult
+	err := json.Unmarshal(data, &predictionResult)
+	if err != nil {
+		return nil, err
+	}
+
+	if predictionResult.Error != nil {
+		return gin.H{"error": predictionResult.Error, "model_info": predictionResult.ModelInfo,
+			"state": jobState.State}, nil
+	}
+
+	//results stored by older workers don't contain the ranked list
+	predictions := predictionResult.Predictions
+	if len(predictions) == 0 {
+		predictions = []datastructures.TFResult{predictionResult.Result}
+	}
+
+	return gin.H{"label": predictionResult.Result.Label, "score": predictionResult.Result.Score,
+		"predictions": predictions, "model_info": predictionResult.ModelInfo, "state": jobState.State}, nil
+}
+
+//getGrabcutMeResponse converts the grabcut result which was stored by the grabcut
+//worker into the response that we send to the client.
+func getGrabcutMeResponse(jobState datastructures.JobState, data []byte) (gin.H, error) {
+	var grabcutResult datastructures.GrabcutResult
+	err := json.Unmarshal(data, &grabcutResult)
+	if err != nil {
+		return nil, err
+	}
+
+	simplification := defaultSimplification
+	if grabcutResult.Simplification != nil {
+		simplification = *grabcutResult.Simplification
+	}
+
+	var polygonOptions datastructures.GrabcutPolygonOptions
+	if grabcutResult.PolygonOptions != nil {
+		polygonOptions = *grabcutResult.PolygonOptions
+	}
+
+	var grabcutMeResult datastructures.GrabcutMeResult
+	grabcutMeResult.Angle = 0
+	grabcutMeResult.Type = "polygon"
+	grabcutMeResult.Tolerance = simplification.Tolerance
+	grabcutMeResult.Width = grabcutResult.Width
+	grabcutMeResult.Height = grabcutResult.Height
+
+	polygons := getGrabcutPolygons(grabcutResult, polygonOptions.MinArea)
+	if len(polygons) > 0 {
+		//simplify polyline of the biggest polygon
+		simplifiedDataPoints, tolerance := simplifyPolygon(polygons[0].Points, simplification)
+		grabcutMeResult.Points = getGrabcutMeResultPoints(simplifiedDataPoints)
+		grabcutMeResult.OriginalVertices = len(polygons[0].Points)
+		grabcutMeResult.Vertices = len(simplifiedDataPoints)
+		grabcutMeResult.Tolerance = tolerance
+
+		if polygonOptions.All {
+			grabcutMeResult.Polygons, grabcutMeResult.OriginalVertices, grabcutMeResult.Vertices, grabcutMeResult.Tolerance =
+				simplifyAllGrabcutPolygons(polygons, simplifiedDataPoints, tolerance, simplification)
+		}
+	}
+
+	if grabcutResult.Error == "" {
+		return gin.H{"result": grabcutMeResult, "state": jobState.State}, nil
+	}
+	return gin.H{"result": grabcutMeResult, "error": grabcutResult.Error, "state": jobState.State}, nil
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	commons "github.com/bbernhard/imagemonkey-playground/commons"
+	datastructures "github.com/bbernhard/imagemonkey-playground/datastructures"
+	"github.com/garyburd/redigo/redis"
+	"github.com/gofrs/uuid"
+	"image"
+	"time"
+)
+
+//a session is kept as long as the job states of its rounds
+const grabcutSessionExpiration = 86400
+
+const maxGrabcutSessionRounds = 50
+
+var errGrabcutSessionConflict = errors.New("grabcut session was modified concurrently")
+
+func grabcutSessionKey(sessionUuid string) string {
+	return "grabcutsession" + sessionUuid
+}
+
+//sendGrabcutSessionRound sends the commands that store the session and enqueue the
+//grabcut request of its newest round. Meant to be used within a transaction.
+func sendGrabcutSessionRound(redisConn redis.Conn, session datastructures.GrabcutSession,
+	grabcutRequest datastructures.GrabcutRequest) error {
+	serialized, err := json.Marshal(session)
+	if err != nil {
+		return err
+	}
+
+	err = redisConn.Send("SETEX", grabcutSessionKey(session.Uuid), grabcutSessionExpiration, serialized)
+	if err != nil {
+		return err
+	}
+	return sendGrabcutRequest(redisConn, grabcutRequest)
+}
+
+//createGrabcutSession starts a new session, whose first round is a grabcut request with the given mask
+func createGrabcutSession(redisConn redis.Conn, params grabcutParams, mask *image.Gray) (datastructures.GrabcutSession, error) {
+	var session datastructures.GrabcutSession
+
+	u, err := uuid.NewV4()
+	if err != nil {
+		return session, err
+	}
+
+	session.Mask, err = encodeGrabcutMask(mask)
+	if err != nil {
+		return session, err
+	}
+
+	grabcutRequest, err := newGrabcutRequest(params, session.Mask)
+	if err != nil {
+		return session, err
+	}
+
+	session.Uuid = u.String()
+	session.Image = params.Image
+	session.Created = time.Now().Unix()
+	session.Updated = session.Created
+	session.CallbackUrl = params.CallbackUrl
+	session.Simplification = params.Simplification
+	session.PolygonOptions = params.PolygonOptions
+	session.Rounds = []datastructures.GrabcutSessionRound{{Uuid: grabcutRequest.Uuid, Created: session.Created}}
+
+	redisConn.Send("MULTI")
+	err = sendGrabcutSessionRound(redisConn, session, grabcutRequest)
+	if err != nil {
+		redisConn.Do("DISCARD")
+		return session, err
+	}
+	_, err = redisConn.Do("EXEC")
+	return session, err
+}
+
+//watchGrabcutSession returns the session with the given uuid and watches it, so that
+//refineGrabcutSession fails in case the session was modified in the meantime. found is
+//false if there is no such session.
+func watchGrabcutSession(redisConn redis.Conn, sessionUuid string) (datastructures.GrabcutSession, bool, error) {
+	_, err := redisConn.Do("WATCH", grabcutSessionKey(sessionUuid))
+	if err != nil {
+		return datastructures.GrabcutSession{}, false, err
+	}
+	return getGrabcutSession(redisConn, sessionUuid)
+}
+
+//getGrabcutSession returns the session with the given uuid. found is false if there is no such session.
+func getGrabcutSession(redisConn redis.Conn, sessionUuid string) (session datastructures.GrabcutSession, found bool, err error) {
+	data, err := redis.Bytes(redisConn.Do("GET", grabcutSessionKey(sessionUuid)))
+	if err == redis.ErrNil {
+		return session, false, nil
+	}
+	if err != nil {
+		return session, false, err
+	}
+
+	err = json.Unmarshal(data, &session)
+	return session, err == nil, err
+}
+
+//refineGrabcutSession draws the corrections (which are scaled to the size of the mask)
+//on the mask of the previous round and starts a new round with the merged mask. The
+//session needs to be watched with watchGrabcutSession, errGrabcutSessionConflict is
+//returned if it was modified in the meantime.
+func refineGrabcutSession(redisConn redis.Conn, session datastructures.GrabcutSession, donationPath string,
+	corrections datastructures.GrabcutStrokes, limits uploadLimits) (datastructures.GrabcutSession, error) {
+	mask, err := decodeGrabcutMask(session.Mask, limits)
+	if err != nil {
+		return session, err
+	}
+
+	bounds := mask.Bounds()
+	drawGrabcutStrokes(mask, scaleGrabcutStrokes(corrections, bounds.Dx(), bounds.Dy()))
+
+	session.Mask, err = encodeGrabcutMask(mask)
+	if err != nil {
+		return session, err
+	}
+
+	params := grabcutParams{Image: session.Image, DonationPath: donationPath, CallbackUrl: session.CallbackUrl,
+		Simplification: session.Simplification, PolygonOptions: session.PolygonOptions}
+	grabcutRequest, err := newGrabcutRequest(params, session.Mask)
+	if err != nil {
+		return session, err
+	}
+
+	session.Updated = time.Now().Unix()
+	session.Rounds = append(session.Rounds, datastructures.GrabcutSessionRound{Uuid: grabcutRequest.Uuid,
+		Created: session.Updated, Strokes: &corrections})
+
+	redisConn.Send("MULTI")
+	err = sendGrabcutSessionRound(redisConn, session, grabcutRequest)
+	if err != nil {
+		redisConn.Do("DISCARD")
+		return session, err
+	}
+
+	//the transaction is aborted (nil reply), if the watched session was modified
+	reply, err := redisConn.Do("EXEC")
+	if err == nil && reply == nil {
+		err = errGrabcutSessionConflict
+	}
+	return session, err
+}
+
+//getGrabcutSessionResponse returns the state (and if available the result) of every
+//round of the session.
+func getGrabcutSessionResponse(redisConn redis.Conn, session datastructures.GrabcutSession) (datastructures.GrabcutMeSession, error) {
+	response := datastructures.GrabcutMeSession{Uuid: session.Uuid, Image: session.Image, Created: session.Created,
+		Updated: session.Updated, Rounds: []datastructures.GrabcutMeSessionRound{}}
+
+	for i, round := range session.Rounds {
+		item := datastructures.GrabcutMeSessionRound{Round: (i + 1), Uuid: round.Uuid, Created: round.Created,
+			Strokes: round.Strokes}
+
+		jobState, found, err := commons.GetJobState(redisConn, round.Uuid)
+		if err != nil {
+			return response, err
+		}
+		if !found {
+			jobState.State = commons.JobStateExpired
+		}
+
+		if jobState.State == commons.JobStateDone || jobState.State == commons.JobStateFailed {
+			data, err := redis.Bytes(redisConn.Do("GET", getResultKey(commons.JobTypeGrabcut, round.Uuid)))
+			if err == nil {
+				item.Result, err = getGrabcutMeResponse(jobState, data)
+				if err != nil {
+					return response, err
+				}
+			} else if err == redis.ErrNil {
+				if jobState.State == commons.JobStateDone {
+					jobState.State = commons.JobStateExpired
+				}
+			} else {
+				return response, err
+			}
+		}
+
+		item.State = jobState.State
+		item.Error = jobState.Error
+		response.Rounds = append(response.Rounds, item)
+	}
+
+	return response, nil
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	datastructures "github.com/bbernhard/imagemonkey-playground/datastructures"
+	"github.com/gin-gonic/gin"
+	"github.com/yrsh/simplify-go"
+	"math"
+	"strconv"
+)
+
+const (
+	defaultSimplifyTolerance = 1.5
+	maxSimplifyTolerance     = 100
+	minSimplifyVertices      = 3
+	maxSimplifyVertices      = 10000
+)
+
+//defaultSimplification is used for requests without simplification options (and for
+//results of requests that were created before the options existed)
+var defaultSimplification = datastructures.GrabcutSimplification{Tolerance: defaultSimplifyTolerance}
+
+//getSimplificationOptions parses the simplification form values of a grabcut request.
+//In case a value is invalid, the response is written and ok is false.
+func getSimplificationOptions(c *gin.Context) (options *datastructures.GrabcutSimplification, ok bool) {
+	rawTolerance := c.PostForm("tolerance")
+	rawHighQuality := c.PostForm("high_quality")
+	rawMaxVertices := c.PostForm("max_vertices")
+	if rawTolerance == "" && rawHighQuality == "" && rawMaxVertices == "" {
+		return nil, true
+	}
+
+	simplification := defaultSimplification
+	if rawTolerance != "" && rawMaxVertices != "" {
+		c.JSON(422, gin.H{"error": "Invalid simplification - either set tolerance or max_vertices"})
+		return nil, false
+	}
+
+	if rawTolerance != "" {
+		tolerance, err := strconv.ParseFloat(rawTolerance, 64)
+		if err != nil || math.IsNaN(tolerance) || tolerance < 0 || tolerance > maxSimplifyTolerance {
+			c.JSON(422, gin.H{"error": ("Invalid tolerance - needs to be a number between 0 and " +
+				strconv.Itoa(maxSimplifyTolerance))})
+			return nil, false
+		}
+		simplification.Tolerance = tolerance
+	}
+
+	if rawHighQuality != "" {
+		highQuality, err := strconv.ParseBool(rawHighQuality)
+		if err != nil {
+			c.JSON(422, gin.H{"error": "Invalid high_quality - needs to be true or false"})
+			return nil, false
+		}
+		simplification.HighQuality = highQuality
+	}
+
+	if rawMaxVertices != "" {
+		maxVertices, err := strconv.Atoi(rawMaxVertices)
+		if err != nil || maxVertices < minSimplifyVertices || maxVertices > maxSimplifyVertices {
+			c.JSON(422, gin.H{"error": ("Invalid max_vertices - needs to be a number between " +
+				strconv.Itoa(minSimplifyVertices) + " and " + strconv.Itoa(maxSimplifyVertices))})
+			return nil, false
+		}
+		simplification.MaxVertices = maxVertices
+		simplification.Tolerance = 0
+	}
+
+	return &simplification, true
+}
+
+//simplifyPolygon simplifies the polygon with the given options. If MaxVertices is set, the
+//smallest tolerance which results in at least 3 and at most MaxVertices vertices is searched.
+//Returns the simplified polygon and the tolerance that was used.
+func simplifyPolygon(points [][]float64, options datastructures.GrabcutSimplification) ([][]float64, float64) {
+	if options.MaxVertices <= 0 {
+		return simplifier.Simplify(points, options.Tolerance, options.HighQuality), options.Tolerance
+	}
+
+	if len(points) <= options.MaxVertices {
+		return points, 0
+	}
+
+	tolerance, found := searchSimplifyTolerance(getMaxSimplifyTolerance(points), options.MaxVertices,
+		func(tolerance float64) int {
+			return len(simplifier.Simplify(points, tolerance, options.HighQuality))
+		})
+	if !found {
+		//the simplification jumps from too many vertices to a line, keep every n-th vertex instead
+		return samplePolygon(points, options.MaxVertices), tolerance
+	}
+	return simplifier.Simplify(points, tolerance, options.HighQuality), tolerance
+}
+
+//getMaxSimplifyTolerance returns the diagonal of the bounding box of the points. With this
+//tolerance only the first and the last point remain.
+func getMaxSimplifyTolerance(points [][]float64) float64 {
+	minX, minY := math.Inf(1), math.Inf(1)
+	maxX, maxY := math.Inf(-1), math.Inf(-1)
+	for _, point := range points {
+		minX, maxX = math.Min(minX, point[0]), math.Max(maxX, point[0])
+		minY, maxY = math.Min(minY, point[1]), math.Max(maxY, point[1])
+	}
+	return math.Hypot(maxX-minX, maxY-minY)
+}
+
+//searchSimplifyTolerance searches the smallest tolerance (up to maxTolerance) for which
+//countVertices returns at least 3 and at most maxVertices vertices. found is false if there
+//is no such tolerance, the returned tolerance is the smallest one with at most maxVertices
+//vertices in that case.
+func searchSimplifyTolerance(maxTolerance float64, maxVertices int, countVertices func(tolerance float64) int) (tolerance float64, found bool) {
+	low, high := 0.0, maxTolerance
+	tolerance = high
+	for i := 0; i < 32 && high-low > 0.01; i++ {
+		current := (low + high) / 2
+		vertices := countVertices(current)
+		if vertices > maxVertices {
+			low = current
+			continue
+		}
+
+		high = current
+		if vertices >= minSimplifyVertices {
+			tolerance, found = current, true
+		} else if !found {
+			tolerance = current
+		}
+	}
+
+	return tolerance, found
+}
+
+//samplePolygon returns n evenly distributed vertices of the polygon
+func samplePolygon(points [][]float64, n int) [][]float64 {
+	sampled := make([][]float64, n)
+	for i := range sampled {
+		sampled[i] = points[i*len(points)/n]
+	}
+	return sampled
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"encoding/json"
+	datastructures "github.com/bbernhard/imagemonkey-playground/datastructures"
+	"github.com/gin-gonic/gin"
+	"math"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func getCirclePolygon(n int, radius float64) [][]float64 {
+	var points [][]float64
+	for i := 0; i < n; i++ {
+		angle := 2 * math.Pi * float64(i) / float64(n)
+		points = append(points, []float64{200 + radius*math.Cos(angle), 200 + radius*math.Sin(angle)})
+	}
+	return points
+}
+
+func TestSimplifyPolygonMaxVertices(t *testing.T) {
+	points := getCirclePolygon(720, 150)
+
+	for _, maxVertices := range []int{3, 10, 50, 200} {
+		simplified, tolerance := simplifyPolygon(points, datastructures.GrabcutSimplification{MaxVertices: maxVertices})
+		if len(simplified) > maxVertices || len(simplified) < 3 {
+			t.Errorf("expected at most %d vertices, got %d", maxVertices, len(simplified))
+		}
+
+		//a slightly smaller tolerance needs to exceed the vertex budget, otherwise the tolerance is too coarse
+		if finer, _ := simplifyPolygon(points, datastructures.GrabcutSimplification{Tolerance: tolerance * 0.9}); len(finer) <= maxVertices {
+			t.Errorf("tolerance %f for %d vertices isn't minimal", tolerance, maxVertices)
+		}
+	}
+
+	simplified, tolerance := simplifyPolygon(points[:20], datastructures.GrabcutSimplification{MaxVertices: 50})
+	if len(simplified) != 20 || tolerance != 0 {
+		t.Errorf("expected small polygon to stay unchanged, got %d vertices (tolerance %f)", len(simplified), tolerance)
+	}
+}
+
+func TestSearchSimplifyTolerance(t *testing.T) {
+	//the simplification jumps from 10 vertices to a line
+	tolerance, found := searchSimplifyTolerance(100, 3, func(tolerance float64) int {
+		if tolerance < 5 {
+			return 10
+		}
+		return 2
+	})
+	if found || math.Abs(tolerance-5) > 0.1 {
+		t.Errorf("expected no tolerance to be found, got %f (found %v)", tolerance, found)
+	}
+
+	tolerance, found = searchSimplifyTolerance(100, 3, func(tolerance float64) int {
+		if tolerance < 5 {
+			return 10
+		}
+		return 3
+	})
+	if !found || math.Abs(tolerance-5) > 0.1 {
+		t.Errorf("expected tolerance 5, got %f (found %v)", tolerance, found)
+	}
+}
+
+func TestSimplifyPolygonKeepsAPolygon(t *testing.T) {
+	//the contour of a one pixel wide line is simplified straight to the line
+	var points [][]float64
+	for x := 0; x <= 100; x++ {
+		points = append(points, []float64{float64(x), 0})
+	}
+	for x := 99; x >= 1; x-- {
+		points = append(points, []float64{float64(x), 0})
+	}
+
+	simplified, _ := simplifyPolygon(points, datastructures.GrabcutSimplification{MaxVertices: 3})
+	if len(simplified) != 3 {
+		t.Errorf("expected 3 vertices, got %d", len(simplified))
+	}
+}
+
+func TestGrabcutMeResponseMaxVerticesOfAllPolygons(t *testing.T) {
+	var polygons []datastructures.GrabcutPolygon
+	for i, radius := range []float64{150, 100, 50} {
+		points := getCirclePolygon(360, radius)
+		for _, point := range points {
+			point[0] += float64(i) * 400
+		}
+		polygons = append(polygons, datastructures.GrabcutPolygon{Points: points, Area: getPolygonArea(points)})
+	}
+
+	for _, maxVertices := range []int{3, 10, 50, 200} {
+		data, _ := json.Marshal(datastructures.GrabcutResult{Polygons: polygons,
+			Simplification: &datastructures.GrabcutSimplification{MaxVertices: maxVertices},
+			PolygonOptions: &datastructures.GrabcutPolygonOptions{All: true}})
+		response, err := getGrabcutMeResponse(datastructures.JobState{State: "done"}, data)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		result := response["result"].(datastructures.GrabcutMeResult)
+		vertices := 0
+		for _, polygon := range result.Polygons {
+			vertices += len(polygon.Points)
+			for _, hole := range polygon.Holes {
+				vertices += len(hole)
+			}
+		}
+		if len(result.Polygons) == 0 || vertices > maxVertices || vertices != result.Vertices {
+			t.Errorf("expected at most %d vertices in total, got %d (reported %d) in %d polygons", maxVertices, vertices,
+				result.Vertices, len(result.Polygons))
+		}
+	}
+}
+
+func TestGrabcutMeResponseSimplification(t *testing.T) {
+	points := getCirclePolygon(360, 100)
+
+	//results of requests without options are simplified with the default tolerance
+	data, _ := json.Marshal(datastructures.GrabcutResult{Points: points})
+	response, err := getGrabcutMeResponse(datastructures.JobState{State: "done"}, data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	result := response["result"].(datastructures.GrabcutMeResult)
+	if result.OriginalVertices != 360 || result.Vertices != len(result.Points) || result.Tolerance != defaultSimplifyTolerance {
+		t.Errorf("unexpected result %d/%d vertices, tolerance %f", result.Vertices, result.OriginalVertices, result.Tolerance)
+	}
+	defaultVertices := result.Vertices
+
+	data, _ = json.Marshal(datastructures.GrabcutResult{Points: points,
+		Simplification: &datastructures.GrabcutSimplification{Tolerance: 0.1, HighQuality: true}})
+	response, err = getGrabcutMeResponse(datastructures.JobState{State: "done"}, data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	result = response["result"].(datastructures.GrabcutMeResult)
+	if result.Vertices <= defaultVertices {
+		t.Errorf("expected a finer polygon than with the default tolerance, got %d vertices (default %d)", result.Vertices, defaultVertices)
+	}
+}
+
+func TestGetSimplificationOptions(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	parse := func(form url.Values) (*datastructures.GrabcutSimplification, bool, int) {
+		w := httptest.NewRecorder()
+		c, _ := gin.CreateTestContext(w)
+		c.Request = httptest.NewRequest("POST", "/v1/grabcut", strings.NewReader(form.Encode()))
+		c.Request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		options, ok := getSimplificationOptions(c)
+		return options, ok, w.Code
+	}
+
+	if options, ok, _ := parse(url.Values{}); !ok || options != nil {
+		t.Errorf("expected no options, got %+v", options)
+	}
+
+	options, ok, _ := parse(url.Values{"tolerance": {"0.5"}, "high_quality": {"true"}})
+	if !ok || options.Tolerance != 0.5 || !options.HighQuality {
+		t.Errorf("unexpected options %+v", options)
+	}
+
+	options, ok, _ = parse(url.Values{"max_vertices": {"20"}})
+	if !ok || options.MaxVertices != 20 {
+		t.Errorf("unexpected options %+v", options)
+	}
+
+	for _, form := range []url.Values{
+		{"tolerance": {"-1"}},
+		{"tolerance": {"NaN"}},
+		{"high_quality": {"maybe"}},
+		{"max_vertices": {"2"}},
+		{"tolerance": {"1"}, "max_vertices": {"10"}},
+	} {
+		if _, ok, code := parse(form); ok || code != 422 {
+			t.Errorf("expected %v to be rejected with 422, got %d", form, code)
+		}
+	}
+}
@@ -0,0 +1,311 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	datastructures "github.com/bbernhard/imagemonkey-playground/datastructures"
+	"image"
+	"image/draw"
+	"image/png"
+	"math"
+	"os"
+	"strconv"
+)
+
+//values of the grabcut mask (see get_contours() in grabcut.py)
+const (
+	maskBackground = 0
+	maskForeground = 255
+	maskProbable   = 128
+)
+
+const (
+	maxStrokePoints = 10000
+	maxBrushWidth   = 500
+)
+
+var maskValues = map[string]uint8{
+	"background": maskBackground,
+	"foreground": maskForeground,
+	"probable":   maskProbable,
+}
+
+//getImageSize returns the size of the image, without decoding the whole image
+func getImageSize(path string) (int, int, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer f.Close()
+
+	config, _, err := image.DecodeConfig(f)
+	if err != nil {
+		return 0, 0, err
+	}
+	return config.Width, config.Height, nil
+}
+
+func isFiniteNumber(numbers ...float64) bool {
+	for _, n := range numbers {
+		if math.IsNaN(n) || math.IsInf(n, 0) {
+			return false
+		}
+	}
+	return true
+}
+
+//parseGrabcutStrokes parses and validates the strokes of a grabcut request. The coordinates
+//of the strokes are relative to a canvas of width x height pixels, which defaults to the size
+//of the image and mustn't be bigger than the image. The returned error is meant for the client.
+func parseGrabcutStrokes(raw string, imageWidth int, imageHeight int, limits uploadLimits) (datastructures.GrabcutStrokes, error) {
+	strokes, err := parseGrabcutCorrections(raw, imageWidth, imageHeight)
+	if err != nil {
+		return strokes, err
+	}
+
+	if strokes.Width > limits.MaxDimension || strokes.Height > limits.MaxDimension || strokes.Width*strokes.Height > limits.MaxPixels {
+		return strokes, fmt.Errorf("canvas too large - max. %d pixels (%d per side) allowed, set a smaller width and height", limits.MaxPixels, limits.MaxDimension)
+	}
+	return strokes, nil
+}
+
+//parseGrabcutCorrections is like parseGrabcutStrokes, but doesn't limit the size of the
+//canvas, as the strokes are scaled to the size of an existing mask before they're drawn.
+func parseGrabcutCorrections(raw string, imageWidth int, imageHeight int) (datastructures.GrabcutStrokes, error) {
+	var strokes datastructures.GrabcutStrokes
+	err := json.Unmarshal([]byte(raw), &strokes)
+	if err != nil {
+		return strokes, errors.New("strokes need to be valid JSON")
+	}
+
+	if strokes.Width == 0 && strokes.Height == 0 {
+		strokes.Width, strokes.Height = imageWidth, imageHeight
+	}
+	if strokes.Width < 1 || strokes.Height < 1 || strokes.Width > imageWidth || strokes.Height > imageHeight {
+		return strokes, fmt.Errorf("width and height need to be between 1 and the size of the image (%dx%d)", imageWidth, imageHeight)
+	}
+
+	if len(strokes.Strokes) == 0 && len(strokes.Rectangles) == 0 {
+		return strokes, errors.New("at least one stroke or rectangle is required")
+	}
+
+	numPoints := 0
+	for _, stroke := range strokes.Strokes {
+		if _, found := maskValues[stroke.Type]; !found {
+			return strokes, errors.New("type of a stroke needs to be foreground, background or probable")
+		}
+		if !isFiniteNumber(stroke.Width) || stroke.Width <= 0 || stroke.Width > maxBrushWidth {
+			return strokes, fmt.Errorf("width of a stroke needs to be between 0 and %d", maxBrushWidth)
+		}
+		if len(stroke.Points) == 0 {
+			return strokes, errors.New("a stroke needs at least one point")
+		}
+		for _, point := range stroke.Points {
+			if len(point) != 2 || !isFiniteNumber(point...) {
+				return strokes, errors.New("points of a stroke need to be [x, y] pairs")
+			}
+		}
+
+		numPoints += len(stroke.Points)
+		if numPoints > maxStrokePoints {
+			return strokes, fmt.Errorf("too many points - max. %d allowed", maxStrokePoints)
+		}
+	}
+
+	for _, rectangle := range strokes.Rectangles {
+		if _, found := maskValues[rectangle.Type]; !found {
+			return strokes, errors.New("type of a rectangle needs to be foreground, background or probable")
+		}
+		if !isFiniteNumber(rectangle.X, rectangle.Y, rectangle.Width, rectangle.Height) || rectangle.Width <= 0 || rectangle.Height <= 0 {
+			return strokes, errors.New("rectangles need a positive width and height")
+		}
+	}
+
+	return strokes, nil
+}
+
+//getSquaredSegmentDistance returns the squared distance of point p to the segment a-b
+func getSquaredSegmentDistance(px, py, ax, ay, bx, by float64) float64 {
+	dx, dy := bx-ax, by-ay
+	if dx != 0 || dy != 0 {
+		t := ((px-ax)*dx + (py-ay)*dy) / (dx*dx + dy*dy)
+		t = math.Max(0, math.Min(1, t))
+		ax, ay = ax+t*dx, ay+t*dy
+	}
+	return (px-ax)*(px-ax) + (py-ay)*(py-ay)
+}
+
+//fillArea sets all pixels within the (clipped) area to value, for which inside returns
+//true (evaluated at the pixel center)
+func fillArea(mask *image.Gray, minX, minY, maxX, maxY float64, value uint8, inside func(x, y float64) bool) {
+	clip := func(n float64, max int) int {
+		return int(math.Max(0, math.Min(n, float64(max))))
+	}
+
+	bounds := mask.Bounds()
+	x0, y0 := clip(math.Floor(minX), bounds.Max.X), clip(math.Floor(minY), bounds.Max.Y)
+	x1, y1 := clip(math.Ceil(maxX), bounds.Max.X), clip(math.Ceil(maxY), bounds.Max.Y)
+
+	for y := y0; y < y1; y++ {
+		for x := x0; x < x1; x++ {
+			if inside(float64(x)+0.5, float64(y)+0.5) {
+				mask.Pix[y*mask.Stride+x] = value
+			}
+		}
+	}
+}
+
+//rasterizeGrabcutStrokes draws the strokes on a mask in which every other pixel is probable foreground
+func rasterizeGrabcutStrokes(strokes datastructures.GrabcutStrokes) *image.Gray {
+	mask := image.NewGray(image.Rect(0, 0, strokes.Width, strokes.Height))
+	for i := range mask.Pix {
+		mask.Pix[i] = maskProbable
+	}
+
+	drawGrabcutStrokes(mask, strokes)
+	return mask
+}
+
+//drawGrabcutStrokes draws the rectangles and afterwards the strokes (in the given order,
+//later ones overwrite earlier ones) on the mask. The strokes need to have the size of the mask.
+func drawGrabcutStrokes(mask *image.Gray, strokes datastructures.GrabcutStrokes) {
+	for _, rectangle := range strokes.Rectangles {
+		fillArea(mask, rectangle.X, rectangle.Y, rectangle.X+rectangle.Width, rectangle.Y+rectangle.Height,
+			maskValues[rectangle.Type], func(x, y float64) bool { return true })
+	}
+
+	for _, stroke := range strokes.Strokes {
+		radius := stroke.Width / 2
+		for i := range stroke.Points {
+			//a stroke with a single point is a dot
+			a, b := stroke.Points[i], stroke.Points[i]
+			if i > 0 {
+				a = stroke.Points[i-1]
+			} else if len(stroke.Points) > 1 {
+				continue
+			}
+
+			fillArea(mask, math.Min(a[0], b[0])-radius, math.Min(a[1], b[1])-radius,
+				math.Max(a[0], b[0])+radius, math.Max(a[1], b[1])+radius, maskValues[stroke.Type],
+				func(x, y float64) bool {
+					return getSquaredSegmentDistance(x, y, a[0], a[1], b[0], b[1]) <= radius*radius
+				})
+		}
+	}
+}
+
+//scaleGrabcutStrokes returns a copy of the strokes, scaled to a canvas of width x height pixels
+func scaleGrabcutStrokes(strokes datastructures.GrabcutStrokes, width int, height int) datastructures.GrabcutStrokes {
+	scaleX := float64(width) / float64(strokes.Width)
+	scaleY := float64(height) / float64(strokes.Height)
+
+	scaled := datastructures.GrabcutStrokes{Width: width, Height: height}
+	for _, stroke := range strokes.Strokes {
+		//brushes are round, so we can only approximate non-uniform scaling
+		scaledStroke := datastructures.GrabcutStroke{Type: stroke.Type, Width: stroke.Width * (scaleX + scaleY) / 2}
+		for _, point := range stroke.Points {
+			scaledStroke.Points = append(scaledStroke.Points, []float64{point[0] * scaleX, point[1] * scaleY})
+		}
+		scaled.Strokes = append(scaled.Strokes, scaledStroke)
+	}
+	for _, rectangle := range strokes.Rectangles {
+		scaled.Rectangles = append(scaled.Rectangles, datastructures.GrabcutRectangle{Type: rectangle.Type,
+			X: rectangle.X * scaleX, Y: rectangle.Y * scaleY, Width: rectangle.Width * scaleX, Height: rectangle.Height * scaleY})
+	}
+	return scaled
+}
+
+//decodeGrabcutMask decodes an uploaded grabcut mask. Color masks are converted to
+//grayscale, like the grabcut worker does. The returned error is meant for the client.
+func decodeGrabcutMask(data []byte, limits uploadLimits) (*image.Gray, error) {
+	config, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return nil, errors.New("mask needs to be an image")
+	}
+	if config.Width > limits.MaxDimension || config.Height > limits.MaxDimension || config.Width*config.Height > limits.MaxPixels {
+		return nil, fmt.Errorf("mask too large - max. %d pixels (%d per side) allowed", limits.MaxPixels, limits.MaxDimension)
+	}
+
+	img, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, errors.New("mask needs to be an image")
+	}
+
+	if mask, ok := img.(*image.Gray); ok {
+		return mask, nil
+	}
+
+	bounds := img.Bounds()
+	mask := image.NewGray(image.Rect(0, 0, bounds.Dx(), bounds.Dy()))
+	draw.Draw(mask, mask.Bounds(), img, bounds.Min, draw.Src)
+	return mask, nil
+}
+
+//getStrokesMask returns the rasterized strokes as PNG encoded grabcut mask
+func getStrokesMask(strokes datastructures.GrabcutStrokes) ([]byte, error) {
+	return encodeGrabcutMask(rasterizeGrabcutStrokes(strokes))
+}
+
+func encodeGrabcutMask(mask *image.Gray) ([]byte, error) {
+	var buf bytes.Buffer
+	err := png.Encode(&buf, mask)
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+//parseGrabcutBoundingBox returns the strokes of a grabcut request that only has a bounding box
+//(in pixels or, if normalized, relative to the size of the image): everything outside of the
+//box is background, everything inside probable foreground. The mask is scaled down, if the
+//image exceeds the limits. The returned error is meant for the client.
+func parseGrabcutBoundingBox(rawX, rawY, rawWidth, rawHeight, rawNormalized string, imageWidth int, imageHeight int,
+	limits uploadLimits) (datastructures.GrabcutStrokes, error) {
+	var strokes datastructures.GrabcutStrokes
+
+	normalized := false
+	if rawNormalized != "" {
+		var err error
+		normalized, err = strconv.ParseBool(rawNormalized)
+		if err != nil {
+			return strokes, errors.New("normalized needs to be true or false")
+		}
+	}
+
+	var box [4]float64
+	for i, raw := range []string{rawX, rawY, rawWidth, rawHeight} {
+		n, err := strconv.ParseFloat(raw, 64)
+		if err != nil || !isFiniteNumber(n) {
+			return strokes, errors.New("x, y, width and height need to be numbers")
+		}
+		box[i] = n
+	}
+
+	if normalized {
+		box[0], box[2] = box[0]*float64(imageWidth), box[2]*float64(imageWidth)
+		box[1], box[3] = box[1]*float64(imageHeight), box[3]*float64(imageHeight)
+	}
+
+	//allow for rounding errors of normalized coordinates
+	const epsilon = 0.001
+	if box[0] < 0 || box[1] < 0 || box[2] <= 0 || box[3] <= 0 ||
+		box[0]+box[2] > float64(imageWidth)+epsilon || box[1]+box[3] > float64(imageHeight)+epsilon {
+		return strokes, fmt.Errorf("the bounding box needs to be inside the image (%dx%d)", imageWidth, imageHeight)
+	}
+	if box[0] < 1 && box[1] < 1 && box[0]+box[2] > float64(imageWidth)-1 && box[1]+box[3] > float64(imageHeight)-1 {
+		return strokes, errors.New("the bounding box can't cover the whole image, some background is required")
+	}
+
+	scale := math.Min(1, float64(limits.MaxDimension)/math.Max(float64(imageWidth), float64(imageHeight)))
+	scale = math.Min(scale, math.Sqrt(float64(limits.MaxPixels)/float64(imageWidth*imageHeight)))
+
+	strokes.Width = int(math.Max(1, math.Floor(float64(imageWidth)*scale)))
+	strokes.Height = int(math.Max(1, math.Floor(float64(imageHeight)*scale)))
+	strokes.Rectangles = []datastructures.GrabcutRectangle{
+		{Type: "background", X: 0, Y: 0, Width: float64(strokes.Width), Height: float64(strokes.Height)},
+		{Type: "probable", X: box[0] * scale, Y: box[1] * scale, Width: box[2] * scale, Height: box[3] * scale},
+	}
+	return strokes, nil
+}
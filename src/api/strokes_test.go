@@ -0,0 +1,224 @@
+package main
+
+import (
+	"bytes"
+	datastructures "github.com/bbernhard/imagemonkey-playground/datastructures"
+	"image"
+	"image/color"
+	"image/png"
+	"reflect"
+	"testing"
+)
+
+var testStrokeLimits = uploadLimits{MaxSize: 1024, MaxDimension: 1000, MaxPixels: 100000}
+
+func TestParseGrabcutStrokes(t *testing.T) {
+	strokes, err := parseGrabcutStrokes(`{"strokes": [{"type": "foreground", "width": 5, "points": [[1, 1], [10, 10]]}]}`,
+		200, 100, testStrokeLimits)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strokes.Width != 200 || strokes.Height != 100 {
+		t.Errorf("expected the size of the image as default canvas, got %dx%d", strokes.Width, strokes.Height)
+	}
+
+	for _, raw := range []string{
+		`not json`,
+		`{}`,
+		`{"width": 300, "height": 100, "rectangles": [{"type": "background", "x": 0, "y": 0, "width": 1, "height": 1}]}`,
+		`{"strokes": [{"type": "sky", "width": 5, "points": [[1, 1]]}]}`,
+		`{"strokes": [{"type": "foreground", "width": 0, "points": [[1, 1]]}]}`,
+		`{"strokes": [{"type": "foreground", "width": 5, "points": []}]}`,
+		`{"strokes": [{"type": "foreground", "width": 5, "points": [[1, 1, 1]]}]}`,
+		`{"rectangles": [{"type": "background", "x": 0, "y": 0, "width": -1, "height": 1}]}`,
+	} {
+		if _, err = parseGrabcutStrokes(raw, 200, 100, testStrokeLimits); err == nil {
+			t.Errorf("expected %s to be rejected", raw)
+		}
+	}
+
+	if _, err = parseGrabcutStrokes(`{"strokes": [{"type": "foreground", "width": 5, "points": [[1, 1]]}]}`,
+		2000, 1000, testStrokeLimits); err == nil {
+		t.Errorf("expected canvas that exceeds the limits to be rejected")
+	}
+}
+
+func TestRasterizeGrabcutStrokes(t *testing.T) {
+	mask := rasterizeGrabcutStrokes(datastructures.GrabcutStrokes{
+		Width:  20,
+		Height: 10,
+		Rectangles: []datastructures.GrabcutRectangle{
+			{Type: "background", X: 0, Y: 0, Width: 20, Height: 2},
+		},
+		Strokes: []datastructures.GrabcutStroke{
+			{Type: "foreground", Width: 2, Points: [][]float64{{2, 5}, {12, 5}}},
+			{Type: "background", Width: 3, Points: [][]float64{{18, 8}}},
+			//strokes overwrite the rectangles
+			{Type: "foreground", Width: 2, Points: [][]float64{{10, -5}, {10, 20}}},
+		},
+	})
+
+	expected := map[image.Point]uint8{
+		{5, 0}:  maskBackground, //rectangle
+		{5, 5}:  maskForeground, //first stroke
+		{5, 4}:  maskForeground,
+		{5, 6}:  maskProbable,
+		{14, 5}: maskProbable,
+		{18, 8}: maskBackground, //dot
+		{17, 7}: maskBackground,
+		{15, 8}: maskProbable,
+		{10, 0}: maskForeground, //last stroke
+		{0, 9}:  maskProbable,
+	}
+	for p, value := range expected {
+		if mask.GrayAt(p.X, p.Y).Y != value {
+			t.Errorf("expected %d at %v, got %d", value, p, mask.GrayAt(p.X, p.Y).Y)
+		}
+	}
+}
+
+func TestGetStrokesMask(t *testing.T) {
+	data, err := getStrokesMask(datastructures.GrabcutStrokes{Width: 4, Height: 3,
+		Strokes: []datastructures.GrabcutStroke{{Type: "foreground", Width: 1, Points: [][]float64{{0.5, 0.5}}}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	img, err := png.Decode(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	gray, ok := img.(*image.Gray)
+	if !ok || gray.Bounds().Dx() != 4 || gray.Bounds().Dy() != 3 {
+		t.Fatalf("expected 4x3 grayscale PNG, got %T %v", img, img.Bounds())
+	}
+	if gray.GrayAt(0, 0).Y != maskForeground || gray.GrayAt(3, 2).Y != maskProbable {
+		t.Errorf("unexpected mask %v", gray.Pix)
+	}
+}
+
+func TestParseGrabcutBoundingBox(t *testing.T) {
+	strokes, err := parseGrabcutBoundingBox("10", "20", "50", "30", "", 200, 100, testStrokeLimits)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mask := rasterizeGrabcutStrokes(strokes)
+	if mask.Bounds().Dx() != 200 || mask.Bounds().Dy() != 100 {
+		t.Fatalf("expected mask of the size of the image, got %v", mask.Bounds())
+	}
+	expected := map[image.Point]uint8{{5, 5}: maskBackground, {10, 20}: maskProbable, {59, 49}: maskProbable,
+		{60, 49}: maskBackground, {199, 99}: maskBackground}
+	for p, value := range expected {
+		if mask.GrayAt(p.X, p.Y).Y != value {
+			t.Errorf("expected %d at %v, got %d", value, p, mask.GrayAt(p.X, p.Y).Y)
+		}
+	}
+
+	normalized, err := parseGrabcutBoundingBox("0.05", "0.2", "0.25", "0.3", "true", 200, 100, testStrokeLimits)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if normalized.Rectangles[1] != strokes.Rectangles[1] {
+		t.Errorf("expected normalized bounding box %+v, got %+v", strokes.Rectangles[1], normalized.Rectangles[1])
+	}
+
+	//images that exceed the limits get a smaller mask
+	scaled, err := parseGrabcutBoundingBox("100", "100", "500", "500", "", 2000, 1000, testStrokeLimits)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if scaled.Width*scaled.Height > testStrokeLimits.MaxPixels || scaled.Width > testStrokeLimits.MaxDimension ||
+		scaled.Width/2 != scaled.Height {
+		t.Errorf("expected scaled down mask, got %dx%d", scaled.Width, scaled.Height)
+	}
+
+	for _, box := range [][5]string{
+		{"a", "0", "10", "10", ""},
+		{"0", "0", "0", "10", ""},
+		{"-1", "0", "10", "10", ""},
+		{"150", "0", "60", "10", ""},
+		{"0", "0", "200", "100", ""},
+		{"0", "0", "1", "1", "true"},
+		{"0", "0", "0.5", "0.5", "maybe"},
+	} {
+		if _, err = parseGrabcutBoundingBox(box[0], box[1], box[2], box[3], box[4], 200, 100, testStrokeLimits); err == nil {
+			t.Errorf("expected %v to be rejected", box)
+		}
+	}
+}
+
+func TestScaleGrabcutStrokes(t *testing.T) {
+	strokes := datastructures.GrabcutStrokes{Width: 200, Height: 100,
+		Strokes:    []datastructures.GrabcutStroke{{Type: "foreground", Width: 10, Points: [][]float64{{20, 10}, {100, 50}}}},
+		Rectangles: []datastructures.GrabcutRectangle{{Type: "background", X: 0, Y: 0, Width: 200, Height: 10}}}
+
+	scaled := scaleGrabcutStrokes(strokes, 100, 50)
+	if scaled.Width != 100 || scaled.Height != 50 {
+		t.Errorf("expected canvas of 100x50, got %dx%d", scaled.Width, scaled.Height)
+	}
+	if scaled.Strokes[0].Width != 5 || !reflect.DeepEqual(scaled.Strokes[0].Points, [][]float64{{10, 5}, {50, 25}}) {
+		t.Errorf("unexpected scaled stroke %+v", scaled.Strokes[0])
+	}
+	if scaled.Rectangles[0] != (datastructures.GrabcutRectangle{Type: "background", X: 0, Y: 0, Width: 100, Height: 5}) {
+		t.Errorf("unexpected scaled rectangle %+v", scaled.Rectangles[0])
+	}
+	if strokes.Strokes[0].Points[1][0] != 100 {
+		t.Errorf("expected the original strokes to be unchanged")
+	}
+}
+
+func TestMergeGrabcutCorrections(t *testing.T) {
+	previous, err := getStrokesMask(datastructures.GrabcutStrokes{Width: 100, Height: 50,
+		Rectangles: []datastructures.GrabcutRectangle{{Type: "background", X: 0, Y: 0, Width: 100, Height: 10}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mask, err := decodeGrabcutMask(previous, testStrokeLimits)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	//corrections in image coordinates (image twice the size of the mask)
+	corrections := datastructures.GrabcutStrokes{Width: 200, Height: 100,
+		Rectangles: []datastructures.GrabcutRectangle{{Type: "foreground", X: 100, Y: 60, Width: 100, Height: 40}}}
+	drawGrabcutStrokes(mask, scaleGrabcutStrokes(corrections, 100, 50))
+
+	expected := map[image.Point]uint8{{10, 5}: maskBackground, {10, 20}: maskProbable, {49, 40}: maskProbable,
+		{50, 30}: maskForeground, {99, 49}: maskForeground}
+	for p, value := range expected {
+		if mask.GrayAt(p.X, p.Y).Y != value {
+			t.Errorf("expected %d at %v, got %d", value, p, mask.GrayAt(p.X, p.Y).Y)
+		}
+	}
+}
+
+func TestDecodeGrabcutMask(t *testing.T) {
+	//color masks are converted to grayscale
+	rgba := image.NewRGBA(image.Rect(0, 0, 4, 2))
+	rgba.Set(1, 1, color.White)
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, rgba); err != nil {
+		t.Fatal(err)
+	}
+
+	mask, err := decodeGrabcutMask(buf.Bytes(), testStrokeLimits)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mask.Bounds().Dx() != 4 || mask.Bounds().Dy() != 2 || mask.GrayAt(1, 1).Y != maskForeground || mask.GrayAt(0, 0).Y != maskBackground {
+		t.Errorf("unexpected mask %v", mask.Pix)
+	}
+
+	if _, err = decodeGrabcutMask([]byte("no image"), testStrokeLimits); err == nil {
+		t.Errorf("expected invalid mask to be rejected")
+	}
+
+	buf.Reset()
+	if err := png.Encode(&buf, image.NewGray(image.Rect(0, 0, 1001, 1))); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = decodeGrabcutMask(buf.Bytes(), testStrokeLimits); err == nil {
+		t.Errorf("expected too large mask to be rejected")
+	}
+}
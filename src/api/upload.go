@@ -0,0 +1,132 @@
+package main
+
+import (
+	"github.com/gin-gonic/gin"
+	"image"
+	_ "image/gif"
+	_ "image/jpeg"
+	_ "image/png"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+//image formats the predict worker is able to decode
+var allowedImageTypes = map[string]bool{
+	"image/jpeg": true,
+	"image/png":  true,
+	"image/gif":  true,
+}
+
+//leave some room for the other form fields and the multipart boundaries
+const multipartOverhead = 1024 * 1024
+
+type uploadLimits struct {
+	MaxSize      int64
+	MaxDimension int
+	MaxPixels    int
+}
+
+//uploadError describes why an upload was rejected. Reason is meant to be
+//evaluated by clients, Message is meant for humans.
+type uploadError struct {
+	Status  int
+	Reason  string
+	Message string
+}
+
+func (e *uploadError) response() gin.H {
+	return gin.H{"error": e.Message, "reason": e.Reason}
+}
+
+func newRequestTooLargeError(maxSize int64) *uploadError {
+	return &uploadError{Status: http.StatusRequestEntityTooLarge, Reason: "file_too_large",
+		Message: "Request too large - max. " + strconv.FormatInt(maxSize, 10) + " bytes allowed"}
+}
+
+//isRequestTooLarge returns true if reading the request body failed, because it exceeded
+//the limit of limitRequestBody (the error of http.MaxBytesReader isn't exported)
+func isRequestTooLarge(err error) bool {
+	return err != nil && strings.Contains(err.Error(), "request body too large")
+}
+
+//limitRequestBody rejects requests that are obviously too big and makes sure that we
+//never read more than maxSize bytes from the request body. Returns false (and writes
+//the response) if the request is too big.
+func limitRequestBody(c *gin.Context, maxSize int64) bool {
+	if c.Request.ContentLength > maxSize {
+		e := newRequestTooLargeError(maxSize)
+		c.JSON(e.Status, e.response())
+		return false
+	}
+
+	c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, maxSize)
+	return true
+}
+
+//parseUploadForm limits the request body to maxSize (see limitRequestBody) and parses the
+//form. As requests without Content-Length (e.g. chunked ones) are only found to be too big
+//while parsing, the form needs to be parsed here. Returns false (and writes the response)
+//if the request is too big. Other errors are left to the caller, which misses the fields.
+func parseUploadForm(c *gin.Context, maxSize int64) bool {
+	if !limitRequestBody(c, maxSize) {
+		return false
+	}
+
+	if _, err := c.MultipartForm(); isRequestTooLarge(err) {
+		e := newRequestTooLargeError(maxSize)
+		c.JSON(e.Status, e.response())
+		return false
+	}
+	return true
+}
+
+//validateImageUpload checks that the uploaded file is a supported image and doesn't
+//exceed the configured limits - without decoding the whole image.
+func validateImageUpload(header *multipart.FileHeader, limits uploadLimits) *uploadError {
+	if header.Size > limits.MaxSize {
+		return &uploadError{Status: http.StatusRequestEntityTooLarge, Reason: "file_too_large",
+			Message: "Picture too large - max. " + strconv.FormatInt(limits.MaxSize, 10) + " bytes allowed"}
+	}
+
+	file, err := header.Open()
+	if err != nil {
+		return &uploadError{Status: http.StatusBadRequest, Reason: "unreadable_file", Message: "Couldn't read picture"}
+	}
+	defer file.Close()
+
+	//http.DetectContentType considers at most the first 512 bytes
+	buf := make([]byte, 512)
+	n, err := io.ReadFull(file, buf)
+	if err != nil && err != io.ErrUnexpectedEOF {
+		return &uploadError{Status: http.StatusBadRequest, Reason: "unreadable_file", Message: "Couldn't read picture"}
+	}
+
+	contentType := http.DetectContentType(buf[:n])
+	if !allowedImageTypes[contentType] {
+		return &uploadError{Status: http.StatusUnsupportedMediaType, Reason: "unsupported_media_type",
+			Message: "Unsupported picture format - only JPEG, PNG and GIF are allowed"}
+	}
+
+	_, err = file.Seek(0, io.SeekStart)
+	if err != nil {
+		return &uploadError{Status: http.StatusBadRequest, Reason: "unreadable_file", Message: "Couldn't read picture"}
+	}
+
+	config, _, err := image.DecodeConfig(file)
+	if err != nil {
+		return &uploadError{Status: http.StatusUnprocessableEntity, Reason: "invalid_image", Message: "Couldn't decode picture"}
+	}
+
+	//protect the predict worker from decompression bombs
+	if config.Width > limits.MaxDimension || config.Height > limits.MaxDimension ||
+		(config.Width*config.Height) > limits.MaxPixels {
+		return &uploadError{Status: http.StatusUnprocessableEntity, Reason: "image_dimensions_too_large",
+			Message: "Picture dimensions too large - max. " + strconv.Itoa(limits.MaxDimension) + "px per side and " +
+				strconv.Itoa(limits.MaxPixels) + " pixels allowed"}
+	}
+
+	return nil
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"github.com/gin-gonic/gin"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestUploadOfChunkedBodyIsTooLarge(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	server, redisPool := newTestRedisPool(t)
+	defer server.Close()
+	defer redisPool.Close()
+
+	config := defaultConfig()
+	config.MaxUploadSize = 1024
+	config.MaxBatchSize = 1
+	api := httptest.NewServer(setupRouter(redisPool, nil, config, make(chan struct{})))
+	defer api.Close()
+
+	for _, path := range []string{"/v1/predict", "/v1/batch/predict", "/v1/grabcut", "/v1/grabcut-sessions",
+		"/v1/grabcut-sessions/1234/rounds"} {
+		//the body is streamed, so the request is sent chunked (without Content-Length)
+		body, bodyWriter := io.Pipe()
+		writer := multipart.NewWriter(bodyWriter)
+		go func() {
+			part, err := writer.CreateFormFile("image", "image.png")
+			if err == nil {
+				_, err = part.Write(bytes.Repeat([]byte{0}, (multipartOverhead + 2*1024)))
+			}
+			if err == nil {
+				err = writer.Close()
+			}
+			bodyWriter.CloseWithError(err)
+		}()
+
+		resp, err := http.Post(api.URL+path, writer.FormDataContentType(), body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body.Close()
+
+		var response map[string]string
+		err = json.NewDecoder(resp.Body).Decode(&response)
+		resp.Body.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if resp.StatusCode != http.StatusRequestEntityTooLarge || response["reason"] != "file_too_large" {
+			t.Errorf("expected %s to reject the chunked body with 413 file_too_large, got %d %v", path,
+				resp.StatusCode, response)
+		}
+	}
+}
@@ -0,0 +1,424 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	commons "github.com/bbernhard/imagemonkey-playground/commons"
+	datastructures "github.com/bbernhard/imagemonkey-playground/datastructures"
+	"github.com/garyburd/redigo/redis"
+	"github.com/getsentry/raven-go"
+	"github.com/gin-gonic/gin"
+	log "github.com/sirupsen/logrus"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+)
+
+//delivery attempts are kept as long as the job state
+const webhookLogExpiration = 86400
+
+//networks webhooks can't be delivered to (besides loopback, link-local, multicast and
+//unspecified addresses), as otherwise anybody could send requests into our internal network
+var privateNetworks = mustParseCIDRs("10.0.0.0/8", "172.16.0.0/12", "192.168.0.0/16", "100.64.0.0/10",
+	"0.0.0.0/8", "fc00::/7")
+
+func mustParseCIDRs(cidrs ...string) []*net.IPNet {
+	var networks []*net.IPNet
+	for _, cidr := range cidrs {
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			panic(err)
+		}
+		networks = append(networks, network)
+	}
+	return networks
+}
+
+//isPublicIp returns true if the ip address is reachable over the internet
+func isPublicIp(ip net.IP) bool {
+	if ip.IsLoopback() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() || ip.IsInterfaceLocalMulticast() ||
+		ip.IsMulticast() || ip.IsUnspecified() {
+		return false
+	}
+
+	for _, network := range privateNetworks {
+		if network.Contains(ip) {
+			return false
+		}
+	}
+	return true
+}
+
+//validateCallbackUrl checks that the callback url is an absolute http(s) url. Unless
+//allowPrivateNetworks is set, all addresses of the host need to be public.
+func validateCallbackUrl(callbackUrl string, allowPrivateNetworks bool) error {
+	u, err := url.Parse(callbackUrl)
+	if err != nil {
+		return err
+	}
+
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Hostname() == "" {
+		return errors.New("callback url needs to be an absolute http(s) url")
+	}
+
+	if allowPrivateNetworks {
+		return nil
+	}
+
+	addresses, err := net.DefaultResolver.LookupIPAddr(context.Background(), u.Hostname())
+	if err != nil {
+		return err
+	}
+	for _, address := range addresses {
+		if !isPublicIp(address.IP) {
+			return errors.New("callback url needs to point to a public address")
+		}
+	}
+
+	return nil
+}
+
+//getCallbackUrl returns the (optional) callback url of the request. In case the callback
+//url is invalid, the response is written and ok is false.
+func getCallbackUrl(c *gin.Context, config Config) (callbackUrl string, ok bool) {
+	callbackUrl = c.PostForm("callback_url")
+	if callbackUrl == "" {
+		return "", true
+	}
+
+	if !config.UseWebhooks {
+		c.JSON(422, gin.H{"error": "Callbacks are not supported"})
+		return "", false
+	}
+
+	if err := validateCallbackUrl(callbackUrl, config.WebhookAllowPrivate); err != nil {
+		c.JSON(422, gin.H{"error": "Invalid callback_url - needs to be an absolute http(s) url with a public address"})
+		return "", false
+	}
+
+	return callbackUrl, true
+}
+
+//signWebhookPayload returns the hex encoded HMAC-SHA256 of "<timestamp>.<payload>". The
+//timestamp is signed too, so that receivers can refuse replayed deliveries.
+func signWebhookPayload(secret []byte, timestamp int64, payload []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(strconv.FormatInt(timestamp, 10) + "."))
+	mac.Write(payload)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+type WebhookDeliverer struct {
+	client         *http.Client
+	secret         []byte
+	maxAttempts    int
+	initialBackoff time.Duration
+}
+
+//NewWebhookDeliverer creates a deliverer. Unless allowPrivateNetworks is set, it refuses to
+//connect to non-public addresses (checked on every connect, as the DNS records of a callback
+//url might have changed since it was validated) and doesn't follow redirects.
+func NewWebhookDeliverer(secret string, maxAttempts int, initialBackoff time.Duration, allowPrivateNetworks bool) *WebhookDeliverer {
+	dialer := &net.Dialer{Timeout: 10 * time.Second}
+	if !allowPrivateNetworks {
+		//the address is already resolved at this point
+		dialer.Control = func(network string, address string, c syscall.RawConn) error {
+			host, _, err := net.SplitHostPort(address)
+			if err != nil {
+				return err
+			}
+			if ip := net.ParseIP(host); ip == nil || !isPublicIp(ip) {
+				return errors.New("connecting to " + host + " isn't allowed")
+			}
+			return nil
+		}
+	}
+
+	return &WebhookDeliverer{
+		client: &http.Client{
+			Timeout: 10 * time.Second,
+			Transport: &http.Transport{
+				DialContext:         dialer.DialContext,
+				TLSHandshakeTimeout: 10 * time.Second,
+				MaxIdleConns:        10,
+				IdleConnTimeout:     90 * time.Second,
+			},
+			//a redirect is reported as unexpected status code
+			CheckRedirect: func(req *http.Request, via []*http.Request) error {
+				return http.ErrUseLastResponse
+			},
+		},
+		secret:         []byte(secret),
+		maxAttempts:    maxAttempts,
+		initialBackoff: initialBackoff,
+	}
+}
+
+//Attempt POSTs the payload to the callback url, number is the number of the attempt.
+//retry is false if the receiver answered with a 2xx status code, maxAttempts is reached
+//or it's pointless to try again.
+func (d *WebhookDeliverer) Attempt(jobUuid string, callbackUrl string, payload []byte,
+	number int) (attempt datastructures.WebhookDeliveryAttempt, retry bool) {
+	attempt.Attempt = number
+	attempt.Timestamp = time.Now().Unix()
+
+	req, err := http.NewRequest("POST", callbackUrl, bytes.NewReader(payload))
+	if err != nil { //no need to retry, this won't get any better
+		attempt.Error = err.Error()
+		return attempt, false
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Playground-Job", jobUuid)
+	req.Header.Set("X-Playground-Timestamp", strconv.FormatInt(attempt.Timestamp, 10))
+	req.Header.Set("X-Playground-Signature", "sha256="+signWebhookPayload(d.secret, attempt.Timestamp, payload))
+
+	resp, err := d.client.Do(req)
+	if err != nil {
+		attempt.Error = err.Error()
+	} else {
+		resp.Body.Close()
+		attempt.StatusCode = resp.StatusCode
+		if resp.StatusCode < 200 || resp.StatusCode > 299 {
+			attempt.Error = "Unexpected status code " + strconv.Itoa(resp.StatusCode)
+		}
+	}
+
+	return attempt, attempt.Error != "" && number < d.maxAttempts
+}
+
+//backoff returns the time to wait after the given attempt. It doubles after every attempt.
+func (d *WebhookDeliverer) backoff(number int) time.Duration {
+	if number > 20 {
+		number = 20
+	}
+	return d.initialBackoff * time.Duration(int64(1)<<uint(number-1))
+}
+
+const (
+	webhookPollInterval = time.Second
+
+	//an attempt is claimed for this many seconds. If the api instance dies during the
+	//attempt, the next attempt is made afterwards (needs to be longer than the client timeout).
+	webhookClaimTimeout = 60
+)
+
+//KEYS: webhook queue
+//ARGV: uuid, now, claimed until
+var claimWebhookScript = redis.NewScript(1, `
+local due = redis.call('ZSCORE', KEYS[1], ARGV[1])
+if due and tonumber(due) <= tonumber(ARGV[2]) then
+	redis.call('ZADD', KEYS[1], ARGV[3], ARGV[1])
+	return 1
+end
+return 0
+`)
+
+//runWebhookDispatcher delivers the webhooks that are due (see commons.WebhookQueue) with
+//numWorkers workers. As the queue is kept in Redis, the webhooks of jobs that finished while
+//no api instance was running (or whose retry was pending when the api stopped) are delivered
+//after the start. Once stop is closed, it waits for the running attempts and returns.
+func runWebhookDispatcher(redisPool *redis.Pool, deliverer *WebhookDeliverer, numWorkers int, stop <-chan struct{}) {
+	jobs := make(chan string)
+	idle := make(chan struct{}, numWorkers) //one token per idle worker
+
+	var workers sync.WaitGroup
+	for i := 0; i < numWorkers; i++ {
+		idle <- struct{}{}
+		workers.Add(1)
+		go func() {
+			defer workers.Done()
+			for uuid := range jobs {
+				deliverWebhook(redisPool, deliverer, uuid)
+				idle <- struct{}{}
+			}
+		}()
+	}
+	defer workers.Wait()
+	defer close(jobs)
+
+	for {
+		//only claim as many attempts as can be made right away, the others might be
+		//made by another api instance in the meantime
+		select {
+		case <-idle:
+		case <-stop:
+			return
+		}
+		available := 1
+		for len(idle) > 0 {
+			<-idle
+			available++
+		}
+
+		redisConn := redisPool.Get()
+		uuids, err := claimDueWebhooks(redisConn, time.Now(), available)
+		redisConn.Close()
+		if err != nil {
+			log.Error("[Webhooks] Couldn't claim webhooks: ", err.Error())
+		}
+
+		for _, uuid := range uuids {
+			jobs <- uuid
+		}
+		for i := len(uuids); i < available; i++ {
+			idle <- struct{}{}
+		}
+
+		//otherwise there might be more webhooks due
+		if len(uuids) < available {
+			select {
+			case <-time.After(webhookPollInterval):
+			case <-stop:
+				return
+			}
+		}
+	}
+}
+
+//claimDueWebhooks claims the next attempt of (at most limit) webhooks that are due and returns
+//their job uuids. Every attempt is claimed by one api instance only.
+func claimDueWebhooks(redisConn redis.Conn, now time.Time, limit int) ([]string, error) {
+	uuids, err := redis.Strings(redisConn.Do("ZRANGEBYSCORE", commons.WebhookQueue, "-inf", now.Unix(),
+		"LIMIT", 0, limit))
+	if err != nil {
+		return nil, err
+	}
+
+	claimed := []string{}
+	for _, uuid := range uuids {
+		ok, err := redis.Bool(claimWebhookScript.Do(redisConn, commons.WebhookQueue, uuid, now.Unix(),
+			now.Unix()+webhookClaimTimeout))
+		if err != nil {
+			return claimed, err
+		}
+		if ok {
+			claimed = append(claimed, uuid)
+		}
+	}
+	return claimed, nil
+}
+
+func deliverWebhook(redisPool *redis.Pool, deliverer *WebhookDeliverer, uuid string) {
+	err := attemptWebhook(redisPool, deliverer, uuid)
+	if err != nil { //the attempt is made again once the claim expired
+		log.Error("[Webhooks] Couldn't deliver webhook for job ", uuid, ": ", err.Error())
+		raven.CaptureError(err, nil)
+	}
+}
+
+//attemptWebhook makes the next delivery attempt of the (claimed) webhook, adds it to the
+//delivery log and schedules the next attempt if needed.
+func attemptWebhook(redisPool *redis.Pool, deliverer *WebhookDeliverer, uuid string) error {
+	jobState, payload, previousAttempts, err := prepareWebhook(redisPool, uuid)
+	if err != nil {
+		return err
+	}
+
+	redisConn := redisPool.Get()
+	defer redisConn.Close()
+
+	if payload == nil { //nothing to deliver (anymore)
+		_, err = redisConn.Do("ZREM", commons.WebhookQueue, uuid)
+		return err
+	}
+
+	attempt, retry := deliverer.Attempt(uuid, jobState.CallbackUrl, payload, previousAttempts+1)
+	serialized, err := json.Marshal(attempt)
+	if err != nil {
+		return err
+	}
+
+	key := "webhooklog" + uuid
+	redisConn.Send("MULTI")
+	redisConn.Send("RPUSH", key, serialized)
+	redisConn.Send("EXPIRE", key, webhookLogExpiration)
+	if retry {
+		next := time.Now().Add(deliverer.backoff(attempt.Attempt)).Unix()
+		redisConn.Send("ZADD", commons.WebhookQueue, next, uuid)
+	} else {
+		redisConn.Send("ZREM", commons.WebhookQueue, uuid)
+	}
+	_, err = redisConn.Do("EXEC")
+
+	if !retry && attempt.Error != "" {
+		log.Info("[Webhooks] Couldn't deliver webhook for job ", uuid, " after ", attempt.Attempt, " attempts")
+	}
+	return err
+}
+
+//prepareWebhook returns the job state, the payload that should be delivered and the number
+//of attempts that were already made. The payload is nil if the job doesn't exist (anymore)
+//or doesn't have a callback url.
+func prepareWebhook(redisPool *redis.Pool, uuid string) (jobState datastructures.JobState, payload []byte,
+	previousAttempts int, err error) {
+	redisConn := redisPool.Get()
+	defer redisConn.Close()
+
+	jobState, found, err := commons.GetJobState(redisConn, uuid)
+	if err != nil || !found || jobState.CallbackUrl == "" {
+		return jobState, nil, 0, err
+	}
+
+	previousAttempts, err = redis.Int(redisConn.Do("LLEN", ("webhooklog" + uuid)))
+	if err != nil {
+		return jobState, nil, 0, err
+	}
+
+	payload, err = getWebhookPayload(redisConn, jobState)
+	return jobState, payload, previousAttempts, err
+}
+
+//getWebhookPayload returns the same response that the client would get from the GET result endpoints
+func getWebhookPayload(redisConn redis.Conn, jobState datastructures.JobState) ([]byte, error) {
+	response := gin.H{"state": jobState.State, "error": jobState.Error}
+
+	data, err := redis.Bytes(redisConn.Do("GET", getResultKey(jobState.Type, jobState.Uuid)))
+	if err != nil && err != redis.ErrNil {
+		return nil, err
+	}
+
+	if err == nil {
+		if jobState.Type == commons.JobTypeGrabcut {
+			response, err = getGrabcutMeResponse(jobState, data)
+		} else {
+			response, err = getPredictMeResponse(jobState, data)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	response["uuid"] = jobState.Uuid
+	response["type"] = jobState.Type
+	return json.Marshal(response)
+}
+
+//getWebhookDeliveryLog returns all delivery attempts of the job's webhook
+func getWebhookDeliveryLog(redisConn redis.Conn, uuid string) ([]datastructures.WebhookDeliveryAttempt, error) {
+	attempts := []datastructures.WebhookDeliveryAttempt{}
+
+	values, err := redis.ByteSlices(redisConn.Do("LRANGE", ("webhooklog" + uuid), 0, -1))
+	if err != nil {
+		return attempts, err
+	}
+
+	for _, value := range values {
+		var attempt datastructures.WebhookDeliveryAttempt
+		err = json.Unmarshal(value, &attempt)
+		if err != nil {
+			return attempts, err
+		}
+		attempts = append(attempts, attempt)
+	}
+
+	return attempts, nil
+}
@@ -0,0 +1,335 @@
+package main
+
+import (
+	commons "github.com/bbernhard/imagemonkey-playground/commons"
+	datastructures "github.com/bbernhard/imagemonkey-playground/datastructures"
+	"github.com/garyburd/redigo/redis"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestWebhookDeliverySignsPayload(t *testing.T) {
+	payload := []byte(`{"uuid":"1234","state":"done"}`)
+
+	var receivedBody []byte
+	var receivedSignature, receivedTimestamp, receivedJob string
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		receivedBody, _ = ioutil.ReadAll(r.Body)
+		receivedSignature = r.Header.Get("X-Playground-Signature")
+		receivedTimestamp = r.Header.Get("X-Playground-Timestamp")
+		receivedJob = r.Header.Get("X-Playground-Job")
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer receiver.Close()
+
+	deliverer := NewWebhookDeliverer("secret", 3, time.Millisecond, true)
+	attempt, retry := deliverer.Attempt("1234", receiver.URL, payload, 1)
+
+	if attempt.Attempt != 1 || attempt.StatusCode != http.StatusNoContent || attempt.Error != "" || retry {
+		t.Fatalf("unexpected delivery attempt: %+v (retry %v)", attempt, retry)
+	}
+	if string(receivedBody) != string(payload) {
+		t.Errorf("expected body %s, got %s", payload, receivedBody)
+	}
+	if receivedJob != "1234" {
+		t.Errorf("expected job header 1234, got %s", receivedJob)
+	}
+
+	if receivedTimestamp != strconv.FormatInt(attempt.Timestamp, 10) {
+		t.Errorf("expected timestamp %d, got %s", attempt.Timestamp, receivedTimestamp)
+	}
+	expectedSignature := "sha256=" + signWebhookPayload([]byte("secret"), attempt.Timestamp, payload)
+	if receivedSignature != expectedSignature {
+		t.Errorf("expected signature %s, got %s", expectedSignature, receivedSignature)
+	}
+}
+
+func TestSignWebhookPayload(t *testing.T) {
+	//echo -n '1600000000.{"uuid":"1234","state":"done"}' | openssl dgst -sha256 -hmac secret
+	expected := "ec0126d0906b7a4fd30211dff7549b5b4c92ee5a5f123792d8487c129551f587"
+	if signature := signWebhookPayload([]byte("secret"), 1600000000, []byte(`{"uuid":"1234","state":"done"}`)); signature != expected {
+		t.Errorf("expected signature %s, got %s", expected, signature)
+	}
+}
+
+//scheduleTestWebhook creates a job with the callback url, whose webhook is due
+func scheduleTestWebhook(t *testing.T, redisPool *redis.Pool, uuid string, callbackUrl string) {
+	redisConn := redisPool.Get()
+	defer redisConn.Close()
+
+	now := time.Now().Unix()
+	_, err := redisConn.Do("HMSET", ("jobstate" + uuid), "uuid", uuid, "type", commons.JobTypePrediction,
+		"state", commons.JobStateFailed, "created", now, "updated", now, "callback_url", callbackUrl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = redisConn.Do("ZADD", commons.WebhookQueue, now, uuid); err != nil {
+		t.Fatal(err)
+	}
+}
+
+//deliverDueWebhooks makes the next attempt of every due webhook and returns their uuids
+func deliverDueWebhooks(t *testing.T, redisPool *redis.Pool, deliverer *WebhookDeliverer, now time.Time) []string {
+	redisConn := redisPool.Get()
+	uuids, err := claimDueWebhooks(redisConn, now, 100)
+	redisConn.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, uuid := range uuids {
+		if err := attemptWebhook(redisPool, deliverer, uuid); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return uuids
+}
+
+func getTestWebhookLog(t *testing.T, redisPool *redis.Pool, uuid string) []datastructures.WebhookDeliveryAttempt {
+	redisConn := redisPool.Get()
+	defer redisConn.Close()
+
+	attempts, err := getWebhookDeliveryLog(redisConn, uuid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return attempts
+}
+
+func TestWebhookDeliveryRetriesUntilSuccess(t *testing.T) {
+	server, redisPool := newTestRedisPool(t)
+	defer server.Close()
+	defer redisPool.Close()
+
+	requests := 0
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		if requests < 3 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer receiver.Close()
+
+	scheduleTestWebhook(t, redisPool, "1234", receiver.URL)
+	deliverer := NewWebhookDeliverer("secret", 5, time.Minute, true)
+
+	//the retry isn't due before the backoff passed
+	now := time.Now()
+	if uuids := deliverDueWebhooks(t, redisPool, deliverer, now); len(uuids) != 1 {
+		t.Fatalf("expected the webhook to be due, got %v", uuids)
+	}
+	if uuids := deliverDueWebhooks(t, redisPool, deliverer, now.Add(30*time.Second)); len(uuids) != 0 {
+		t.Errorf("expected no webhook to be due during the backoff, got %v", uuids)
+	}
+	deliverDueWebhooks(t, redisPool, deliverer, now.Add(2*time.Minute))
+	deliverDueWebhooks(t, redisPool, deliverer, now.Add(10*time.Minute))
+	if uuids := deliverDueWebhooks(t, redisPool, deliverer, now.Add(time.Hour)); len(uuids) != 0 {
+		t.Errorf("expected no webhook to be due after the successful attempt, got %v", uuids)
+	}
+
+	attempts := getTestWebhookLog(t, redisPool, "1234")
+	if len(attempts) != 3 {
+		t.Fatalf("expected 3 attempts, got %d", len(attempts))
+	}
+	if attempts[0].StatusCode != http.StatusServiceUnavailable || attempts[0].Error == "" {
+		t.Errorf("expected first attempt to fail, got %+v", attempts[0])
+	}
+	if attempts[2].Attempt != 3 || attempts[2].StatusCode != http.StatusOK || attempts[2].Error != "" {
+		t.Errorf("expected last attempt to succeed, got %+v", attempts[2])
+	}
+}
+
+func TestWebhookDeliveryGivesUpAfterMaxAttempts(t *testing.T) {
+	server, redisPool := newTestRedisPool(t)
+	defer server.Close()
+	defer redisPool.Close()
+
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer receiver.Close()
+
+	scheduleTestWebhook(t, redisPool, "1234", receiver.URL)
+	deliverer := NewWebhookDeliverer("secret", 4, 0, true)
+	for i := 0; i < 6; i++ {
+		deliverDueWebhooks(t, redisPool, deliverer, time.Now().Add(time.Minute))
+	}
+
+	attempts := getTestWebhookLog(t, redisPool, "1234")
+	if len(attempts) != 4 {
+		t.Fatalf("expected 4 attempts, got %d", len(attempts))
+	}
+	for _, attempt := range attempts {
+		if attempt.Error == "" {
+			t.Errorf("expected attempt to fail, got %+v", attempt)
+		}
+	}
+}
+
+func TestWebhookAttemptIsClaimedOnce(t *testing.T) {
+	server, redisPool := newTestRedisPool(t)
+	defer server.Close()
+	defer redisPool.Close()
+
+	scheduleTestWebhook(t, redisPool, "1234", "http://203.0.113.1/hook")
+
+	redisConn := redisPool.Get()
+	defer redisConn.Close()
+
+	now := time.Now()
+	if uuids, err := claimDueWebhooks(redisConn, now, 10); err != nil || len(uuids) != 1 {
+		t.Fatalf("expected the webhook to be claimed, got %v (err %v)", uuids, err)
+	}
+	if uuids, err := claimDueWebhooks(redisConn, now, 10); err != nil || len(uuids) != 0 {
+		t.Errorf("expected the webhook to be claimed only once, got %v (err %v)", uuids, err)
+	}
+
+	//the instance that claimed the attempt died
+	later := now.Add((webhookClaimTimeout + 1) * time.Second)
+	if uuids, err := claimDueWebhooks(redisConn, later, 10); err != nil || len(uuids) != 1 {
+		t.Errorf("expected the webhook to be claimed again after the claim expired, got %v (err %v)", uuids, err)
+	}
+}
+
+func TestWebhookDispatcherLimitsConcurrentDeliveries(t *testing.T) {
+	server, redisPool := newTestRedisPool(t)
+	defer server.Close()
+	defer redisPool.Close()
+
+	var active, maxActive, delivered int32
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		current := atomic.AddInt32(&active, 1)
+		for {
+			max := atomic.LoadInt32(&maxActive)
+			if current <= max || atomic.CompareAndSwapInt32(&maxActive, max, current) {
+				break
+			}
+		}
+		time.Sleep(50 * time.Millisecond)
+		atomic.AddInt32(&active, -1)
+		atomic.AddInt32(&delivered, 1)
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer receiver.Close()
+
+	for i := 0; i < 6; i++ {
+		scheduleTestWebhook(t, redisPool, strconv.Itoa(i), receiver.URL)
+	}
+
+	stop := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		runWebhookDispatcher(redisPool, NewWebhookDeliverer("secret", 3, 0, true), 2, stop)
+		close(stopped)
+	}()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for atomic.LoadInt32(&delivered) < 6 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	close(stop)
+
+	select {
+	case <-stopped:
+	case <-time.After(time.Second):
+		t.Fatal("expected the dispatcher to stop")
+	}
+	if delivered := atomic.LoadInt32(&delivered); delivered != 6 {
+		t.Errorf("expected 6 deliveries, got %d", delivered)
+	}
+	if maxActive := atomic.LoadInt32(&maxActive); maxActive > 2 {
+		t.Errorf("expected at most 2 concurrent deliveries, got %d", maxActive)
+	}
+}
+
+func TestWebhookWithoutJobIsDropped(t *testing.T) {
+	server, redisPool := newTestRedisPool(t)
+	defer server.Close()
+	defer redisPool.Close()
+
+	redisConn := redisPool.Get()
+	defer redisConn.Close()
+	if _, err := redisConn.Do("ZADD", commons.WebhookQueue, time.Now().Unix(), "1234"); err != nil {
+		t.Fatal(err)
+	}
+
+	deliverDueWebhooks(t, redisPool, NewWebhookDeliverer("secret", 3, 0, true), time.Now())
+	if scheduled, _ := redis.Int(redisConn.Do("ZCARD", commons.WebhookQueue)); scheduled != 0 {
+		t.Errorf("expected the webhook of the expired job to be dropped, got %d", scheduled)
+	}
+}
+
+func TestWebhookDeliveryDoesntFollowRedirects(t *testing.T) {
+	redirected := false
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		redirected = true
+	}))
+	defer target.Close()
+
+	receiver := httptest.NewServer(http.RedirectHandler(target.URL, http.StatusFound))
+	defer receiver.Close()
+
+	deliverer := NewWebhookDeliverer("secret", 1, time.Millisecond, true)
+	attempt, _ := deliverer.Attempt("1234", receiver.URL, []byte("{}"), 1)
+
+	if attempt.StatusCode != http.StatusFound || attempt.Error == "" {
+		t.Errorf("expected the redirect to fail the attempt, got %+v", attempt)
+	}
+	if redirected {
+		t.Errorf("expected the redirect not to be followed")
+	}
+}
+
+func TestWebhookDeliveryRefusesPrivateAddresses(t *testing.T) {
+	requests := 0
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+	}))
+	defer receiver.Close()
+
+	deliverer := NewWebhookDeliverer("secret", 1, time.Millisecond, false)
+	attempt, _ := deliverer.Attempt("1234", receiver.URL, []byte("{}"), 1)
+
+	if attempt.StatusCode != 0 || !strings.Contains(attempt.Error, "isn't allowed") {
+		t.Errorf("expected the connection to be refused, got %+v", attempt)
+	}
+	if requests != 0 {
+		t.Errorf("expected no request to the loopback address, got %d", requests)
+	}
+}
+
+func TestValidateCallbackUrl(t *testing.T) {
+	valid := []string{"http://203.0.113.1/hook", "https://203.0.113.1:8443/hook?id=1", "http://[2001:db8::1]/hook"}
+	for _, callbackUrl := range valid {
+		if err := validateCallbackUrl(callbackUrl, false); err != nil {
+			t.Errorf("expected %s to be valid: %s", callbackUrl, err.Error())
+		}
+	}
+
+	invalid := []string{"example.com/hook", "ftp://example.com/hook", "/hook", "http://", "http://:80/hook"}
+	for _, callbackUrl := range invalid {
+		if err := validateCallbackUrl(callbackUrl, true); err == nil {
+			t.Errorf("expected %s to be invalid", callbackUrl)
+		}
+	}
+
+	private := []string{"http://127.0.0.1/hook", "http://localhost:8080/hook", "http://10.1.2.3/hook", "http://172.16.0.1/hook",
+		"http://192.168.1.1/hook", "http://169.254.169.254/latest/meta-data/", "http://0.0.0.0/hook", "http://[::1]/hook",
+		"http://[fd00::1]/hook", "http://[fe80::1]/hook", "http://[::ffff:127.0.0.1]/hook"}
+	for _, callbackUrl := range private {
+		if err := validateCallbackUrl(callbackUrl, false); err == nil {
+			t.Errorf("expected %s to be refused", callbackUrl)
+		}
+		if err := validateCallbackUrl(callbackUrl, true); err != nil {
+			t.Errorf("expected %s to be allowed for testing: %s", callbackUrl, err.Error())
+		}
+	}
+}
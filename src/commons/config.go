@@ -0,0 +1,270 @@
+package commons
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"gopkg.in/yaml.v2"
+	"io"
+	"io/ioutil"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+//ConfigEnvPrefix is the prefix of the environment variables that overwrite config values
+//(e.g PLAYGROUND_REDIS_ADDRESS overwrites redis_address)
+const ConfigEnvPrefix = "PLAYGROUND_"
+
+//ConfigValidator is implemented by configs that need to check their values after loading
+type ConfigValidator interface {
+	Validate() error
+}
+
+//configField describes a field of a config struct. The field is configured with tags:
+//
+//	config: name of the value (required, fields without config tag are ignored)
+//	help:   description that is shown in the usage
+//	env:    additional environment variable (for backwards compatibility)
+//	secret: if "true", the value is redacted when the config is printed
+//
+//The fields of embedded structs are handled as if they were fields of the config itself.
+type configField struct {
+	name   string
+	help   string
+	env    string
+	secret bool
+	value  reflect.Value
+}
+
+//configFlag collects the value of a command line flag. The value is only applied after
+//the config file and the environment variables, so that flags take precedence.
+type configFlag struct {
+	field *configField
+	raw   string
+	set   bool
+}
+
+func (f *configFlag) String() string {
+	if f == nil || f.field == nil {
+		return ""
+	}
+	return fmt.Sprint(f.field.value.Interface())
+}
+
+func (f *configFlag) Set(raw string) error {
+	//make sure that invalid values are reported while parsing the flags
+	err := setConfigValue(reflect.New(f.field.value.Type()).Elem(), raw)
+	if err != nil {
+		return err
+	}
+
+	f.raw = raw
+	f.set = true
+	return nil
+}
+
+func (f *configFlag) IsBoolFlag() bool {
+	return f.field != nil && f.field.value.Kind() == reflect.Bool
+}
+
+func getConfigFields(config interface{}) ([]*configField, error) {
+	v := reflect.ValueOf(config)
+	if v.Kind() != reflect.Ptr || v.Elem().Kind() != reflect.Struct {
+		return nil, errors.New("config needs to be a pointer to a struct")
+	}
+	return getStructConfigFields(v.Elem())
+}
+
+func getStructConfigFields(v reflect.Value) ([]*configField, error) {
+	var fields []*configField
+	for i := 0; i < v.NumField(); i++ {
+		structField := v.Type().Field(i)
+		name := structField.Tag.Get("config")
+		if name == "" {
+			//the values of embedded structs (e.g StorageConfig) are part of the config
+			if structField.Anonymous && structField.Type.Kind() == reflect.Struct {
+				embeddedFields, err := getStructConfigFields(v.Field(i))
+				if err != nil {
+					return nil, err
+				}
+				fields = append(fields, embeddedFields...)
+			}
+			continue
+		}
+
+		switch structField.Type.Kind() {
+		case reflect.String, reflect.Bool, reflect.Int, reflect.Int64, reflect.Float64:
+		default:
+			return nil, fmt.Errorf("config value %s has unsupported type %s", name, structField.Type)
+		}
+
+		fields = append(fields, &configField{
+			name:   name,
+			help:   structField.Tag.Get("help"),
+			env:    structField.Tag.Get("env"),
+			secret: structField.Tag.Get("secret") == "true",
+			value:  v.Field(i),
+		})
+	}
+
+	return fields, nil
+}
+
+func setConfigValue(value reflect.Value, raw string) error {
+	switch value.Kind() {
+	case reflect.String:
+		value.SetString(raw)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(raw)
+		if err != nil {
+			return fmt.Errorf("invalid boolean %q", raw)
+		}
+		value.SetBool(b)
+	case reflect.Int, reflect.Int64:
+		n, err := strconv.ParseInt(raw, 10, 64)
+		if err != nil {
+			return fmt.Errorf("invalid number %q", raw)
+		}
+		value.SetInt(n)
+	case reflect.Float64:
+		n, err := strconv.ParseFloat(raw, 64)
+		if err != nil {
+			return fmt.Errorf("invalid number %q", raw)
+		}
+		value.SetFloat(n)
+	}
+	return nil
+}
+
+//getConfigEnvName returns the environment variable of the config value
+func getConfigEnvName(name string) string {
+	return ConfigEnvPrefix + strings.ToUpper(name)
+}
+
+//LoadConfig fills config (a pointer to a struct, which already contains the defaults) from
+//(in increasing order of precedence) the YAML config file, the environment variables and
+//the command line flags. Every value has a flag with the name of the value, and - for
+//backwards compatibility - an alias where underscores are replaced by hyphens. The config
+//file is set with -config (or PLAYGROUND_CONFIG). Additional (non config) flags can be
+//registered on flags before calling LoadConfig. If config implements ConfigValidator, the
+//values are validated afterwards.
+func LoadConfig(config interface{}, flags *flag.FlagSet, args []string) error {
+	fields, err := getConfigFields(config)
+	if err != nil {
+		return err
+	}
+
+	configFile := flags.String("config", GetEnv(ConfigEnvPrefix+"CONFIG"), "Path to a YAML config file")
+
+	var configFlags []*configFlag
+	for _, field := range fields {
+		f := &configFlag{field: field}
+		configFlags = append(configFlags, f)
+
+		help := field.help + " (env: " + getConfigEnvName(field.name) + ")"
+		flags.Var(f, field.name, help)
+		if alias := strings.Replace(field.name, "_", "-", -1); alias != field.name {
+			flags.Var(f, alias, "Alias for -"+field.name)
+		}
+	}
+
+	err = flags.Parse(args)
+	if err != nil {
+		return err
+	}
+
+	if *configFile != "" {
+		err = loadConfigFile(fields, *configFile)
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, field := range fields {
+		for _, env := range []string{field.env, getConfigEnvName(field.name)} {
+			if env == "" {
+				continue
+			}
+
+			if raw := GetEnv(env); raw != "" {
+				err = setConfigValue(field.value, raw)
+				if err != nil {
+					return fmt.Errorf("%s: %s", env, err.Error())
+				}
+			}
+		}
+	}
+
+	for _, f := range configFlags {
+		if f.set {
+			setConfigValue(f.field.value, f.raw) //already validated in Set()
+		}
+	}
+
+	if validator, ok := config.(ConfigValidator); ok {
+		return validator.Validate()
+	}
+	return nil
+}
+
+func loadConfigFile(fields []*configField, path string) error {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	values := map[string]interface{}{}
+	err = yaml.Unmarshal(data, &values)
+	if err != nil {
+		return fmt.Errorf("%s: %s", path, err.Error())
+	}
+
+	for name, value := range values {
+		var field *configField
+		for _, f := range fields {
+			if f.name == name || strings.Replace(f.name, "_", "-", -1) == name {
+				field = f
+				break
+			}
+		}
+		if field == nil {
+			return fmt.Errorf("%s: unknown config value %s", path, name)
+		}
+
+		if value == nil {
+			continue
+		}
+		err = setConfigValue(field.value, fmt.Sprint(value))
+		if err != nil {
+			return fmt.Errorf("%s: %s: %s", path, name, err.Error())
+		}
+	}
+
+	return nil
+}
+
+//PrintConfig writes the config as YAML (which can be used as config file). Secrets are redacted.
+func PrintConfig(w io.Writer, config interface{}) error {
+	fields, err := getConfigFields(config)
+	if err != nil {
+		return err
+	}
+
+	values := yaml.MapSlice{}
+	for _, field := range fields {
+		var value interface{} = field.value.Interface()
+		if field.secret && field.value.String() != "" {
+			value = "<redacted>"
+		}
+		values = append(values, yaml.MapItem{Key: field.name, Value: value})
+	}
+
+	data, err := yaml.Marshal(values)
+	if err != nil {
+		return err
+	}
+
+	_, err = w.Write(data)
+	return err
+}
@@ -0,0 +1,168 @@
+package commons
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+)
+
+type testConfig struct {
+	RedisAddress string `config:"redis_address" help:"Address to the Redis server"`
+	MaxWorkers   int    `config:"max_workers"`
+	UseSentry    bool   `config:"use_sentry"`
+	SentryDsn    string `config:"sentry_dsn" env:"TEST_SENTRY_DSN" secret:"true"`
+	Ignored      string
+}
+
+func (c *testConfig) Validate() error {
+	if c.MaxWorkers < 1 {
+		return errors.New("max_workers needs to be at least 1")
+	}
+	return nil
+}
+
+func loadTestConfig(args ...string) (testConfig, error) {
+	config := testConfig{RedisAddress: ":6379", MaxWorkers: 5}
+	err := LoadConfig(&config, flag.NewFlagSet("test", flag.ContinueOnError), args)
+	return config, err
+}
+
+func writeTestConfigFile(t *testing.T, content string) string {
+	f, err := ioutil.TempFile("", "config*.yml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	_, err = f.WriteString(content)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return f.Name()
+}
+
+func TestLoadConfigDefaults(t *testing.T) {
+	config, err := loadTestConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.RedisAddress != ":6379" || config.MaxWorkers != 5 || config.UseSentry {
+		t.Errorf("unexpected config %+v", config)
+	}
+}
+
+func TestLoadConfigPrecedence(t *testing.T) {
+	path := writeTestConfigFile(t, "redis_address: file:6379\nmax_workers: 3\nuse_sentry: true\n")
+	defer os.Remove(path)
+
+	config, err := loadTestConfig("-config", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.RedisAddress != "file:6379" || config.MaxWorkers != 3 || !config.UseSentry {
+		t.Errorf("expected values of config file, got %+v", config)
+	}
+
+	os.Setenv("PLAYGROUND_REDIS_ADDRESS", "env:6379")
+	defer os.Unsetenv("PLAYGROUND_REDIS_ADDRESS")
+
+	config, err = loadTestConfig("-config", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.RedisAddress != "env:6379" || config.MaxWorkers != 3 {
+		t.Errorf("expected environment to overwrite config file, got %+v", config)
+	}
+
+	config, err = loadTestConfig("-config", path, "-redis_address", "flag:6379", "-use_sentry=false")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.RedisAddress != "flag:6379" || config.UseSentry {
+		t.Errorf("expected flags to overwrite environment, got %+v", config)
+	}
+}
+
+func TestLoadConfigHyphenAlias(t *testing.T) {
+	config, err := loadTestConfig("-redis-address=:6380", "-max-workers", "2", "-use-sentry")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.RedisAddress != ":6380" || config.MaxWorkers != 2 || !config.UseSentry {
+		t.Errorf("unexpected config %+v", config)
+	}
+}
+
+func TestLoadConfigLegacyEnv(t *testing.T) {
+	os.Setenv("TEST_SENTRY_DSN", "https://key@sentry.example.com/1")
+	defer os.Unsetenv("TEST_SENTRY_DSN")
+
+	config, err := loadTestConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.SentryDsn != "https://key@sentry.example.com/1" {
+		t.Errorf("expected sentry dsn from legacy environment variable, got %q", config.SentryDsn)
+	}
+}
+
+func TestLoadConfigRejectsInvalidValues(t *testing.T) {
+	if _, err := loadTestConfig("-max_workers", "many"); err == nil {
+		t.Errorf("expected invalid number to be rejected")
+	}
+
+	if _, err := loadTestConfig("-max_workers", "0"); err == nil {
+		t.Errorf("expected validation to fail")
+	}
+
+	path := writeTestConfigFile(t, "redis_adress: :6379\n")
+	defer os.Remove(path)
+	if _, err := loadTestConfig("-config", path); err == nil || !strings.Contains(err.Error(), "redis_adress") {
+		t.Errorf("expected unknown config value to be rejected, got %v", err)
+	}
+}
+
+func TestPrintConfigRedactsSecrets(t *testing.T) {
+	config := testConfig{RedisAddress: ":6379", MaxWorkers: 5, SentryDsn: "https://key@sentry.example.com/1"}
+
+	var buf bytes.Buffer
+	err := PrintConfig(&buf, &config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := "redis_address: :6379\nmax_workers: 5\nuse_sentry: false\nsentry_dsn: <redacted>\n"
+	if buf.String() != expected {
+		t.Errorf("expected\n%s\ngot\n%s", expected, buf.String())
+	}
+}
+
+type testEmbeddedConfig struct {
+	RedisAddress string `config:"redis_address"`
+	StorageConfig
+}
+
+func TestLoadConfigEmbeddedStruct(t *testing.T) {
+	config := testEmbeddedConfig{StorageConfig: StorageConfig{Storage: StorageTypeLocal}}
+	err := LoadConfig(&config, flag.NewFlagSet("test", flag.ContinueOnError),
+		[]string{"-storage", "s3", "-s3-bucket", "images", "-s3_secret_key", "secret"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.Storage != StorageTypeS3 || config.S3Bucket != "images" {
+		t.Errorf("expected values of embedded struct to be set, got %+v", config)
+	}
+
+	var buf bytes.Buffer
+	err = PrintConfig(&buf, &config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(buf.String(), "s3_bucket: images\n") || !strings.Contains(buf.String(), "s3_secret_key: <redacted>\n") {
+		t.Errorf("expected embedded values in printed config, got\n%s", buf.String())
+	}
+}
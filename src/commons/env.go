@@ -0,0 +1,14 @@
+package commons
+
+import (
+	"os"
+)
+
+func GetEnv(name string) string {
+	val, found := os.LookupEnv(name)
+	if found {
+		return val
+	}
+
+	return ""
+}
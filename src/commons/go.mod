@@ -0,0 +1,17 @@
+module github.com/bbernhard/imagemonkey-playground/commons
+
+go 1.12
+
+require (
+	github.com/alicebob/gopher-json v0.0.0-20180125190556-5a6b3ba71ee6 // indirect
+	github.com/alicebob/miniredis v2.5.0+incompatible
+	github.com/bbernhard/imagemonkey-playground/datastructures v0.0.0-00010101000000-000000000000
+	github.com/garyburd/redigo v1.6.0
+	github.com/gomodule/redigo v1.7.0 // indirect
+	github.com/minio/minio-go/v6 v6.0.50
+	github.com/sirupsen/logrus v1.4.2
+	github.com/yuin/gopher-lua v0.0.0-20190514113301-1cd887cd7036 // indirect
+	gopkg.in/yaml.v2 v2.2.5
+)
+
+replace github.com/bbernhard/imagemonkey-playground/datastructures => ../datastructures
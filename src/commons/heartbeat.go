@@ -0,0 +1,96 @@
+package commons
+
+import (
+	"fmt"
+	"github.com/garyburd/redigo/redis"
+	log "github.com/sirupsen/logrus"
+	"os"
+	"strconv"
+	"time"
+)
+
+//HeartbeatInterval is the interval in which workers send a heartbeat
+const HeartbeatInterval = 10 * time.Second
+
+//heartbeats of workers that are gone are removed after an hour
+const heartbeatRetention = 3600
+
+//every worker type has a sorted set with the worker ids, scored by the time of the last heartbeat
+func heartbeatKey(jobType string) string {
+	return jobType + "heartbeats"
+}
+
+//GetWorkerId returns an id that identifies this process
+func GetWorkerId() string {
+	hostname, err := os.Hostname()
+	if err != nil {
+		hostname = "unknown"
+	}
+	return fmt.Sprintf("%s:%d", hostname, os.Getpid())
+}
+
+//SendHeartbeat tells everyone that the worker is still alive
+func SendHeartbeat(redisConn redis.Conn, jobType string, workerId string) error {
+	now := time.Now().Unix()
+	key := heartbeatKey(jobType)
+
+	redisConn.Send("MULTI")
+	redisConn.Send("ZADD", key, now, workerId)
+	redisConn.Send("ZREMRANGEBYSCORE", key, "-inf", (now - heartbeatRetention))
+	_, err := redisConn.Do("EXEC")
+	return err
+}
+
+//StartHeartbeat sends a heartbeat every HeartbeatInterval until the returned function is called
+func StartHeartbeat(redisPool *redis.Pool, jobType string, workerId string) (stop func()) {
+	done := make(chan struct{})
+
+	send := func() {
+		redisConn := redisPool.Get()
+		defer redisConn.Close()
+
+		err := SendHeartbeat(redisConn, jobType, workerId)
+		if err != nil {
+			log.Error("[Heartbeat] Couldn't send heartbeat: ", err.Error())
+		}
+	}
+
+	go func() {
+		ticker := time.NewTicker(HeartbeatInterval)
+		defer ticker.Stop()
+
+		send()
+		for {
+			select {
+			case <-ticker.C:
+				send()
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	return func() {
+		close(done)
+	}
+}
+
+//GetWorkerStatus returns the number of workers that sent a heartbeat within maxAge
+//and the time of the most recent heartbeat (0 if there was none)
+func GetWorkerStatus(redisConn redis.Conn, jobType string, maxAge time.Duration) (active int, lastHeartbeat int64, err error) {
+	key := heartbeatKey(jobType)
+	now := time.Now()
+
+	active, err = redis.Int(redisConn.Do("ZCOUNT", key, now.Add(-maxAge).Unix(), "+inf"))
+	if err != nil {
+		return 0, 0, err
+	}
+
+	values, err := redis.Strings(redisConn.Do("ZREVRANGE", key, 0, 0, "WITHSCORES"))
+	if err != nil || len(values) < 2 {
+		return active, 0, err
+	}
+
+	lastHeartbeat, err = strconv.ParseInt(values[1], 10, 64)
+	return active, lastHeartbeat, err
+}
@@ -0,0 +1,236 @@
+package commons
+
+import (
+	"encoding/json"
+	"errors"
+	datastructures "github.com/bbernhard/imagemonkey-playground/datastructures"
+	"github.com/garyburd/redigo/redis"
+	"time"
+)
+
+const (
+	JobStateQueued     = "queued"
+	JobStateProcessing = "processing"
+	JobStateDone       = "done"
+	JobStateFailed     = "failed"
+	JobStateExpired    = "expired"
+)
+
+const (
+	JobTypePrediction = "predict"
+	JobTypeGrabcut    = "grabcut"
+)
+
+//the job state outlives the actual result (which expires after 10min/1hr), so
+//that we can tell clients that their result is gone instead of answering with a 404
+const jobStateExpiration = 86400
+
+func jobStateKey(uuid string) string {
+	return "jobstate" + uuid
+}
+
+//JobStateChannel returns the pub/sub channel on which every state change
+//of the job is published (as serialized datastructures.JobState)
+func JobStateChannel(uuid string) string {
+	return "jobstate" + uuid
+}
+
+//WebhookQueue is a sorted set with the uuids of the jobs whose webhook needs to be delivered,
+//scored by the time (unix timestamp) of the next delivery attempt. A job is added once it
+//reaches state done or failed (if it has a callback url). The grabcut worker
+//(src/grabcut/grabcut.py) adds its jobs too, so the key mustn't be changed without
+//changing the worker.
+const WebhookQueue = "webhooks"
+
+//IsFinalJobState returns true if the job won't change its state anymore
+func IsFinalJobState(state string) bool {
+	return state == JobStateDone || state == JobStateFailed || state == JobStateExpired
+}
+
+//CreateJobState adds a new job in state 'queued'. Needs to be called
+//before the job is pushed to the queue. callbackUrl is optional.
+func CreateJobState(redisConn redis.Conn, uuid string, jobType string, callbackUrl string) error {
+	redisConn.Send("MULTI")
+	SendCreateJobState(redisConn, uuid, jobType, callbackUrl)
+	_, err := redisConn.Do("EXEC")
+	return err
+}
+
+//SendCreateJobState is like CreateJobState, but only sends the commands. Meant
+//for transactions (MULTI/EXEC) of the caller.
+func SendCreateJobState(redisConn redis.Conn, uuid string, jobType string, callbackUrl string) {
+	now := time.Now().Unix()
+	key := jobStateKey(uuid)
+
+	redisConn.Send("HMSET", key, "uuid", uuid, "type", jobType, "state", JobStateQueued,
+		"created", now, "updated", now, "callback_url", callbackUrl)
+	redisConn.Send("EXPIRE", key, jobStateExpiration)
+}
+
+//KEYS: job state, webhook queue
+//ARGV: uuid, state, updated, error (empty = unchanged), expiration
+//
+//The grabcut worker (src/grabcut/grabcut.py) runs the same script.
+var updateJobStateScript = redis.NewScript(2, `
+local previous = redis.call('HGET', KEYS[1], 'state')
+--a finished job stays finished (e.g. when it was delivered twice), only its result can expire
+if (previous == 'done' or previous == 'failed' or previous == 'expired') and ARGV[2] ~= 'expired' then
+	return 0
+end
+
+redis.call('HMSET', KEYS[1], 'state', ARGV[2], 'updated', ARGV[3])
+if ARGV[4] ~= '' then
+	redis.call('HSET', KEYS[1], 'error', ARGV[4])
+end
+redis.call('EXPIRE', KEYS[1], ARGV[5])
+
+local final = {done = true, failed = true}
+if final[ARGV[2]] and not final[previous] then
+	local callback_url = redis.call('HGET', KEYS[1], 'callback_url')
+	if callback_url and callback_url ~= '' then
+		redis.call('ZADD', KEYS[2], ARGV[3], ARGV[1])
+	end
+end
+return 1
+`)
+
+//UpdateJobState sets the state of an existing job and publishes the change. errMsg
+//is only stored if it isn't empty. Once the job is done or failed, its webhook is
+//scheduled (see WebhookQueue) and its state can only change to expired anymore
+//(other changes are ignored).
+func UpdateJobState(redisConn redis.Conn, uuid string, state string, errMsg string) error {
+	var jobState datastructures.JobState
+	jobState.Uuid = uuid
+	jobState.State = state
+	jobState.Error = errMsg
+	jobState.Updated = time.Now().Unix()
+
+	notification, err := json.Marshal(jobState)
+	if err != nil {
+		return err
+	}
+
+	stored, err := storeJobState(redisConn, jobState)
+	if err != nil || !stored {
+		return err
+	}
+
+	//published after the state is stored, so that subscribers which read the state see the change
+	_, err = redisConn.Do("PUBLISH", JobStateChannel(uuid), notification)
+	return err
+}
+
+//storeJobState stores the state and schedules the webhook (without publishing the change).
+//Returns false if the job was already finished.
+func storeJobState(redisConn redis.Conn, jobState datastructures.JobState) (bool, error) {
+	return redis.Bool(updateJobStateScript.Do(redisConn, jobStateKey(jobState.Uuid), WebhookQueue, jobState.Uuid,
+		jobState.State, jobState.Updated, jobState.Error, jobStateExpiration))
+}
+
+//JobStateSubscription delivers the state changes of a single job
+type JobStateSubscription struct {
+	C          <-chan datastructures.JobState
+	pubSubConn redis.PubSubConn
+}
+
+//SubscribeJobState subscribes to the state changes of the job with the given uuid.
+//The subscription needs to be closed by the caller.
+func SubscribeJobState(redisPool *redis.Pool, uuid string) (*JobStateSubscription, error) {
+	//we need a dedicated connection, as a subscribed connection can't be used for anything else
+	pubSubConn := redis.PubSubConn{Conn: redisPool.Get()}
+
+	err := pubSubConn.Subscribe(JobStateChannel(uuid))
+	if err != nil {
+		pubSubConn.Close()
+		return nil, err
+	}
+
+	notifications := make(chan datastructures.JobState, 10)
+	go func() {
+		defer pubSubConn.Close()
+		defer close(notifications)
+		for {
+			switch v := pubSubConn.Receive().(type) {
+			case redis.Message:
+				var notification datastructures.JobState
+				if err := json.Unmarshal(v.Data, &notification); err == nil {
+					notifications <- notification
+				}
+			case redis.Subscription:
+				if v.Count == 0 { //unsubscribed, see Close()
+					return
+				}
+			case error:
+				return
+			}
+		}
+	}()
+
+	return &JobStateSubscription{C: notifications, pubSubConn: pubSubConn}, nil
+}
+
+//Close ends the subscription. The connection is closed by the receiving goroutine
+//as soon as Redis confirmed the unsubscribe.
+func (s *JobStateSubscription) Close() {
+	s.pubSubConn.Unsubscribe()
+	//drain, so that the receiving goroutine doesn't block forever
+	for range s.C {
+	}
+}
+
+//WaitForFinalJobState blocks until the job with the given uuid reached a final state or
+//the timeout passed. It returns immediately if the job doesn't exist.
+func WaitForFinalJobState(redisPool *redis.Pool, uuid string, timeout time.Duration) error {
+	subscription, err := SubscribeJobState(redisPool, uuid)
+	if err != nil {
+		return err
+	}
+	defer subscription.Close()
+
+	//check the state only after we've subscribed - otherwise we could miss the notification
+	redisConn := redisPool.Get()
+	jobState, found, err := GetJobState(redisConn, uuid)
+	redisConn.Close()
+	if err != nil {
+		return err
+	}
+	if !found || IsFinalJobState(jobState.State) {
+		return nil
+	}
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	for {
+		select {
+		case notification, ok := <-subscription.C:
+			if !ok {
+				return errors.New("subscription closed unexpectedly")
+			}
+			if IsFinalJobState(notification.State) {
+				return nil
+			}
+		case <-timer.C:
+			return nil
+		}
+	}
+}
+
+//GetJobState returns the state of the job with the given uuid. If there
+//is no such job, found is false.
+func GetJobState(redisConn redis.Conn, uuid string) (jobState datastructures.JobState, found bool, err error) {
+	values, err := redis.Values(redisConn.Do("HGETALL", jobStateKey(uuid)))
+	if err != nil {
+		return jobState, false, err
+	}
+
+	if len(values) == 0 {
+		return jobState, false, nil
+	}
+
+	err = redis.ScanStruct(values, &jobState)
+	if err != nil {
+		return jobState, false, err
+	}
+
+	return jobState, true, nil
+}
@@ -0,0 +1,100 @@
+package commons
+
+import (
+	datastructures "github.com/bbernhard/imagemonkey-playground/datastructures"
+	"github.com/garyburd/redigo/redis"
+	"testing"
+	"time"
+)
+
+//storeTestJobState is UpdateJobState without the notification (miniredis doesn't support PUBLISH)
+func storeTestJobState(t *testing.T, redisConn redis.Conn, uuid string, state string, errMsg string) {
+	_, err := storeJobState(redisConn, datastructures.JobState{Uuid: uuid, State: state, Error: errMsg, Updated: time.Now().Unix()})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestUpdateJobState(t *testing.T) {
+	server, redisConn := newTestRedis(t)
+	defer server.Close()
+	defer redisConn.Close()
+
+	if err := CreateJobState(redisConn, "1234", JobTypePrediction, ""); err != nil {
+		t.Fatal(err)
+	}
+	storeTestJobState(t, redisConn, "1234", JobStateFailed, "Couldn't process request")
+
+	jobState, found, err := GetJobState(redisConn, "1234")
+	if err != nil || !found {
+		t.Fatalf("expected the job state, got found %v, err %v", found, err)
+	}
+	if jobState.State != JobStateFailed || jobState.Error != "Couldn't process request" || jobState.Type != JobTypePrediction {
+		t.Errorf("unexpected job state %+v", jobState)
+	}
+
+	//jobs without callback url don't have a webhook
+	if scheduled, _ := redis.Int(redisConn.Do("ZCARD", WebhookQueue)); scheduled != 0 {
+		t.Errorf("expected no webhook, got %d", scheduled)
+	}
+}
+
+func TestUpdateJobStateSchedulesWebhook(t *testing.T) {
+	server, redisConn := newTestRedis(t)
+	defer server.Close()
+	defer redisConn.Close()
+
+	if err := CreateJobState(redisConn, "1234", JobTypeGrabcut, "http://203.0.113.1/hook"); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, state := range []string{JobStateProcessing, JobStateDone} {
+		storeTestJobState(t, redisConn, "1234", state, "")
+	}
+	uuids, err := redis.Strings(redisConn.Do("ZRANGE", WebhookQueue, 0, -1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(uuids) != 1 || uuids[0] != "1234" {
+		t.Fatalf("expected the webhook of the job to be scheduled, got %v", uuids)
+	}
+
+	//the webhook is only scheduled when the job becomes final, not again afterwards
+	if _, err := redisConn.Do("ZREM", WebhookQueue, "1234"); err != nil {
+		t.Fatal(err)
+	}
+	storeTestJobState(t, redisConn, "1234", JobStateFailed, "Couldn't process request")
+	if scheduled, _ := redis.Int(redisConn.Do("ZCARD", WebhookQueue)); scheduled != 0 {
+		t.Errorf("expected the webhook not to be scheduled again, got %d", scheduled)
+	}
+}
+
+func TestUpdateJobStateKeepsFinalState(t *testing.T) {
+	server, redisConn := newTestRedis(t)
+	defer server.Close()
+	defer redisConn.Close()
+
+	if err := CreateJobState(redisConn, "1234", JobTypePrediction, ""); err != nil {
+		t.Fatal(err)
+	}
+	storeTestJobState(t, redisConn, "1234", JobStateDone, "")
+
+	//e.g. a second delivery of the job
+	for _, state := range []string{JobStateProcessing, JobStateFailed} {
+		stored, err := storeJobState(redisConn, datastructures.JobState{Uuid: "1234", State: state, Updated: time.Now().Unix()})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if stored {
+			t.Errorf("expected the change to %s to be ignored", state)
+		}
+	}
+	if jobState, _, _ := GetJobState(redisConn, "1234"); jobState.State != JobStateDone {
+		t.Errorf("expected the job to stay done, got %s", jobState.State)
+	}
+
+	storeTestJobState(t, redisConn, "1234", JobStateExpired, "")
+	if jobState, _, _ := GetJobState(redisConn, "1234"); jobState.State != JobStateExpired {
+		t.Errorf("expected the result of the job to expire, got %s", jobState.State)
+	}
+}
@@ -0,0 +1,212 @@
+package commons
+
+import (
+	"errors"
+	"github.com/garyburd/redigo/redis"
+	"time"
+)
+
+//max number of items that are kept in the dead letter list of a queue
+const maxDeadLetters = 1000
+
+//ReliableQueue is a FIFO queue in redis, whose items survive the crash of a consumer.
+//A consumer moves the item it pops to a processing list and leases it for a visibility
+//timeout. Once the item is processed, the consumer acknowledges it. Items whose lease
+//expired are put back into the queue by Reap, so every item is delivered at least once.
+//
+//The grabcut worker (src/grabcut/grabcut.py) implements the consumer side of the same
+//protocol, so the keys mustn't be changed without changing the worker.
+type ReliableQueue struct {
+	Name string
+}
+
+func NewReliableQueue(name string) ReliableQueue {
+	return ReliableQueue{Name: name}
+}
+
+//queues of the predict and the grabcut worker. Every model of the predict worker has its
+//own queue, so that a model whose workers are all busy doesn't hold up the jobs of the other one.
+var (
+	PredictionQueue     = NewReliableQueue("predictme") //classification
+	NSFWPredictionQueue = NewReliableQueue("predictmensfw")
+	GrabcutQueue        = NewReliableQueue("grabcutme")
+)
+
+//GetPredictionQueue returns the queue of the model with the given name (the type of the prediction request)
+func GetPredictionQueue(model string) ReliableQueue {
+	if model == "nsfw-classification" {
+		return NSFWPredictionQueue
+	}
+	return PredictionQueue
+}
+
+func (q ReliableQueue) processingKey() string {
+	return q.Name + "processing"
+}
+
+func (q ReliableQueue) leasesKey() string {
+	return q.Name + "leases"
+}
+
+func (q ReliableQueue) deliveriesKey() string {
+	return q.Name + "deliveries"
+}
+
+//DeadLetterKey returns the key of the list with the items that were given up on
+func (q ReliableQueue) DeadLetterKey() string {
+	return q.Name + "dead"
+}
+
+//Send sends the command that adds the item to the queue. Meant for transactions (MULTI/EXEC)
+//of the caller.
+func (q ReliableQueue) Send(redisConn redis.Conn, item []byte) error {
+	return redisConn.Send("LPUSH", q.Name, item)
+}
+
+//Push adds the item to the queue
+func (q ReliableQueue) Push(redisConn redis.Conn, item []byte) error {
+	_, err := redisConn.Do("LPUSH", q.Name, item)
+	return err
+}
+
+//Pop takes the oldest item from the queue and leases it for visibilityTimeout. Returns
+//nil if the queue is empty. The item needs to be acknowledged with Ack once it's processed.
+func (q ReliableQueue) Pop(redisConn redis.Conn, visibilityTimeout time.Duration) ([]byte, error) {
+	item, err := redis.Bytes(redisConn.Do("RPOPLPUSH", q.Name, q.processingKey()))
+	return q.lease(redisConn, item, err, visibilityTimeout)
+}
+
+//BlockingPop is like Pop, but waits up to timeout (at least a second) for an item, in case
+//the queue is empty. Returns nil if there was no item within the timeout.
+func (q ReliableQueue) BlockingPop(redisConn redis.Conn, timeout time.Duration, visibilityTimeout time.Duration) ([]byte, error) {
+	seconds := int(timeout / time.Second)
+	if seconds < 1 {
+		seconds = 1 //0 would block forever
+	}
+	item, err := redis.Bytes(redisConn.Do("BRPOPLPUSH", q.Name, q.processingKey(), seconds))
+	return q.lease(redisConn, item, err, visibilityTimeout)
+}
+
+//lease leases the popped item (the reply of the pop command) for visibilityTimeout
+func (q ReliableQueue) lease(redisConn redis.Conn, item []byte, err error, visibilityTimeout time.Duration) ([]byte, error) {
+	if err == redis.ErrNil {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	//if we die before the lease is stored, Reap leases the item for us
+	deadline := time.Now().Add(visibilityTimeout).Unix()
+	_, err = redisConn.Do("ZADD", q.leasesKey(), deadline, item)
+	return item, err
+}
+
+//KEYS: leases
+//ARGV: item, deadline
+var extendScript = redis.NewScript(1, `
+if redis.call('ZSCORE', KEYS[1], ARGV[1]) then
+	redis.call('ZADD', KEYS[1], ARGV[2], ARGV[1])
+	return 1
+end
+return 0
+`)
+
+//Extend renews the lease of the popped item, so that it expires visibilityTimeout from now.
+//Returns false if the item isn't leased anymore, because its lease expired and Reap handed
+//it out again (or gave up on it). The item mustn't be processed (nor acknowledged) then.
+func (q ReliableQueue) Extend(redisConn redis.Conn, item []byte, visibilityTimeout time.Duration) (bool, error) {
+	deadline := time.Now().Add(visibilityTimeout).Unix()
+	return redis.Bool(extendScript.Do(redisConn, q.leasesKey(), item, deadline))
+}
+
+//KEYS: queue, processing list, leases
+var releaseScript = redis.NewScript(3, `
+if redis.call('LREM', KEYS[2], 1, ARGV[1]) > 0 then
+	redis.call('ZREM', KEYS[3], ARGV[1])
+	redis.call('RPUSH', KEYS[1], ARGV[1])
+end
+return 0
+`)
+
+//Release puts the popped item back to the front of the queue, e.g. because the consumer has
+//no capacity to process it. Unlike an expired lease, this doesn't count as a delivery.
+func (q ReliableQueue) Release(redisConn redis.Conn, item []byte) error {
+	_, err := releaseScript.Do(redisConn, q.Name, q.processingKey(), q.leasesKey(), item)
+	return err
+}
+
+//Ack removes the processed item from the processing list
+func (q ReliableQueue) Ack(redisConn redis.Conn, item []byte) error {
+	redisConn.Send("MULTI")
+	redisConn.Send("LREM", q.processingKey(), 1, item)
+	redisConn.Send("ZREM", q.leasesKey(), item)
+	redisConn.Send("HDEL", q.deliveriesKey(), item)
+	_, err := redisConn.Do("EXEC")
+	return err
+}
+
+//Len returns the number of items in the queue and the number of items that are processed
+func (q ReliableQueue) Len(redisConn redis.Conn) (queued int, processing int, err error) {
+	redisConn.Send("MULTI")
+	redisConn.Send("LLEN", q.Name)
+	redisConn.Send("LLEN", q.processingKey())
+	values, err := redis.Ints(redisConn.Do("EXEC"))
+	if err != nil {
+		return 0, 0, err
+	}
+	return values[0], values[1], nil
+}
+
+//KEYS: queue, processing list, leases, deliveries, dead letters
+//ARGV: now, lease of items without lease, max deliveries, max dead letters
+var reapScript = redis.NewScript(5, `
+local items = redis.call('LRANGE', KEYS[2], 0, -1)
+for _, item in ipairs(items) do
+	if not redis.call('ZSCORE', KEYS[3], item) then
+		redis.call('ZADD', KEYS[3], ARGV[2], item)
+	end
+end
+
+local requeued = 0
+local dead = {}
+for _, item in ipairs(redis.call('ZRANGEBYSCORE', KEYS[3], '-inf', ARGV[1])) do
+	redis.call('ZREM', KEYS[3], item)
+	if redis.call('LREM', KEYS[2], 1, item) > 0 then
+		if redis.call('HINCRBY', KEYS[4], item, 1) >= tonumber(ARGV[3]) then
+			redis.call('HDEL', KEYS[4], item)
+			redis.call('LPUSH', KEYS[5], item)
+			redis.call('LTRIM', KEYS[5], 0, tonumber(ARGV[4]) - 1)
+			table.insert(dead, item)
+		else
+			redis.call('RPUSH', KEYS[1], item)
+			requeued = requeued + 1
+		end
+	end
+end
+return {requeued, dead}
+`)
+
+//Reap puts the items whose lease expired back to the front of the queue. Items without lease
+//(the consumer died right after popping them) are leased for orphanTimeout first. Items that
+//weren't acknowledged after maxDeliveries deliveries are moved to the dead letter list instead
+//and returned, so that the caller can mark the jobs as failed.
+func (q ReliableQueue) Reap(redisConn redis.Conn, orphanTimeout time.Duration, maxDeliveries int) (requeued int, dead [][]byte, err error) {
+	now := time.Now()
+	values, err := redis.Values(reapScript.Do(redisConn, q.Name, q.processingKey(), q.leasesKey(), q.deliveriesKey(),
+		q.DeadLetterKey(), now.Unix(), now.Add(orphanTimeout).Unix(), maxDeliveries, maxDeadLetters))
+	if err != nil {
+		return 0, nil, err
+	}
+
+	if len(values) != 2 {
+		return 0, nil, errors.New("unexpected reply of reap script")
+	}
+
+	requeued, err = redis.Int(values[0], nil)
+	if err != nil {
+		return 0, nil, err
+	}
+	dead, err = redis.ByteSlices(values[1], nil)
+	return requeued, dead, err
+}
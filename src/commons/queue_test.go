@@ -0,0 +1,285 @@
+package commons
+
+import (
+	"github.com/alicebob/miniredis"
+	"github.com/garyburd/redigo/redis"
+	"testing"
+	"time"
+)
+
+func newTestRedis(t *testing.T) (*miniredis.Miniredis, redis.Conn) {
+	server, err := miniredis.Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	redisConn, err := redis.Dial("tcp", server.Addr())
+	if err != nil {
+		server.Close()
+		t.Fatal(err)
+	}
+	return server, redisConn
+}
+
+func popItem(t *testing.T, redisConn redis.Conn, queue ReliableQueue, visibilityTimeout time.Duration) string {
+	item, err := queue.Pop(redisConn, visibilityTimeout)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(item)
+}
+
+func checkQueueLen(t *testing.T, redisConn redis.Conn, queue ReliableQueue, expectedQueued int, expectedProcessing int) {
+	queued, processing, err := queue.Len(redisConn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if queued != expectedQueued || processing != expectedProcessing {
+		t.Errorf("expected %d queued and %d processing items, got %d and %d", expectedQueued, expectedProcessing, queued, processing)
+	}
+}
+
+func TestReliableQueueIsFifo(t *testing.T) {
+	server, redisConn := newTestRedis(t)
+	defer server.Close()
+	defer redisConn.Close()
+
+	queue := NewReliableQueue("test")
+	for _, item := range []string{"a", "b", "c"} {
+		if err := queue.Push(redisConn, []byte(item)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, expected := range []string{"a", "b", "c", ""} {
+		if item := popItem(t, redisConn, queue, time.Minute); item != expected {
+			t.Errorf("expected item %q, got %q", expected, item)
+		}
+	}
+	checkQueueLen(t, redisConn, queue, 0, 3)
+
+	for _, item := range []string{"a", "b", "c"} {
+		if err := queue.Ack(redisConn, []byte(item)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	checkQueueLen(t, redisConn, queue, 0, 0)
+}
+
+func TestReliableQueueRequeuesExpiredItems(t *testing.T) {
+	server, redisConn := newTestRedis(t)
+	defer server.Close()
+	defer redisConn.Close()
+
+	queue := NewReliableQueue("test")
+	for _, item := range []string{"crashed", "processed", "slow", "next"} {
+		if err := queue.Push(redisConn, []byte(item)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	popItem(t, redisConn, queue, -time.Second)
+	popItem(t, redisConn, queue, -time.Second)
+	popItem(t, redisConn, queue, time.Minute)
+	if err := queue.Ack(redisConn, []byte("processed")); err != nil {
+		t.Fatal(err)
+	}
+
+	requeued, dead, err := queue.Reap(redisConn, time.Minute, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if requeued != 1 || len(dead) != 0 {
+		t.Errorf("expected 1 requeued and no dead items, got %d and %d", requeued, len(dead))
+	}
+	checkQueueLen(t, redisConn, queue, 2, 1)
+
+	//the requeued item is delivered before the items that were queued later
+	if item := popItem(t, redisConn, queue, time.Minute); item != "crashed" {
+		t.Errorf("expected the requeued item, got %q", item)
+	}
+}
+
+func TestReliableQueueExtend(t *testing.T) {
+	server, redisConn := newTestRedis(t)
+	defer server.Close()
+	defer redisConn.Close()
+
+	queue := NewReliableQueue("test")
+	for _, item := range []string{"extended", "expired"} {
+		if err := queue.Push(redisConn, []byte(item)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	popItem(t, redisConn, queue, -time.Second)
+	popItem(t, redisConn, queue, -time.Second)
+
+	extended, err := queue.Extend(redisConn, []byte("extended"), time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !extended {
+		t.Error("expected the lease to be extended")
+	}
+
+	requeued, _, err := queue.Reap(redisConn, time.Minute, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if requeued != 1 {
+		t.Errorf("expected only the expired item to be requeued, got %d requeued", requeued)
+	}
+	checkQueueLen(t, redisConn, queue, 1, 1)
+
+	//the expired item was handed out again, its lease can't be extended anymore
+	extended, err = queue.Extend(redisConn, []byte("expired"), time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if extended {
+		t.Error("expected the lease of the requeued item not to be extended")
+	}
+	checkQueueLen(t, redisConn, queue, 1, 1)
+}
+
+func TestReliableQueueLeasesOrphanedItems(t *testing.T) {
+	server, redisConn := newTestRedis(t)
+	defer server.Close()
+	defer redisConn.Close()
+
+	//the consumer died between popping the item and storing the lease
+	queue := NewReliableQueue("test")
+	if _, err := redisConn.Do("LPUSH", queue.processingKey(), "orphan"); err != nil {
+		t.Fatal(err)
+	}
+
+	requeued, _, err := queue.Reap(redisConn, time.Minute, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if requeued != 0 {
+		t.Errorf("expected the orphaned item to be leased first, got %d requeued", requeued)
+	}
+
+	requeued, _, err = queue.Reap(redisConn, -time.Second, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if requeued != 0 {
+		t.Errorf("expected the existing lease to be kept, got %d requeued", requeued)
+	}
+
+	if _, err := redisConn.Do("ZADD", queue.leasesKey(), time.Now().Add(-time.Second).Unix(), "orphan"); err != nil {
+		t.Fatal(err)
+	}
+	requeued, _, err = queue.Reap(redisConn, time.Minute, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if requeued != 1 {
+		t.Errorf("expected the orphaned item to be requeued once its lease expired, got %d requeued", requeued)
+	}
+}
+
+func TestReliableQueueGivesUpAfterMaxDeliveries(t *testing.T) {
+	server, redisConn := newTestRedis(t)
+	defer server.Close()
+	defer redisConn.Close()
+
+	queue := NewReliableQueue("test")
+	if err := queue.Push(redisConn, []byte("poison")); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 1; i <= 3; i++ {
+		if item := popItem(t, redisConn, queue, -time.Second); item != "poison" {
+			t.Fatalf("expected delivery %d of the item, got %q", i, item)
+		}
+
+		requeued, dead, err := queue.Reap(redisConn, time.Minute, 3)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if i < 3 && (requeued != 1 || len(dead) != 0) {
+			t.Errorf("expected the item to be requeued after delivery %d, got %d requeued and %d dead", i, requeued, len(dead))
+		}
+		if i == 3 && (requeued != 0 || len(dead) != 1 || string(dead[0]) != "poison") {
+			t.Errorf("expected the item to be dead after delivery %d, got %d requeued and %q dead", i, requeued, dead)
+		}
+	}
+
+	checkQueueLen(t, redisConn, queue, 0, 0)
+	deadLetters, err := redis.Strings(redisConn.Do("LRANGE", queue.DeadLetterKey(), 0, -1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(deadLetters) != 1 || deadLetters[0] != "poison" {
+		t.Errorf("expected the item in the dead letter list, got %v", deadLetters)
+	}
+}
+
+func TestReliableQueueBlockingPop(t *testing.T) {
+	server, redisConn := newTestRedis(t)
+	defer server.Close()
+	defer redisConn.Close()
+
+	queue := NewReliableQueue("test")
+	if err := queue.Push(redisConn, []byte("a")); err != nil {
+		t.Fatal(err)
+	}
+
+	item, err := queue.BlockingPop(redisConn, time.Second, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(item) != "a" {
+		t.Errorf("expected item %q, got %q", "a", item)
+	}
+	checkQueueLen(t, redisConn, queue, 0, 1)
+
+	item, err = queue.BlockingPop(redisConn, time.Second, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if item != nil {
+		t.Errorf("expected no item after the timeout, got %q", item)
+	}
+}
+
+func TestReliableQueueRelease(t *testing.T) {
+	server, redisConn := newTestRedis(t)
+	defer server.Close()
+	defer redisConn.Close()
+
+	queue := NewReliableQueue("test")
+	for _, item := range []string{"a", "b"} {
+		if err := queue.Push(redisConn, []byte(item)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	popItem(t, redisConn, queue, -time.Second)
+	if err := queue.Release(redisConn, []byte("a")); err != nil {
+		t.Fatal(err)
+	}
+	checkQueueLen(t, redisConn, queue, 2, 0)
+
+	//the released item is neither leased anymore nor counted as a delivery
+	requeued, dead, err := queue.Reap(redisConn, time.Minute, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if requeued != 0 || len(dead) != 0 {
+		t.Errorf("expected no requeued and no dead items, got %d and %d", requeued, len(dead))
+	}
+
+	if item := popItem(t, redisConn, queue, time.Minute); item != "a" {
+		t.Errorf("expected the released item, got %q", item)
+	}
+
+	//releasing an item that isn't processed (anymore) doesn't add it to the queue again
+	if err := queue.Release(redisConn, []byte("c")); err != nil {
+		t.Fatal(err)
+	}
+	checkQueueLen(t, redisConn, queue, 1, 1)
+}
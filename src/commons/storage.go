@@ -0,0 +1,203 @@
+package commons
+
+import (
+	"errors"
+	"fmt"
+	"github.com/minio/minio-go/v6"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+//ErrStorageNotFound is returned by Storage.Get if there is nothing stored under the key
+var ErrStorageNotFound = errors.New("not found in storage")
+
+//Storage stores the uploaded images, so that the api and the workers don't need to run
+//on the same host. Keys are simple names (e.g the uuid of the request), without any path.
+type Storage interface {
+	Put(key string, r io.Reader, size int64) error
+	Get(key string) (io.ReadCloser, error)
+	Delete(key string) error
+}
+
+const (
+	StorageTypeLocal = "local"
+	StorageTypeS3    = "s3"
+)
+
+//StorageConfig contains the storage related configuration, it is embedded
+//in the configs of the api and the predict worker.
+type StorageConfig struct {
+	Storage        string `config:"storage" help:"Where uploaded images are stored (local or s3)"`
+	PredictionsDir string `config:"predictions_dir" help:"Location of the temporary saved images for predictions (local storage)"`
+	S3Endpoint     string `config:"s3_endpoint" help:"Endpoint of the S3 compatible storage, e.g s3.amazonaws.com or localhost:9000"`
+	S3Region       string `config:"s3_region" help:"Region of the S3 bucket"`
+	S3Bucket       string `config:"s3_bucket" help:"S3 bucket the images are stored in"`
+	S3AccessKey    string `config:"s3_access_key" help:"S3 access key"`
+	S3SecretKey    string `config:"s3_secret_key" secret:"true" help:"S3 secret key"`
+	S3UseSSL       bool   `config:"s3_use_ssl" help:"Connect to the S3 endpoint via https"`
+}
+
+//Validate returns the problems of the storage configuration
+func (c *StorageConfig) Validate() []string {
+	var problems []string
+
+	switch c.Storage {
+	case StorageTypeLocal:
+		if c.PredictionsDir == "" {
+			problems = append(problems, "predictions_dir is required when storage is local")
+		}
+	case StorageTypeS3:
+		if c.S3Endpoint == "" || c.S3Bucket == "" {
+			problems = append(problems, "s3_endpoint and s3_bucket are required when storage is s3")
+		}
+	default:
+		problems = append(problems, "storage needs to be local or s3")
+	}
+
+	return problems
+}
+
+//NewStorage creates the storage that is selected in the config
+func NewStorage(config StorageConfig) (Storage, error) {
+	switch config.Storage {
+	case StorageTypeLocal:
+		return NewLocalStorage(config.PredictionsDir)
+	case StorageTypeS3:
+		return NewS3Storage(config.S3Endpoint, config.S3Region, config.S3Bucket, config.S3AccessKey,
+			config.S3SecretKey, config.S3UseSSL)
+	}
+	return nil, fmt.Errorf("unknown storage %s", config.Storage)
+}
+
+func validateStorageKey(key string) error {
+	if key == "" || key == "." || key == ".." || strings.ContainsAny(key, "/\\") {
+		return fmt.Errorf("invalid storage key %q", key)
+	}
+	return nil
+}
+
+//LocalStorage stores every key as file in a directory
+type LocalStorage struct {
+	dir string
+}
+
+//NewLocalStorage creates the directory if it doesn't exist yet
+func NewLocalStorage(dir string) (*LocalStorage, error) {
+	//as the images are temporary the directory might not already exist (e.q if they are stored in /tmp and the server reboots)
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return nil, err
+	}
+	return &LocalStorage{dir: dir}, nil
+}
+
+func (s *LocalStorage) path(key string) (string, error) {
+	err := validateStorageKey(key)
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(s.dir, key), nil
+}
+
+func (s *LocalStorage) Put(key string, r io.Reader, size int64) error {
+	path, err := s.path(key)
+	if err != nil {
+		return err
+	}
+
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+
+	_, err = io.Copy(f, r)
+	if err != nil {
+		f.Close()
+		os.Remove(path)
+		return err
+	}
+	return f.Close()
+}
+
+func (s *LocalStorage) Get(key string) (io.ReadCloser, error) {
+	path, err := s.path(key)
+	if err != nil {
+		return nil, err
+	}
+
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil, ErrStorageNotFound
+	}
+	return f, err
+}
+
+func (s *LocalStorage) Delete(key string) error {
+	path, err := s.path(key)
+	if err != nil {
+		return err
+	}
+
+	err = os.Remove(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+//S3Storage stores every key as object in a bucket of an S3 compatible storage (AWS, MinIO, ...)
+type S3Storage struct {
+	client *minio.Client
+	bucket string
+}
+
+func NewS3Storage(endpoint string, region string, bucket string, accessKey string, secretKey string, useSSL bool) (*S3Storage, error) {
+	client, err := minio.NewWithRegion(endpoint, accessKey, secretKey, useSSL, region)
+	if err != nil {
+		return nil, err
+	}
+	return &S3Storage{client: client, bucket: bucket}, nil
+}
+
+func (s *S3Storage) Put(key string, r io.Reader, size int64) error {
+	err := validateStorageKey(key)
+	if err != nil {
+		return err
+	}
+
+	_, err = s.client.PutObject(s.bucket, key, r, size, minio.PutObjectOptions{ContentType: "application/octet-stream"})
+	return err
+}
+
+func (s *S3Storage) Get(key string) (io.ReadCloser, error) {
+	err := validateStorageKey(key)
+	if err != nil {
+		return nil, err
+	}
+
+	object, err := s.client.GetObject(s.bucket, key, minio.GetObjectOptions{})
+	if err != nil {
+		return nil, err
+	}
+
+	//GetObject doesn't send a request, so we wouldn't notice a missing object before reading it
+	_, err = object.Stat()
+	if err != nil {
+		object.Close()
+		if minio.ToErrorResponse(err).Code == "NoSuchKey" {
+			return nil, ErrStorageNotFound
+		}
+		return nil, err
+	}
+	return object, nil
+}
+
+func (s *S3Storage) Delete(key string) error {
+	err := validateStorageKey(key)
+	if err != nil {
+		return err
+	}
+	return s.client.RemoveObject(s.bucket, key)
+}
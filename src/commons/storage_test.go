@@ -0,0 +1,178 @@
+package commons
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+)
+
+//fakeS3 implements the parts of the S3 api that are used by S3Storage (path style requests only)
+type fakeS3 struct {
+	mutex   sync.Mutex
+	objects map[string][]byte
+}
+
+//readAwsChunked decodes a body that was sent with a streaming signature
+//("<size>;chunk-signature=<signature>\r\n<data>\r\n", terminated by an empty chunk)
+func readAwsChunked(r io.Reader) ([]byte, error) {
+	var data []byte
+	reader := bufio.NewReader(r)
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+
+		size, err := strconv.ParseInt(strings.SplitN(line, ";", 2)[0], 16, 64)
+		if err != nil {
+			return nil, err
+		}
+
+		chunk := make([]byte, size+2) //data + \r\n
+		_, err = io.ReadFull(reader, chunk)
+		if err != nil {
+			return nil, err
+		}
+		if size == 0 {
+			return data, nil
+		}
+		data = append(data, chunk[:size]...)
+	}
+}
+
+func (s *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	key := strings.TrimPrefix(r.URL.Path, "/")
+	switch r.Method {
+	case http.MethodPut:
+		var data []byte
+		var err error
+		if r.Header.Get("X-Amz-Content-Sha256") == "STREAMING-AWS4-HMAC-SHA256-PAYLOAD" {
+			data, err = readAwsChunked(r.Body)
+		} else {
+			data, err = ioutil.ReadAll(r.Body)
+		}
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		s.objects[key] = data
+		w.Header().Set("ETag", `"etag"`)
+	case http.MethodGet, http.MethodHead:
+		data, found := s.objects[key]
+		if !found {
+			w.Header().Set("Content-Type", "application/xml")
+			w.WriteHeader(http.StatusNotFound)
+			if r.Method == http.MethodGet {
+				io.WriteString(w, `<?xml version="1.0" encoding="UTF-8"?><Error><Code>NoSuchKey</Code>`+
+					`<Message>The specified key does not exist.</Message></Error>`)
+			}
+			return
+		}
+		w.Header().Set("ETag", `"etag"`)
+		w.Header().Set("Last-Modified", "Mon, 02 Jan 2006 15:04:05 GMT")
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+		if r.Method == http.MethodGet {
+			w.Write(data)
+		}
+	case http.MethodDelete:
+		delete(s.objects, key)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+func testStorage(t *testing.T, storage Storage) {
+	data := []byte("not really an image")
+	err := storage.Put("0c6a2f5d-6c4a-4b8b-9a46-6f3fb6c4b2a1", bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r, err := storage.Get("0c6a2f5d-6c4a-4b8b-9a46-6f3fb6c4b2a1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	stored, err := ioutil.ReadAll(r)
+	r.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(stored, data) {
+		t.Errorf("expected %q, got %q", data, stored)
+	}
+
+	err = storage.Delete("0c6a2f5d-6c4a-4b8b-9a46-6f3fb6c4b2a1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = storage.Get("0c6a2f5d-6c4a-4b8b-9a46-6f3fb6c4b2a1"); err != ErrStorageNotFound {
+		t.Errorf("expected ErrStorageNotFound after delete, got %v", err)
+	}
+
+	err = storage.Delete("0c6a2f5d-6c4a-4b8b-9a46-6f3fb6c4b2a1")
+	if err != nil {
+		t.Errorf("expected deleting a missing key to succeed, got %v", err)
+	}
+
+	for _, key := range []string{"", ".", "..", "../passwd", "a/b", "a\\b"} {
+		if err = storage.Put(key, bytes.NewReader(data), int64(len(data))); err == nil {
+			t.Errorf("expected key %q to be rejected", key)
+		}
+	}
+}
+
+func TestLocalStorage(t *testing.T) {
+	dir, err := ioutil.TempDir("", "storage")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	storage, err := NewLocalStorage(dir + "/predictions/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	testStorage(t, storage)
+}
+
+func TestS3Storage(t *testing.T) {
+	server := httptest.NewServer(&fakeS3{objects: map[string][]byte{}})
+	defer server.Close()
+
+	storage, err := NewStorage(StorageConfig{Storage: StorageTypeS3, S3Endpoint: strings.TrimPrefix(server.URL, "http://"),
+		S3Region: "us-east-1", S3Bucket: "predictions", S3AccessKey: "access", S3SecretKey: "secret"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	testStorage(t, storage)
+}
+
+//TestMinioStorage runs against a real MinIO (or other S3 compatible) server, e.g
+//PLAYGROUND_TEST_S3_ENDPOINT=localhost:9000 PLAYGROUND_TEST_S3_BUCKET=predictions
+//PLAYGROUND_TEST_S3_ACCESS_KEY=minioadmin PLAYGROUND_TEST_S3_SECRET_KEY=minioadmin go test
+func TestMinioStorage(t *testing.T) {
+	endpoint := GetEnv("PLAYGROUND_TEST_S3_ENDPOINT")
+	if endpoint == "" {
+		t.Skip("PLAYGROUND_TEST_S3_ENDPOINT not set")
+	}
+
+	storage, err := NewS3Storage(endpoint, "us-east-1", GetEnv("PLAYGROUND_TEST_S3_BUCKET"),
+		GetEnv("PLAYGROUND_TEST_S3_ACCESS_KEY"), GetEnv("PLAYGROUND_TEST_S3_SECRET_KEY"), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testStorage(t, storage)
+}
@@ -1,14 +1,96 @@
 package datastructures
 
+type GrabcutSimplification struct {
+	Tolerance   float64 `json:"tolerance"`
+	HighQuality bool    `json:"high_quality"`
+	MaxVertices int     `json:"max_vertices,omitempty"`
+}
+
+type GrabcutPolygonOptions struct {
+	All     bool    `json:"all"`
+	MinArea float64 `json:"min_area"`
+}
+
+type GrabcutStroke struct {
+	Type   string      `json:"type"`
+	Width  float64     `json:"width"`
+	Points [][]float64 `json:"points"`
+}
+
+type GrabcutRectangle struct {
+	Type   string  `json:"type"`
+	X      float64 `json:"x"`
+	Y      float64 `json:"y"`
+	Width  float64 `json:"width"`
+	Height float64 `json:"height"`
+}
+
+type GrabcutStrokes struct {
+	Width      int                `json:"width,omitempty"`
+	Height     int                `json:"height,omitempty"`
+	Strokes    []GrabcutStroke    `json:"strokes"`
+	Rectangles []GrabcutRectangle `json:"rectangles"`
+}
+
 type GrabcutRequest struct {
-	Uuid     string `json:"uuid"`
-	Filename string `json:"filename"`
-	Mask     []byte `json:"mask"`
+	Uuid           string                 `json:"uuid"`
+	Filename       string                 `json:"filename"`
+	Mask           []byte                 `json:"mask"`
+	CallbackUrl    string                 `json:"callback_url,omitempty"`
+	Simplification *GrabcutSimplification `json:"simplification,omitempty"`
+	PolygonOptions *GrabcutPolygonOptions `json:"polygon_options,omitempty"`
+}
+
+type GrabcutSessionRound struct {
+	Uuid    string          `json:"uuid"`
+	Created int64           `json:"created"`
+	Strokes *GrabcutStrokes `json:"strokes,omitempty"`
+}
+
+type GrabcutSession struct {
+	Uuid           string                 `json:"uuid"`
+	Image          string                 `json:"image"`
+	Created        int64                  `json:"created"`
+	Updated        int64                  `json:"updated"`
+	Mask           []byte                 `json:"mask"`
+	CallbackUrl    string                 `json:"callback_url,omitempty"`
+	Simplification *GrabcutSimplification `json:"simplification,omitempty"`
+	PolygonOptions *GrabcutPolygonOptions `json:"polygon_options,omitempty"`
+	Rounds         []GrabcutSessionRound  `json:"rounds"`
+}
+
+type GrabcutMeSessionRound struct {
+	Round   int                    `json:"round"`
+	Uuid    string                 `json:"uuid"`
+	Created int64                  `json:"created"`
+	Strokes *GrabcutStrokes        `json:"strokes,omitempty"`
+	State   string                 `json:"state"`
+	Error   string                 `json:"error,omitempty"`
+	Result  map[string]interface{} `json:"result,omitempty"`
+}
+
+type GrabcutMeSession struct {
+	Uuid    string                  `json:"uuid"`
+	Image   string                  `json:"image"`
+	Created int64                   `json:"created"`
+	Updated int64                   `json:"updated"`
+	Rounds  []GrabcutMeSessionRound `json:"rounds"`
+}
+
+type GrabcutPolygon struct {
+	Points [][]float64   `json:"points"`
+	Holes  [][][]float64 `json:"holes"`
+	Area   float64       `json:"area"`
 }
 
 type GrabcutResult struct {
-	Points [][]float64 `json:"points"`
-	Error  string      `json:"error"`
+	Points         [][]float64            `json:"points"`
+	Polygons       []GrabcutPolygon       `json:"polygons,omitempty"`
+	Error          string                 `json:"error"`
+	Width          int                    `json:"width,omitempty"`
+	Height         int                    `json:"height,omitempty"`
+	Simplification *GrabcutSimplification `json:"simplification,omitempty"`
+	PolygonOptions *GrabcutPolygonOptions `json:"polygon_options,omitempty"`
 }
 
 type GrabcutMeResultPoint struct {
@@ -16,10 +98,22 @@ type GrabcutMeResultPoint struct {
 	Y float32 `json:"y"`
 }
 
+type GrabcutMePolygon struct {
+	Points []GrabcutMeResultPoint   `json:"points"`
+	Holes  [][]GrabcutMeResultPoint `json:"holes"`
+	Area   float64                  `json:"area"`
+}
+
 type GrabcutMeResult struct {
-	Points []GrabcutMeResultPoint `json:"points"`
-	Type   string                 `json:"type"`
-	Angle  float32                `json:"angle"`
+	Points           []GrabcutMeResultPoint `json:"points"`
+	Polygons         []GrabcutMePolygon     `json:"polygons,omitempty"`
+	Type             string                 `json:"type"`
+	Angle            float32                `json:"angle"`
+	OriginalVertices int                    `json:"original_vertices"`
+	Vertices         int                    `json:"vertices"`
+	Tolerance        float64                `json:"tolerance"`
+	Width            int                    `json:"width,omitempty"`
+	Height           int                    `json:"height,omitempty"`
 }
 
 type TFResult struct {
@@ -35,20 +129,60 @@ type ModelInfo struct {
 }
 
 type PredictionRequest struct {
-	Uuid     string `json:"uuid"`
-	Filename string `json:"filename"`
-	Created  int64  `json:"created"`
-	Type     string `json:"type"`
+	Uuid        string `json:"uuid"`
+	Filename    string `json:"filename"`
+	Created     int64  `json:"created"`
+	Type        string `json:"type"`
+	TopK        int    `json:"top_k"`
+	CallbackUrl string `json:"callback_url,omitempty"`
+}
+
+type PredictionFailure struct {
+	Code       string `json:"code"`
+	Message    string `json:"message"`
+	ModelBuild int32  `json:"model_build"`
 }
 
 type PredictionResult struct {
-	Uuid      string    `json:"uuid"`
-	Result    TFResult  `json:"result"`
-	ModelInfo ModelInfo `json:"model_info"`
+	Uuid        string             `json:"uuid"`
+	Result      TFResult           `json:"result"`
+	Predictions []TFResult         `json:"predictions"`
+	ModelInfo   ModelInfo          `json:"model_info"`
+	Error       *PredictionFailure `json:"error,omitempty"`
 }
 
 type PredictMeResult struct {
-	Label     string    `json:"label"`
-	Score     float32   `json:"score"`
-	ModelInfo ModelInfo `json:"model_info"`
+	Label       string             `json:"label"`
+	Score       float32            `json:"score"`
+	Predictions []TFResult         `json:"predictions"`
+	ModelInfo   ModelInfo          `json:"model_info"`
+	Error       *PredictionFailure `json:"error,omitempty"`
+}
+
+type JobState struct {
+	Uuid        string `json:"uuid" redis:"uuid"`
+	Type        string `json:"type" redis:"type"`
+	State       string `json:"state" redis:"state"`
+	Error       string `json:"error,omitempty" redis:"error"`
+	Created     int64  `json:"created" redis:"created"`
+	Updated     int64  `json:"updated" redis:"updated"`
+	CallbackUrl string `json:"-" redis:"callback_url"`
+}
+
+type WebhookDeliveryAttempt struct {
+	Attempt    int    `json:"attempt"`
+	Timestamp  int64  `json:"timestamp"`
+	StatusCode int    `json:"status_code"`
+	Error      string `json:"error,omitempty"`
+}
+
+type PredictionBatchItem struct {
+	Uuid     string `json:"uuid"`
+	Filename string `json:"filename"`
+}
+
+type PredictionBatch struct {
+	Uuid    string                `json:"uuid"`
+	Created int64                 `json:"created"`
+	Items   []PredictionBatchItem `json:"items"`
 }
@@ -0,0 +1,131 @@
+package exporter
+
+import (
+	"errors"
+	datastructures "github.com/bbernhard/imagemonkey-playground/datastructures"
+	"math"
+	"sort"
+)
+
+//COCOAnnotation contains the segmentation related fields of an annotation in the COCO
+//format (the ids are up to the caller).
+type COCOAnnotation struct {
+	Segmentation interface{} `json:"segmentation"`
+	Area         float64     `json:"area"`
+	Bbox         [4]float64  `json:"bbox"`
+	IsCrowd      int         `json:"iscrowd"`
+}
+
+//COCORLE is an uncompressed run-length encoded mask. The runs are in column-major order
+//and start with the number of background pixels.
+type COCORLE struct {
+	Size   [2]int `json:"size"` //height, width
+	Counts []int  `json:"counts"`
+}
+
+//ToCOCO returns the result as COCO annotation with polygon segmentation. COCO polygons
+//can't have holes - use ToCOCORLE if holes matter. The area doesn't include the holes.
+func ToCOCO(result datastructures.GrabcutMeResult) COCOAnnotation {
+	polygons := getPolygons(result)
+
+	segmentation := [][]float64{}
+	for _, poly := range polygons {
+		var coordinates []float64
+		for _, p := range poly.outer {
+			coordinates = append(coordinates, p.x, p.y)
+		}
+		segmentation = append(segmentation, coordinates)
+	}
+
+	return COCOAnnotation{Segmentation: segmentation, Area: getTotalArea(polygons), Bbox: getBoundingBox(polygons)}
+}
+
+//MaxRLEPixels is the max size (width * height) of the image a mask is run-length encoded for
+const MaxRLEPixels = 100000000
+
+//ErrImageTooLarge is returned for results whose image exceeds MaxRLEPixels
+var ErrImageTooLarge = errors.New("image too large for a run-length encoded mask")
+
+//ToCOCORLE returns the result as COCO annotation with a run-length encoded mask of the
+//whole image. The area is the number of pixels of the mask.
+func ToCOCORLE(result datastructures.GrabcutMeResult) (COCOAnnotation, error) {
+	polygons := getPolygons(result)
+	width, height := getImageSize(result, polygons)
+	if int64(width)*int64(height) > MaxRLEPixels {
+		return COCOAnnotation{}, ErrImageTooLarge
+	}
+
+	counts, area := encodeRLE(polygons, width, height)
+	rle := COCORLE{Size: [2]int{height, width}, Counts: counts}
+	return COCOAnnotation{Segmentation: rle, Area: float64(area), Bbox: getBoundingBox(polygons)}, nil
+}
+
+type edge struct {
+	p1, p2 point
+}
+
+//encodeRLE returns the (column-major) runs of the mask in which every pixel whose center
+//is inside a polygon (and not inside one of its holes) is set (even-odd rule) and the number
+//of set pixels. The mask itself is never built: every column is intersected with the edges
+//that cross it and the resulting spans are encoded right away.
+func encodeRLE(polygons []polygon, width int, height int) ([]int, int) {
+	//the edges that cross the center of each column
+	columns := make([][]edge, width)
+	for _, poly := range polygons {
+		for _, ring := range append([][]point{poly.outer}, poly.holes...) {
+			for i := range ring {
+				e := edge{ring[i], ring[(i+1)%len(ring)]}
+				first := int(math.Max(0, math.Ceil(math.Min(e.p1.x, e.p2.x)-0.5)))
+				last := int(math.Min(float64(width), math.Ceil(math.Max(e.p1.x, e.p2.x)-0.5)))
+				for x := first; x < last; x++ {
+					columns[x] = append(columns[x], e)
+				}
+			}
+		}
+	}
+
+	counts := []int{}
+	area := 0
+	current, run := false, 0
+	//appendRun adds n pixels of the given value to the runs
+	appendRun := func(set bool, n int) {
+		if n <= 0 {
+			return
+		}
+		if set != current {
+			counts = append(counts, run)
+			current, run = set, 0
+		}
+		run += n
+	}
+
+	for x, edges := range columns {
+		centerX := float64(x) + 0.5
+
+		var intersections []float64
+		for _, e := range edges {
+			if (e.p1.x <= centerX) != (e.p2.x <= centerX) {
+				intersections = append(intersections, e.p1.y+(centerX-e.p1.x)*(e.p2.y-e.p1.y)/(e.p2.x-e.p1.x))
+			}
+		}
+		sort.Float64s(intersections)
+
+		//the pixel y is inside the span [a, b), if a <= y + 0.5 < b
+		y := 0
+		for i := 0; i+1 < len(intersections); i += 2 {
+			start := int(math.Max(float64(y), math.Ceil(intersections[i]-0.5)))
+			end := int(math.Min(float64(height), math.Ceil(intersections[i+1]-0.5)))
+			if start >= end {
+				continue
+			}
+			appendRun(false, start-y)
+			appendRun(true, end-start)
+			area += end - start
+			y = end
+		}
+		appendRun(false, height-y)
+	}
+	counts = append(counts, run)
+
+	return counts, area
+}
@@ -0,0 +1,135 @@
+//Package exporter renders grabcut results in the formats of common labelling tools.
+package exporter
+
+import (
+	"encoding/json"
+	"fmt"
+	datastructures "github.com/bbernhard/imagemonkey-playground/datastructures"
+	"math"
+)
+
+const (
+	FormatGeoJSON = "geojson"
+	FormatCOCO    = "coco"
+	FormatCOCORLE = "coco-rle"
+	FormatSVG     = "svg"
+)
+
+//Formats contains all supported export formats
+var Formats = []string{FormatGeoJSON, FormatCOCO, FormatCOCORLE, FormatSVG}
+
+func IsSupportedFormat(format string) bool {
+	for _, f := range Formats {
+		if f == format {
+			return true
+		}
+	}
+	return false
+}
+
+//Export renders the grabcut result in the given format. Returns the rendered result
+//and its content type.
+func Export(format string, result datastructures.GrabcutMeResult) ([]byte, string, error) {
+	switch format {
+	case FormatGeoJSON:
+		data, err := json.Marshal(ToGeoJSON(result))
+		return data, "application/geo+json", err
+	case FormatCOCO:
+		data, err := json.Marshal(ToCOCO(result))
+		return data, "application/json", err
+	case FormatCOCORLE:
+		annotation, err := ToCOCORLE(result)
+		if err != nil {
+			return nil, "", err
+		}
+		data, err := json.Marshal(annotation)
+		return data, "application/json", err
+	case FormatSVG:
+		return []byte(ToSVG(result)), "image/svg+xml", nil
+	}
+	return nil, "", fmt.Errorf("unsupported format %s", format)
+}
+
+type point struct {
+	x, y float64
+}
+
+type polygon struct {
+	outer []point
+	holes [][]point
+	area  float64
+}
+
+func toPoints(resultPoints []datastructures.GrabcutMeResultPoint) []point {
+	points := make([]point, len(resultPoints))
+	for i, p := range resultPoints {
+		points[i] = point{x: float64(p.X), y: float64(p.Y)}
+	}
+	return points
+}
+
+//getSignedArea returns the area of the ring, positive if the ring is counterclockwise
+//(with the y axis pointing up)
+func getSignedArea(ring []point) float64 {
+	area := 0.0
+	for i := range ring {
+		j := (i + 1) % len(ring)
+		area += ring[i].x*ring[j].y - ring[j].x*ring[i].y
+	}
+	return area / 2
+}
+
+//getPolygons returns the polygons of the result. Results that only contain the biggest
+//polygon (points) are handled as a single polygon without holes.
+func getPolygons(result datastructures.GrabcutMeResult) []polygon {
+	var polygons []polygon
+	if len(result.Polygons) > 0 {
+		for _, p := range result.Polygons {
+			poly := polygon{outer: toPoints(p.Points), area: p.Area}
+			for _, hole := range p.Holes {
+				poly.holes = append(poly.holes, toPoints(hole))
+			}
+			polygons = append(polygons, poly)
+		}
+	} else if len(result.Points) > 0 {
+		outer := toPoints(result.Points)
+		polygons = append(polygons, polygon{outer: outer, area: math.Abs(getSignedArea(outer))})
+	}
+	return polygons
+}
+
+//getBoundingBox returns the bounding box (x, y, width, height) of the outer rings
+func getBoundingBox(polygons []polygon) [4]float64 {
+	if len(polygons) == 0 {
+		return [4]float64{}
+	}
+
+	minX, minY := math.Inf(1), math.Inf(1)
+	maxX, maxY := math.Inf(-1), math.Inf(-1)
+	for _, poly := range polygons {
+		for _, p := range poly.outer {
+			minX, maxX = math.Min(minX, p.x), math.Max(maxX, p.x)
+			minY, maxY = math.Min(minY, p.y), math.Max(maxY, p.y)
+		}
+	}
+	return [4]float64{minX, minY, maxX - minX, maxY - minY}
+}
+
+//getImageSize returns the size of the image the result belongs to. Results of older
+//workers don't contain the size, in that case the polygons need to fit in.
+func getImageSize(result datastructures.GrabcutMeResult, polygons []polygon) (int, int) {
+	if result.Width > 0 && result.Height > 0 {
+		return result.Width, result.Height
+	}
+
+	bbox := getBoundingBox(polygons)
+	return int(math.Ceil(bbox[0] + bbox[2])), int(math.Ceil(bbox[1] + bbox[3]))
+}
+
+func getTotalArea(polygons []polygon) float64 {
+	area := 0.0
+	for _, poly := range polygons {
+		area += poly.area
+	}
+	return area
+}
@@ -0,0 +1,151 @@
+package exporter
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	datastructures "github.com/bbernhard/imagemonkey-playground/datastructures"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+var update = flag.Bool("update", false, "update the expected outputs in testdata")
+
+var fileExtensions = map[string]string{
+	FormatGeoJSON: ".geojson",
+	FormatCOCO:    ".coco.json",
+	FormatCOCORLE: ".coco-rle.json",
+	FormatSVG:     ".svg",
+}
+
+func loadFixture(t *testing.T, name string) datastructures.GrabcutMeResult {
+	data, err := ioutil.ReadFile(filepath.Join("testdata", name+".json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var result datastructures.GrabcutMeResult
+	err = json.Unmarshal(data, &result)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return result
+}
+
+func TestExport(t *testing.T) {
+	for _, fixture := range []string{"polygons", "points", "empty"} {
+		result := loadFixture(t, fixture)
+
+		for _, format := range Formats {
+			data, _, err := Export(format, result)
+			if err != nil {
+				t.Fatalf("%s: couldn't export %s: %s", fixture, format, err.Error())
+			}
+
+			path := filepath.Join("testdata", fixture+fileExtensions[format])
+			if *update {
+				if err = ioutil.WriteFile(path, data, 0644); err != nil {
+					t.Fatal(err)
+				}
+				continue
+			}
+
+			expected, err := ioutil.ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(data, expected) {
+				t.Errorf("%s: unexpected %s export\nexpected: %s\ngot:      %s", fixture, format, expected, data)
+			}
+		}
+	}
+}
+
+func TestExportUnsupportedFormat(t *testing.T) {
+	if IsSupportedFormat("kml") {
+		t.Errorf("expected kml to be unsupported")
+	}
+	if _, _, err := Export("kml", datastructures.GrabcutMeResult{}); err == nil {
+		t.Errorf("expected error for unsupported format")
+	}
+}
+
+func TestGeoJSONRingOrientation(t *testing.T) {
+	//clockwise square (with the y axis pointing up)
+	square := []point{{0, 0}, {0, 1}, {1, 1}, {1, 0}}
+
+	outer := toGeoJSONRing(square, true)
+	if len(outer) != 5 || outer[0][0] != outer[4][0] || outer[0][1] != outer[4][1] {
+		t.Fatalf("expected closed ring, got %v", outer)
+	}
+
+	var ring []point
+	for _, position := range outer[:4] {
+		ring = append(ring, point{position[0], position[1]})
+	}
+	if getSignedArea(ring) <= 0 {
+		t.Errorf("expected counterclockwise outer ring, got %v", outer)
+	}
+}
+
+//decodeRLE returns the mask (rows of pixels) of the column-major runs
+func decodeRLE(counts []int, width int, height int) [][]bool {
+	mask := make([][]bool, height)
+	for y := range mask {
+		mask[y] = make([]bool, width)
+	}
+
+	pixel := 0
+	for i, count := range counts {
+		for ; count > 0; count-- {
+			if i%2 == 1 {
+				mask[pixel%height][pixel/height] = true
+			}
+			pixel++
+		}
+	}
+	return mask
+}
+
+func TestEncodeRLE(t *testing.T) {
+	result := loadFixture(t, "polygons")
+	counts, area := encodeRLE(getPolygons(result), result.Width, result.Height)
+
+	total := 0
+	for _, count := range counts {
+		total += count
+	}
+	if total != result.Width*result.Height {
+		t.Fatalf("expected runs of %d pixels, got %d: %v", result.Width*result.Height, total, counts)
+	}
+
+	mask := decodeRLE(counts, result.Width, result.Height)
+	pixels := 0
+	for y := range mask {
+		for x := range mask[y] {
+			if mask[y][x] {
+				pixels++
+			}
+		}
+	}
+	//5x5 square with 1x1 hole + 2x2 square
+	if pixels != 28 || area != 28 || mask[3][3] || !mask[1][1] || mask[6][6] {
+		t.Errorf("unexpected mask with %d pixels (area %d): %v", pixels, area, mask)
+	}
+}
+
+func TestCOCORLEOfTooLargeImage(t *testing.T) {
+	result := loadFixture(t, "polygons")
+	result.Width, result.Height = 100000, 100000
+	if _, _, err := Export(FormatCOCORLE, result); err != ErrImageTooLarge {
+		t.Errorf("expected the image to be too large, got %v", err)
+	}
+
+	//the size of results of older workers comes from the polygons
+	result = datastructures.GrabcutMeResult{Points: []datastructures.GrabcutMeResultPoint{{X: 0, Y: 0},
+		{X: 1e6, Y: 0}, {X: 1e6, Y: 1e6}}}
+	if _, _, err := Export(FormatCOCORLE, result); err != ErrImageTooLarge {
+		t.Errorf("expected the polygons to be too large, got %v", err)
+	}
+}
@@ -0,0 +1,68 @@
+package exporter
+
+import (
+	datastructures "github.com/bbernhard/imagemonkey-playground/datastructures"
+)
+
+type GeoJSONGeometry struct {
+	Type        string      `json:"type"`
+	Coordinates interface{} `json:"coordinates"`
+}
+
+type GeoJSONFeature struct {
+	Type       string                 `json:"type"`
+	Geometry   *GeoJSONGeometry       `json:"geometry"`
+	Properties map[string]interface{} `json:"properties"`
+}
+
+//toGeoJSONRing returns the closed ring (first position = last position) with the
+//orientation required by RFC 7946 (outer rings counterclockwise, holes clockwise)
+func toGeoJSONRing(ring []point, counterclockwise bool) [][]float64 {
+	positions := make([][]float64, 0, len(ring)+1)
+	for _, p := range ring {
+		positions = append(positions, []float64{p.x, p.y})
+	}
+
+	if (getSignedArea(ring) > 0) != counterclockwise {
+		for i, j := 0, len(positions)-1; i < j; i, j = i+1, j-1 {
+			positions[i], positions[j] = positions[j], positions[i]
+		}
+	}
+
+	if len(positions) > 0 {
+		positions = append(positions, positions[0])
+	}
+	return positions
+}
+
+//ToGeoJSON returns the result as GeoJSON Feature with a Polygon (or a MultiPolygon if
+//the result contains several polygons) in image coordinates. The geometry is null if
+//the result doesn't contain a polygon.
+func ToGeoJSON(result datastructures.GrabcutMeResult) GeoJSONFeature {
+	polygons := getPolygons(result)
+
+	var coordinates [][][][]float64
+	for _, poly := range polygons {
+		rings := [][][]float64{toGeoJSONRing(poly.outer, true)}
+		for _, hole := range poly.holes {
+			rings = append(rings, toGeoJSONRing(hole, false))
+		}
+		coordinates = append(coordinates, rings)
+	}
+
+	feature := GeoJSONFeature{Type: "Feature", Properties: map[string]interface{}{"area": getTotalArea(polygons)}}
+	if result.Width > 0 && result.Height > 0 {
+		feature.Properties["width"] = result.Width
+		feature.Properties["height"] = result.Height
+	}
+
+	switch len(coordinates) {
+	case 0:
+	case 1:
+		feature.Geometry = &GeoJSONGeometry{Type: "Polygon", Coordinates: coordinates[0]}
+	default:
+		feature.Geometry = &GeoJSONGeometry{Type: "MultiPolygon", Coordinates: coordinates}
+	}
+
+	return feature
+}
@@ -0,0 +1,7 @@
+module github.com/bbernhard/imagemonkey-playground/exporter
+
+go 1.12
+
+require github.com/bbernhard/imagemonkey-playground/datastructures v0.0.0-00010101000000-000000000000
+
+replace github.com/bbernhard/imagemonkey-playground/datastructures => ../datastructures
@@ -0,0 +1,51 @@
+package exporter
+
+import (
+	datastructures "github.com/bbernhard/imagemonkey-playground/datastructures"
+	"strconv"
+	"strings"
+)
+
+func formatSVGNumber(n float64) string {
+	return strconv.FormatFloat(n, 'f', -1, 32)
+}
+
+func writeSVGRing(b *strings.Builder, ring []point) {
+	for i, p := range ring {
+		if i == 0 {
+			b.WriteString("M")
+		} else {
+			b.WriteString(" L")
+		}
+		b.WriteString(formatSVGNumber(p.x) + " " + formatSVGNumber(p.y))
+	}
+	if len(ring) > 0 {
+		b.WriteString(" Z")
+	}
+}
+
+//ToSVG returns the result as SVG document of the size of the image, which contains a
+//single path (holes are cut out with the evenodd fill rule).
+func ToSVG(result datastructures.GrabcutMeResult) string {
+	polygons := getPolygons(result)
+	width, height := getImageSize(result, polygons)
+
+	var path strings.Builder
+	for _, poly := range polygons {
+		for _, ring := range append([][]point{poly.outer}, poly.holes...) {
+			if path.Len() > 0 {
+				path.WriteString(" ")
+			}
+			writeSVGRing(&path, ring)
+		}
+	}
+
+	var b strings.Builder
+	b.WriteString(`<svg xmlns="http://www.w3.org/2000/svg" width="` + strconv.Itoa(width) + `" height="` +
+		strconv.Itoa(height) + `" viewBox="0 0 ` + strconv.Itoa(width) + ` ` + strconv.Itoa(height) + `">`)
+	if path.Len() > 0 {
+		b.WriteString(`<path d="` + path.String() + `" fill-rule="evenodd"/>`)
+	}
+	b.WriteString("</svg>\n")
+	return b.String()
+}
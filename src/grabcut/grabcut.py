@@ -8,10 +8,210 @@ from sentry_sdk import init, capture_exception, capture_message
 import argparse
 import sys
 import os
+import socket
+import threading
+
+#job state keys outlive the results, see src/commons/jobstate.go
+JOB_STATE_EXPIRATION = 86400
+
+#see src/commons/heartbeat.go
+HEARTBEAT_INTERVAL = 10
+HEARTBEAT_RETENTION = 3600
+
+#reliable queue, see src/commons/queue.go
+QUEUE = "grabcutme"
+QUEUE_PROCESSING = QUEUE + "processing"
+QUEUE_LEASES = QUEUE + "leases"
+QUEUE_DELIVERIES = QUEUE + "deliveries"
+
+#jobs whose webhook needs to be delivered, see src/commons/jobstate.go
+WEBHOOK_QUEUE = "webhooks"
+FINAL_JOB_STATES = ("done", "failed")
+
+#seconds the result of a job is kept
+RESULT_EXPIRATION = 600
 
 class GrabcutError(Exception):
     pass
 
+#same script as updateJobStateScript in src/commons/jobstate.go, keep both in sync
+#KEYS: job state, webhook queue
+#ARGV: uuid, state, updated, error (empty = unchanged), expiration
+UPDATE_JOB_STATE_SCRIPT = """
+local previous = redis.call('HGET', KEYS[1], 'state')
+--a finished job stays finished (e.g. when it was delivered twice), only its result can expire
+if (previous == 'done' or previous == 'failed' or previous == 'expired') and ARGV[2] ~= 'expired' then
+	return 0
+end
+
+redis.call('HMSET', KEYS[1], 'state', ARGV[2], 'updated', ARGV[3])
+if ARGV[4] ~= '' then
+	redis.call('HSET', KEYS[1], 'error', ARGV[4])
+end
+redis.call('EXPIRE', KEYS[1], ARGV[5])
+
+local final = {done = true, failed = true}
+if final[ARGV[2]] and not final[previous] then
+	local callback_url = redis.call('HGET', KEYS[1], 'callback_url')
+	if callback_url and callback_url ~= '' then
+		redis.call('ZADD', KEYS[2], ARGV[3], ARGV[1])
+	end
+end
+return 1
+"""
+
+#same script as extendScript in src/commons/queue.go
+#KEYS: leases
+#ARGV: item, deadline
+EXTEND_LEASE_SCRIPT = """
+if redis.call('ZSCORE', KEYS[1], ARGV[1]) then
+	redis.call('ZADD', KEYS[1], ARGV[2], ARGV[1])
+	return 1
+end
+return 0
+"""
+
+def update_job_state(r, uuid, state, err=None):
+    key = "jobstate" + uuid
+    notification = {"uuid": uuid, "state": state, "updated": int(time.time())}
+    if err is not None:
+        notification["error"] = err
+
+    stored = r.eval(UPDATE_JOB_STATE_SCRIPT, 2, key, WEBHOOK_QUEUE, uuid, state, notification["updated"],
+                    err or "", JOB_STATE_EXPIRATION)
+    #published after the state is stored, so that subscribers which read the state see the change
+    if stored == 1:
+        r.publish(key, json.dumps(notification))
+
+def get_job_state(r, uuid):
+    state = r.hget("jobstate" + uuid, "state")
+    if state is None:
+        return None
+    return state.decode("utf-8")
+
+def send_heartbeat(r, worker_id):
+    now = int(time.time())
+    pipe = r.pipeline()
+    pipe.zadd("grabcutheartbeats", {worker_id: now})
+    pipe.zremrangebyscore("grabcutheartbeats", "-inf", now - HEARTBEAT_RETENTION)
+    pipe.execute()
+
+class CurrentJob(object):
+    #the job that is processed at the moment, whose lease is renewed by the heartbeat thread
+    def __init__(self):
+        self._lock = threading.Lock()
+        self._item = None
+
+    def set(self, item):
+        with self._lock:
+            self._item = item
+
+    def get(self):
+        with self._lock:
+            return self._item
+
+def start_heartbeat(r, worker_id, current_job, visibility_timeout):
+    #the heartbeats are sent from a background thread, so that they keep coming while a job is processed.
+    #The lease of the job is renewed well before it expires.
+    interval = min(HEARTBEAT_INTERVAL, max(visibility_timeout // 3, 1))
+    def run():
+        while True:
+            try:
+                send_heartbeat(r, worker_id)
+                item = current_job.get()
+                if item is not None:
+                    extend_lease(r, item, visibility_timeout)
+            except Exception:
+                capture_exception()
+            time.sleep(interval)
+
+    thread = threading.Thread(target=run)
+    thread.daemon = True
+    thread.start()
+
+def take_job(r, visibility_timeout):
+    #the job stays in the processing list until it's acknowledged. If we die before,
+    #the api puts it back into the queue once the lease expired.
+    item = r.brpoplpush(QUEUE, QUEUE_PROCESSING, timeout=HEARTBEAT_INTERVAL)
+    if item is not None:
+        r.zadd(QUEUE_LEASES, {item: int(time.time()) + visibility_timeout})
+    return item
+
+def extend_lease(r, item, visibility_timeout):
+    #returns False if the lease is gone, i.e. the job was already acknowledged or handed to another worker
+    return r.eval(EXTEND_LEASE_SCRIPT, 1, QUEUE_LEASES, item, int(time.time()) + visibility_timeout) == 1
+
+def ack_job(r, item):
+    pipe = r.pipeline()
+    pipe.lrem(QUEUE_PROCESSING, 1, item)
+    pipe.zrem(QUEUE_LEASES, item)
+    pipe.hdel(QUEUE_DELIVERIES, item)
+    pipe.execute()
+
+def process_job(r, item, visibility_timeout):
+    try:
+        json_obj = json.loads(item)
+    except ValueError:
+        #would fail again on every delivery
+        capture_exception()
+        ack_job(r, item)
+        return
+
+    #a job can be delivered more than once, e.g. if we were too slow to acknowledge it
+    if get_job_state(r, json_obj["uuid"]) in FINAL_JOB_STATES:
+        ack_job(r, item)
+        return
+
+    key = "grabcut" + json_obj["uuid"]
+    err = None
+    update_job_state(r, json_obj["uuid"], "processing")
+    
+    try:
+        img_bytes = base64.b64decode(json_obj["mask"])
+        arr = np.fromstring(img_bytes, np.uint8)
+        mask = cv.imdecode(arr, 0) 
+    except Exception as e:
+        capture_exception()
+        err = "Couldn't decode image mask"
+
+    if err is None:
+        try:
+            polygons, (width, height) = get_contours(json_obj["filename"], mask)
+        except Exception as e:
+            capture_exception()
+            err = "Couldn't process request"
+
+    res = {}
+    res["error"] = ""
+    #the simplification and filtering of the polygons happens in the api, when the result is fetched
+    for option in ["simplification", "polygon_options"]:
+        if json_obj.get(option) is not None:
+            res[option] = json_obj[option]
+    if err is not None:
+        res["error"] = err
+
+    res["points"] = []
+    res["polygons"] = []
+    if err is None and len(polygons) > 0:
+        #'points' only contains the biggest polygon (for api instances that don't know 'polygons')
+        res["points"] = polygons[0]["points"]
+        res["polygons"] = polygons
+    if err is None:
+        res["width"] = width
+        res["height"] = height
+    #if we were too slow (e.g. the heartbeat thread couldn't reach redis), the job was handed
+    #to another worker - which writes the result instead
+    if not extend_lease(r, item, visibility_timeout):
+        capture_message("Lease of grabcut job %s expired, skipping its result" %json_obj["uuid"])
+        return
+
+    r.setex(name=key, value=json.dumps(res), time=RESULT_EXPIRATION)
+    if err is None:
+        update_job_state(r, json_obj["uuid"], "done")
+    else:
+        update_job_state(r, json_obj["uuid"], "failed", err)
+    ack_job(r, item)
+
 def get_contours(filename, grabcut_mask):
     bgd_model = np.zeros((1,65),np.float64)
     fgd_model = np.zeros((1,65),np.float64)
@@ -47,31 +247,31 @@ def get_contours(filename, grabcut_mask):
     cv.grabCut(img, mask, None, bgd_model, fgd_model, 5, cv.GC_INIT_WITH_MASK)
     mask2 = np.where((mask==1) + (mask==3),255,0).astype('uint8')
 
-    contours, _ = cv.findContours(mask2, cv.RETR_EXTERNAL, cv.CHAIN_APPROX_SIMPLE)
+    #RETR_CCOMP organizes the contours in two levels: the outer borders of the
+    #objects and the borders of their holes
+    contours, hierarchy = cv.findContours(mask2, cv.RETR_CCOMP, cv.CHAIN_APPROX_SIMPLE)
 
-    #find the biggest area
-    """cnt = contours[0]
-    max_area = cv.contourArea(cnt)
+    def scale(contour):
+        return [[float(p[0][0]) * scale_x, float(p[0][1]) * scale_y] for p in contour]
 
-    for cont in contours:
-        if cv.contourArea(cont) > max_area:
-            cnt = cont
-            max_area = cv.contourArea(cont)
+    polygons = []
+    for i, contour in enumerate(contours):
+        if hierarchy[0][i][3] != -1:
+            continue #hole, added to its parent below
 
-    epsilon = 0.009*cv.arcLength(cnt,True)
-    approx = cv.approxPolyDP(cnt,epsilon,True)
+        holes = []
+        area = cv.contourArea(contour)
+        child = hierarchy[0][i][2]
+        while child != -1:
+            holes.append(scale(contours[child]))
+            area -= cv.contourArea(contours[child])
+            child = hierarchy[0][child][0]
 
-    contours = cv.convexHull(cnt)"""
-
-    if len(contours) == 0:
-        contours = np.empty([0, 0])
-    else:
-        contours = np.vstack(contours).squeeze()
-        for elem in contours:
-            elem[0] = elem[0] * float(scale_x)
-            elem[1] = elem[1] * float(scale_y)
+        polygons.append({"points": scale(contour), "holes": holes, "area": area * scale_x * scale_y})
 
-    return contours
+    #biggest polygon first
+    polygons.sort(key=lambda polygon: polygon["area"], reverse=True)
+    return polygons, (old_img_size[1], old_img_size[0])
 
 
 def is_maintenance(file_path):
@@ -87,6 +287,7 @@ if __name__ == "__main__":
     parser.add_argument('--use_sentry', help='use sentry to log errors', type=str, required=False, default="false")
     parser.add_argument('--maintenance_file', help='path to the maintenance file', required=False, default=None)
     parser.add_argument('--redis_port', help='Redis port', type=int, required=False, default=6379)
+    parser.add_argument('--visibility_timeout', help='Seconds a job may take, before it is handed to another worker', type=int, required=False, default=300)
 
     args = parser.parse_args()
 
@@ -111,38 +312,20 @@ if __name__ == "__main__":
         pool = redis.ConnectionPool(host='localhost', port=str(args.redis_port), db=0)
         r = redis.Redis(connection_pool=pool)
 
-        expire_in_secs = 600
+        worker_id = "%s:%d" %(socket.gethostname(), os.getpid())
+        current_job = CurrentJob()
+        start_heartbeat(r, worker_id, current_job, args.visibility_timeout)
+
         while True:
-            obj = r.blpop("grabcutme")
-            json_obj = json.loads(obj[1])
-            key = "grabcut" + json_obj["uuid"]
-            err = None
-            
+            item = take_job(r, args.visibility_timeout)
+            if item is None:
+                continue
+
+            current_job.set(item)
             try:
-                img_bytes = base64.b64decode(json_obj["mask"])
-                arr = np.fromstring(img_bytes, np.uint8)
-                mask = cv.imdecode(arr, 0) 
-            except Exception as e:
-                capture_exception()
-                err = "Couldn't decode image mask"
-
-            if err is None:
-                try:
-                    cont = get_contours(json_obj["filename"], mask)
-                except Exception as e:
-                    capture_exception()
-                    err = "Couldn't process request"
-
-            res = {}
-            res["error"] = ""
-            if err is not None:
-                res["error"] = err
-
-            if err is None:
-                res["points"] = cont.tolist()
-            else:
-                res["points"] = np.empty([0, 0]).tolist()
-            r.setex(name=key, value=json.dumps(res), time=expire_in_secs)
+                process_job(r, item, args.visibility_timeout)
+            finally:
+                current_job.set(None)
     else:
         print("Starting ImageMonkey Grabcut (Maintenance Mode)")
         while True:
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"errors"
+	commons "github.com/bbernhard/imagemonkey-playground/commons"
+	"strings"
+)
+
+//Config contains the configuration of the predict worker. Every value can be set in the
+//config file, with a PLAYGROUND_* environment variable or with a flag (see commons.LoadConfig).
+type Config struct {
+	RedisAddress        string `config:"redis_address" help:"Address to the Redis server"`
+	RedisMaxConnections int    `config:"redis_max_connections" help:"Max connections to Redis"`
+	MaxWorkerQueueSize  int    `config:"max_worker_queue_size" help:"The size of job queue"`
+	MaxWorkers          int    `config:"max_workers" help:"The number of workers to start"`
+	MaxWorkersNSFW      int    `config:"max_workers_nsfw" help:"The number of workers that operate on the NSFW model"`
+	UseSentry           bool   `config:"use_sentry" help:"Use Sentry for error logging (needs sentry_dsn)"`
+	SentryDsn           string `config:"sentry_dsn" env:"SENTRY_DSN" secret:"true" help:"Sentry DSN"`
+	ModelsDir           string `config:"models_dir" help:"Models Directory"`
+	NSFWModelsDir       string `config:"nsfw_models_dir" help:"NSFW Models Directory"`
+	ShutdownTimeout     int    `config:"shutdown_timeout" help:"Max number of seconds to wait for running jobs on shutdown"`
+	MetricsAddress      string `config:"metrics_address" help:"Address to serve the Prometheus metrics on (empty = disabled)"`
+	VisibilityTimeout   int    `config:"visibility_timeout" help:"Seconds after which the job of a worker that stopped renewing its lease (e.g. because it died) is handed to another worker"`
+	PopTimeout          int    `config:"pop_timeout" help:"Max number of seconds to wait for a new job (also the max delay until a shutdown request is noticed)"`
+	commons.StorageConfig
+}
+
+func defaultConfig() Config {
+	return Config{
+		RedisAddress:        ":6379",
+		RedisMaxConnections: 10,
+		MaxWorkerQueueSize:  100,
+		MaxWorkers:          5,
+		MaxWorkersNSFW:      3,
+		ModelsDir:           "/home/playground/training/models/",
+		NSFWModelsDir:       "/home/playground/training/models/nsfw/",
+		ShutdownTimeout:     120,
+		MetricsAddress:      ":9102",
+		VisibilityTimeout:   300,
+		PopTimeout:          5,
+		StorageConfig: commons.StorageConfig{
+			Storage:        commons.StorageTypeLocal,
+			PredictionsDir: "/tmp/predictions/",
+		},
+	}
+}
+
+//Validate returns an error that lists all invalid values
+func (c *Config) Validate() error {
+	var problems []string
+	check := func(ok bool, problem string) {
+		if !ok {
+			problems = append(problems, problem)
+		}
+	}
+
+	check(c.RedisAddress != "", "redis_address is required")
+	check(c.RedisMaxConnections >= 1, "redis_max_connections needs to be at least 1")
+	check(c.MaxWorkerQueueSize >= 1, "max_worker_queue_size needs to be at least 1")
+	check(c.MaxWorkers >= 1, "max_workers needs to be at least 1")
+	check(c.MaxWorkersNSFW >= 1, "max_workers_nsfw needs to be at least 1")
+	check(!c.UseSentry || c.SentryDsn != "", "sentry_dsn is required when use_sentry is set")
+	check(c.ModelsDir != "", "models_dir is required")
+	check(c.NSFWModelsDir != "", "nsfw_models_dir is required")
+	check(c.ShutdownTimeout >= 0, "shutdown_timeout can't be negative")
+	check(c.VisibilityTimeout >= 1, "visibility_timeout needs to be at least 1")
+	check(c.PopTimeout >= 1, "pop_timeout needs to be at least 1")
+	problems = append(problems, c.StorageConfig.Validate()...)
+
+	if len(problems) > 0 {
+		return errors.New(strings.Join(problems, "; "))
+	}
+	return nil
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"github.com/garyburd/redigo/redis"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	log "github.com/sirupsen/logrus"
+	"net/http"
+	"time"
+)
+
+//stages of a prediction, see Predict
+const (
+	PredictionStageDecode = "decode"
+	PredictionStageResize = "resize"
+	PredictionStageTensor = "tensor"
+	PredictionStageRun    = "session_run"
+)
+
+var (
+	jobsProcessedTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "playground_predict_jobs_processed_total",
+		Help: "Number of processed prediction jobs",
+	}, []string{"model", "state"})
+
+	predictionFailuresTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "playground_predict_failures_total",
+		Help: "Number of failed predictions",
+	}, []string{"model", "code"})
+
+	predictionStageDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "playground_predict_stage_duration_seconds",
+		Help:    "Time it took to run a stage of a prediction",
+		Buckets: []float64{.001, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10},
+	}, []string{"model", "stage"})
+
+	busyWorkers = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "playground_predict_busy_workers",
+		Help: "Number of workers that are currently processing a job",
+	}, []string{"model"})
+
+	workers = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "playground_predict_workers",
+		Help: "Number of started workers",
+	}, []string{"model"})
+
+	pendingJobs = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "playground_predict_pending_jobs",
+		Help: "Number of jobs that were taken from the queue, but aren't processed yet",
+	}, []string{"model"})
+
+	jobsReleasedTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "playground_predict_jobs_released_total",
+		Help: "Number of jobs that were put back into the Redis queue, because all workers were busy",
+	}, []string{"model"})
+)
+
+func init() {
+	prometheus.MustRegister(jobsProcessedTotal, predictionFailuresTotal, predictionStageDuration,
+		busyWorkers, workers, pendingJobs, jobsReleasedTotal)
+}
+
+func observePredictionStage(model string, stage string, start time.Time) {
+	predictionStageDuration.WithLabelValues(model, stage).Observe(time.Since(start).Seconds())
+}
+
+//registerQueueDepth reports the length of the Redis queue whenever the metrics are scraped
+func registerQueueDepth(redisPool *redis.Pool, queue string) {
+	prometheus.MustRegister(prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Name:        "playground_predict_queue_depth",
+		Help:        "Number of jobs in the Redis queue",
+		ConstLabels: prometheus.Labels{"queue": queue},
+	}, func() float64 {
+		redisConn := redisPool.Get()
+		defer redisConn.Close()
+
+		length, err := redis.Int(redisConn.Do("LLEN", queue))
+		if err != nil {
+			log.Error("[Metrics] Couldn't get queue length: ", err.Error())
+			return 0
+		}
+		return float64(length)
+	}))
+}
+
+//serveMetrics exposes the metrics at http://<address>/metrics
+func serveMetrics(address string) {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+
+	log.Info("[Metrics] Serving metrics on ", address)
+	err := http.ListenAndServe(address, mux)
+	if err != nil {
+		log.Error("[Metrics] Couldn't serve metrics: ", err.Error())
+	}
+}
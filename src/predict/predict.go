@@ -3,8 +3,10 @@ package main
 import (
 	"bufio"
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
+	commons "github.com/bbernhard/imagemonkey-playground/commons"
 	datastructures "github.com/bbernhard/imagemonkey-playground/datastructures"
 	"github.com/disintegration/imaging"
 	"github.com/garyburd/redigo/redis"
@@ -15,45 +17,81 @@ import (
 	_ "image/gif"
 	_ "image/jpeg"
 	_ "image/png"
+	"io"
 	"io/ioutil"
-	"mime/multipart"
 	"os"
+	"os/signal"
+	"sort"
+	"sync"
+	"syscall"
 	"time"
 )
 
-func GetEnv(name string) string {
-	val, found := os.LookupEnv(name)
-	if found {
-		return val
-	}
+type Predictor interface {
+	Load(basePath string) error
+	Predict(image io.Reader, topK int) ([]datastructures.TFResult, error)
+	Close()
+}
+
+//error codes that are reported back to the client in case a prediction fails
+const (
+	PredictionErrorModelNotLoaded   = "model_not_loaded"
+	PredictionErrorImageUnavailable = "image_unavailable"
+	PredictionErrorInvalidImage     = "invalid_image"
+	PredictionErrorInference        = "inference_failed"
+	PredictionErrorInternal         = "internal_error"
+)
 
-	return ""
+//human readable messages of the error codes, reported together with the code
+var predictionErrorMessages = map[string]string{
+	PredictionErrorModelNotLoaded:   "The model isn't loaded - please try again later",
+	PredictionErrorImageUnavailable: "The image is no longer available - please upload it again",
+	PredictionErrorInvalidImage:     "The image couldn't be decoded",
+	PredictionErrorInference:        "The model couldn't classify the image",
+	PredictionErrorInternal:         "Couldn't process request",
 }
 
-func MustGetEnv(name string) string {
-	val := GetEnv(name)
-	if val == "" {
-		log.Fatal("Couldn't get env ", name)
-	}
+//PredictionError is returned by Predict and carries an error code which
+//tells the client why the prediction failed.
+type PredictionError struct {
+	Code string
+	Err  error
+}
 
-	return val
+func (e *PredictionError) Error() string {
+	return e.Code + ": " + e.Err.Error()
 }
 
-type Predictor interface {
-	Load(modelPath string, labelPath string) error
-	Predict(file multipart.File) (datastructures.TFResult, error)
-	Close()
+//getPredictionErrorCode returns the error code of err, or PredictionErrorInternal
+//if err wasn't returned by Predict.
+func getPredictionErrorCode(err error) string {
+	if predictionError, ok := err.(*PredictionError); ok {
+		return predictionError.Code
+	}
+	return PredictionErrorInternal
 }
 
+//getPredictionErrorMessage returns the human readable message of the error code
+func getPredictionErrorMessage(code string) string {
+	if message, found := predictionErrorMessages[code]; found {
+		return message
+	}
+	return predictionErrorMessages[PredictionErrorInternal]
+}
+
+var _ Predictor = (*TensorflowPredictor)(nil)
+
 type TensorflowPredictor struct {
+	model     string
 	labels    []string
 	graph     *tf.Graph
 	session   *tf.Session
 	modelInfo datastructures.ModelInfo
 }
 
-func NewTensorflowPredictor() *TensorflowPredictor {
-	return &TensorflowPredictor{}
+//NewTensorflowPredictor creates a predictor, model is the name the predictor reports its metrics under
+func NewTensorflowPredictor(model string) *TensorflowPredictor {
+	return &TensorflowPredictor{model: model}
 }
 
 func (p *TensorflowPredictor) Load(basePath string) error {
@@ -110,19 +148,24 @@ func (p *TensorflowPredictor) Load(basePath string) error {
 	return nil
 }
 
-func (p *TensorflowPredictor) Predict(file string) (datastructures.TFResult, error) {
-	var res datastructures.TFResult
-	res.Label = ""
-	res.Score = 0
+//Predict returns the topK most probable labels for the given image, sorted
+//by score (highest first). At least one label is always returned.
+func (p *TensorflowPredictor) Predict(image io.Reader, topK int) ([]datastructures.TFResult, error) {
+	var res []datastructures.TFResult
+	if p.session == nil {
+		return res, &PredictionError{Code: PredictionErrorModelNotLoaded, Err: errors.New("model not loaded")}
+	}
+
 	// For multiple images, session.Run() can be called in a loop (and
 	// concurrently). Furthermore, images can be batched together since the
 	// model accepts batches of image data as input.
-	tensor, err := makeTensorFromImage(file)
+	tensor, err := makeTensorFromImage(image, p.model)
 	if err != nil {
 		log.Error("[Predicting Image Label] Couldn't create tensor from image: ", err.Error())
 		raven.CaptureError(err, nil)
-		return res, err
+		return res, &PredictionError{Code: PredictionErrorInvalidImage, Err: err}
 	}
+	start := time.Now()
 	output, err := p.session.Run(
 		map[tf.Output]*tf.Tensor{
 			//graph.Operation("input").Output(0): tensor,
@@ -133,22 +176,25 @@ func (p *TensorflowPredictor) Predict(file string) (datastructures.TFResult, err
 			p.graph.Operation("final_result").Output(0),
 		},
 		nil)
+	observePredictionStage(p.model, PredictionStageRun, start)
 	if err != nil {
 		log.Error("[Predicting Image Label] Couldn't run image prediction: ", err.Error())
 		raven.CaptureError(err, nil)
-		return res, err
+		return res, &PredictionError{Code: PredictionErrorInference, Err: err}
 	}
 
 	// output[0].Value() is a vector containing probabilities of
 	// labels for each image in the "batch". The batch size was 1.
-	// Find the most probably label index.
+	// Find the most probable label indices.
 	probabilities := output[0].Value().([][]float32)[0]
-	res = getBestLabel(probabilities, p.labels)
+	res = getTopLabels(probabilities, p.labels, topK)
 	return res, nil
 }
 
 func (p *TensorflowPredictor) Close() {
-	p.session.Close()
+	if p.session != nil {
+		p.session.Close()
+	}
 }
 
 func loadLabels(path string) ([]string, error) {
@@ -173,24 +219,37 @@ func loadLabels(path string) ([]string, error) {
 	return labels, nil
 }
 
-func getBestLabel(probabilities []float32, labels []string) datastructures.TFResult {
-	var result datastructures.TFResult
-	bestIdx := 0
-	for i, p := range probabilities {
-		if p > probabilities[bestIdx] {
-			bestIdx = i
-		}
+//getTopLabels returns the k labels with the highest probability, sorted by
+//score (highest first). k is clamped to [1, len(probabilities)].
+func getTopLabels(probabilities []float32, labels []string, k int) []datastructures.TFResult {
+	indices := make([]int, len(probabilities))
+	for i := range indices {
+		indices[i] = i
 	}
+	sort.SliceStable(indices, func(i, j int) bool {
+		return probabilities[indices[i]] > probabilities[indices[j]]
+	})
 
-	result.Score = (probabilities[bestIdx] * 100.0)
-	result.Label = labels[bestIdx]
+	if k < 1 {
+		k = 1
+	}
+	if k > len(indices) {
+		k = len(indices)
+	}
 
-	return result
+	results := make([]datastructures.TFResult, k)
+	for i := 0; i < k; i++ {
+		results[i].Score = (probabilities[indices[i]] * 100.0)
+		results[i].Label = labels[indices[i]]
+	}
+
+	return results
 }
 
 // Given an image, returns a Tensor which is suitable for
-// providing the image data to the pre-defined model.
-func makeTensorFromImage(file string) (*tf.Tensor, error) {
+// providing the image data to the pre-defined model. The duration of every
+// step is reported under the given model name.
+func makeTensorFromImage(r io.Reader, model string) (*tf.Tensor, error) {
 	const (
 		// Some constants specific to the pre-trained model.
 		// - The model was trained with images scaled to 299x299 pixels.
@@ -204,16 +263,12 @@ func makeTensorFromImage(file string) (*tf.Tensor, error) {
 		Std  = 128
 	)
 
-	f, err := os.Open(file)
-	if err != nil {
-		return nil, err
-	}
-	defer f.Close()
-
-	img, _, err := image.Decode(f)
+	start := time.Now()
+	img, _, err := image.Decode(r)
 	if err != nil {
 		return nil, err
 	}
+	observePredictionStage(model, PredictionStageDecode, start)
 
 	//resize image to 299x299 (= size the model was trained on)
 	//the image resize library in use might be slow when larger images are used
@@ -221,7 +276,9 @@ func makeTensorFromImage(file string) (*tf.Tensor, error) {
 	//Consider using a different image resizing library (but in that case we probably
 	//need to write the image first to disk and read the resized image afterwards.
 	//Is that faster?)
+	start = time.Now()
 	img = imaging.Resize(img, W, H, imaging.Box)
+	observePredictionStage(model, PredictionStageResize, start)
 
 	sz := img.Bounds().Size()
 	if sz.X != W || sz.Y != H {
@@ -235,6 +292,8 @@ func makeTensorFromImage(file string) (*tf.Tensor, error) {
 	// - 3rd dimension: Columns of the row
 	// - 4th dimension: Colors of the pixel as (B, G, R)
 	// Thus, the shape is [1, 299, 299, 3]
+	start = time.Now()
+	defer observePredictionStage(model, PredictionStageTensor, start)
 	var ret [1][H][W][3]float32
 	for y := 0; y < H; y++ {
 		for x := 0; x < W; x++ {
@@ -250,63 +309,162 @@ func makeTensorFromImage(file string) (*tf.Tensor, error) {
 }
 
 var redisPool *redis.Pool
+var imageStorage commons.Storage
+var leases *leaseKeeper
 
 func main() {
 	log.SetLevel(log.DebugLevel)
 
-	redisAddress := flag.String("redis-address", ":6379", "Address to the Redis server")
-	redisMaxConnections := flag.Int("redis-max-connections", 10, "Max connections to Redis")
-	maxWorkerQueueSize := flag.Int("max-worker-queue-size", 100, "The size of job queue")
-	maxWorkers := flag.Int("max-workers", 5, "The number of workers to start")
-	maxWorkersNSFW := flag.Int("max-workers-nsfw", 3, "The number of workers that operate on the NSFW model")
-	useSentry := flag.Bool("use_sentry", false, "Use Sentry for error logging")
-	modelsDir := flag.String("models-dir", "/home/playground/training/models/", "Models Directory")
-	nsfwModelsDir := flag.String("nsfw-models-dir", "/home/playground/training/models/nsfw/", "NSFW Models Directory")
+	config := defaultConfig()
+
+	printConfig := flag.Bool("print_config", false, "Print the effective configuration (secrets redacted) and exit")
 
-	flag.Parse()
+	err := commons.LoadConfig(&config, flag.CommandLine, os.Args[1:])
+	if err != nil {
+		log.Fatal("Invalid configuration: ", err.Error())
+	}
 
-	log.Info("Starting Playground Worker (Redis address: ", *redisAddress, ")")
+	if *printConfig {
+		err = commons.PrintConfig(os.Stdout, &config)
+		if err != nil {
+			log.Fatal("Couldn't print configuration: ", err.Error())
+		}
+		return
+	}
+
+	log.Info("Starting Playground Worker (Redis address: ", config.RedisAddress, ")")
 	log.Debug("Starting ThreadPool")
 
-	if *useSentry {
-		sentryDsn := MustGetEnv("SENTRY_DSN")
+	if config.UseSentry {
 		raven.SetEnvironment("predict")
-		raven.SetDSN(sentryDsn)
+		raven.SetDSN(config.SentryDsn)
 
 		raven.CaptureMessage("Starting up playground-predict worker", nil)
 	}
 
 	redisPool = redis.NewPool(func() (redis.Conn, error) {
-		c, err := redis.Dial("tcp", *redisAddress)
+		c, err := redis.Dial("tcp", config.RedisAddress)
 
 		if err != nil {
 			return nil, err
 		}
 
 		return c, err
-	}, *redisMaxConnections)
+	}, config.RedisMaxConnections)
 	defer redisPool.Close()
 
+	imageStorage, err = commons.NewStorage(config.StorageConfig)
+	if err != nil {
+		log.Fatal("Couldn't create storage: ", err.Error())
+	}
+
+	if config.MetricsAddress != "" {
+		registerQueueDepth(redisPool, commons.PredictionQueue.Name)
+		registerQueueDepth(redisPool, commons.NSFWPredictionQueue.Name)
+		go serveMetrics(config.MetricsAddress)
+	}
+
 	log.Debug("Starting Dispatcher")
 
-	jobQueue := make(chan Job, *maxWorkerQueueSize)
-	dispatcher := NewDispatcher(jobQueue, *maxWorkers, *modelsDir)
-	dispatcher.run()
+	jobQueue := make(chan Job, config.MaxWorkerQueueSize)
+	dispatcher := NewDispatcher(jobQueue, config.MaxWorkers, config.ModelsDir, "classification")
+	err = dispatcher.run()
+	if err != nil {
+		log.Fatal("Couldn't load classification model: ", err.Error())
+	}
 
 	//NSFW job queue
-	nsfwJobQueue := make(chan Job, *maxWorkerQueueSize)
-	nsfwDispatcher := NewDispatcher(nsfwJobQueue, *maxWorkersNSFW, *nsfwModelsDir)
-	nsfwDispatcher.run()
+	nsfwJobQueue := make(chan Job, config.MaxWorkerQueueSize)
+	nsfwDispatcher := NewDispatcher(nsfwJobQueue, config.MaxWorkersNSFW, config.NSFWModelsDir, "nsfw-classification")
+	err = nsfwDispatcher.run()
+	if err != nil {
+		log.Fatal("Couldn't load nsfw classification model: ", err.Error())
+	}
+
+	//only now we are ready to process jobs (the api reports readiness based on the heartbeats)
+	stopHeartbeat := commons.StartHeartbeat(redisPool, commons.JobTypePrediction, commons.GetWorkerId())
+	defer stopHeartbeat()
+
+	//on SIGTERM we stop taking jobs from the queue and finish the ones we already took
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT)
+
+	popTimeout := time.Duration(config.PopTimeout) * time.Second
+	visibilityTimeout := time.Duration(config.VisibilityTimeout) * time.Second
 
+	leases = newLeaseKeeper(visibilityTimeout)
+	go leases.run()
+
+	dispatchers := map[string]*Dispatcher{dispatcher.model: dispatcher, nsfwDispatcher.model: nsfwDispatcher}
+
+	//every model has its own queue and intake, so that a model whose workers are all busy
+	//doesn't hold up the jobs of the other one
+	stop := make(chan struct{})
+	var intake sync.WaitGroup
+	for _, d := range dispatchers {
+		intake.Add(1)
+		go func(d *Dispatcher) {
+			defer intake.Done()
+			takeJobs(commons.GetPredictionQueue(d.model), d, dispatchers, popTimeout, visibilityTimeout, stop)
+		}(d)
+	}
+
+	sig := <-signals
+	log.Info("Received ", sig, " - stopping intake")
+	close(stop)
+	intake.Wait()
+
+	stopped := make(chan struct{})
+	go func() {
+		dispatcher.stop()
+		nsfwDispatcher.stop()
+		close(stopped)
+	}()
+
+	select {
+	case <-stopped:
+		log.Info("All jobs processed - shutting down")
+	case <-time.After(time.Duration(config.ShutdownTimeout) * time.Second):
+		log.Error("Couldn't process all jobs within ", config.ShutdownTimeout, " seconds - shutting down anyway")
+	}
+}
+
+//takeJobs takes the jobs of the dispatcher's model from the queue until stop is closed. A job
+//is only taken once the dispatcher has room for it, so that it doesn't wait in our hands while
+//other instances could process it.
+func takeJobs(queue commons.ReliableQueue, d *Dispatcher, dispatchers map[string]*Dispatcher,
+	popTimeout time.Duration, visibilityTimeout time.Duration, stop <-chan struct{}) {
 	for {
-		var data []byte
+		select {
+		case <-stop:
+			return
+		default:
+		}
+
+		for d.full() {
+			if !sleep(100*time.Millisecond, stop) {
+				return
+			}
+		}
 
 		redisConn := redisPool.Get()
 
-		data, err := redis.Bytes(redisConn.Do("LPOP", "predictme"))
+		//the job stays in the queue's processing list until a worker acknowledges it. If we
+		//die before (and stop renewing its lease), it's handed to another worker once the
+		//visibility timeout expired.
+		data, err := queue.BlockingPop(redisConn, popTimeout, visibilityTimeout)
 		if err != nil {
+			log.Error("Couldn't take job from queue ", queue.Name, ": ", err.Error())
+			redisConn.Close()
+
+			//don't hammer redis in case it's unavailable
+			if !sleep(time.Second, stop) {
+				return
+			}
+			continue
+		}
+		if data == nil { //nothing in queue within the pop timeout
 			redisConn.Close()
-			time.Sleep(time.Second) //nothing in queue, sleep for one sec
 			continue
 		}
 
@@ -317,20 +475,57 @@ func main() {
 		if err != nil {
 			log.Error("Couldn't unmarshal: ", err.Error())
 			raven.CaptureError(err, nil)
+			ackJob(redisConn, Job{Item: data, Queue: queue}) //would fail again on every delivery
 			redisConn.Close()
 			continue
 		}
 
-		work := Job{PredictionRequest: predictionRequest}
-		if predictionRequest.Type == "classification" {
-			jobQueue <- work
-		} else if predictionRequest.Type == "nsfw-classification" {
-			nsfwJobQueue <- work
-		} else {
+		work := Job{PredictionRequest: predictionRequest, Item: data, Queue: queue}
+
+		//only jobs that were queued before every model had its own queue can belong to another model
+		target, ok := dispatchers[predictionRequest.Type]
+		if !ok {
 			log.Error("Invalid classification type: ", predictionRequest.Type)
+			ackJob(redisConn, work)
+			redisConn.Close()
+			continue
 		}
 
+		//the lease is renewed while the job waits in the job queue, until a worker processed it
+		leases.hold(queue, data)
+		if target.trySubmit(work) {
+			redisConn.Close()
+			continue
+		}
+		leases.release(queue, data)
+
+		//all workers are busy and their job queue is full. Instead of waiting with the job
+		//in hand (while its visibility timeout expires), we put it back into the redis queue
+		//(where other workers can take it) and wait until we have capacity again.
+		log.Debug("Job queue of ", target.model, " is full - putting job back into queue")
+		jobsReleasedTotal.WithLabelValues(target.model).Inc()
+		err = queue.Release(redisConn, data)
+		if err != nil {
+			//the job is handed out again once its visibility timeout expired
+			log.Error("Couldn't put job back into queue: ", err.Error())
+			raven.CaptureError(err, nil)
+		}
 		redisConn.Close()
+
+		for target.full() {
+			if !sleep(100*time.Millisecond, stop) {
+				return
+			}
+		}
 	}
+}
 
+//sleep waits for the given duration. Returns false if we were asked to stop in the meantime.
+func sleep(duration time.Duration, stop <-chan struct{}) bool {
+	select {
+	case <-stop:
+		return false
+	case <-time.After(duration):
+		return true
+	}
 }
@@ -2,25 +2,34 @@ package main
 
 import (
 	"encoding/json"
+	commons "github.com/bbernhard/imagemonkey-playground/commons"
 	datastructures "github.com/bbernhard/imagemonkey-playground/datastructures"
-	log "github.com/sirupsen/logrus"
+	"github.com/garyburd/redigo/redis"
 	"github.com/getsentry/raven-go"
-	"os"
+	log "github.com/sirupsen/logrus"
+	"sync"
+	"time"
 )
 
 // Job holds the attributes needed to perform unit of work.
 type Job struct {
 	PredictionRequest datastructures.PredictionRequest
+	Item              []byte                //as taken from the queue, needed for the acknowledgement
+	Queue             commons.ReliableQueue //the queue the job was taken from
 }
 
 // NewWorker creates takes a numeric id and a channel w/ worker pool.
-func NewWorker(id int, workerPool chan chan Job, modelDir string) Worker {
+func NewWorker(id int, workerPool chan chan Job, modelDir string, model string, pending *sync.WaitGroup,
+	running *sync.WaitGroup) Worker {
 	return Worker{
 		id:         id,
 		jobQueue:   make(chan Job),
 		workerPool: workerPool,
 		quitChan:   make(chan bool),
 		modelDir:   modelDir,
+		model:      model,
+		pending:    pending,
+		running:    running,
 	}
 }
 
@@ -30,14 +39,26 @@ type Worker struct {
 	workerPool chan chan Job
 	quitChan   chan bool
 	modelDir   string
+	model      string
+	pending    *sync.WaitGroup //jobs that were submitted, but aren't processed yet
+	running    *sync.WaitGroup //workers that haven't stopped yet
 }
 
-func (w Worker) start() {
+//start loads the model and starts processing jobs. Returns an error if the model couldn't be loaded.
+func (w Worker) start() error {
 	log.Debug("[Worker] Worker ", w.id, " starting")
-	predictor := NewTensorflowPredictor()
-	predictor.Load(w.modelDir)
+	predictor := NewTensorflowPredictor(w.model)
+	err := predictor.Load(w.modelDir)
+	if err != nil {
+		predictor.Close()
+		return err
+	}
 
+	w.running.Add(1)
 	go func() {
+		defer w.running.Done()
+		defer predictor.Close()
+
 		for {
 			// Add my jobQueue to the worker pool.
 			w.workerPool <- w.jobQueue
@@ -45,38 +66,8 @@ func (w Worker) start() {
 			select {
 			case job := <-w.jobQueue:
 				// Dispatcher has added a job to my jobQueue.
-				tfResult, err := predictor.Predict(job.PredictionRequest.Filename)
-				if err == nil {
-					redisConn := redisPool.Get()
-
-					var predictionResult datastructures.PredictionResult
-					predictionResult.Uuid = job.PredictionRequest.Uuid
-					predictionResult.Result = tfResult
-					predictionResult.ModelInfo = predictor.modelInfo
-
-					serialized, err := json.Marshal(predictionResult)
-					if err != nil {
-						log.Error("[Worker] Couldn't marshal prediction result: ", err.Error())
-						raven.CaptureError(err, nil)
-					} else {
-						//store result with an expiration time of 1hr...it doesn't make sense to store it longer
-						//than that.
-						_, err = redisConn.Do("SETEX", ("predict" + job.PredictionRequest.Uuid), 3600, serialized)
-						if err != nil {
-							log.Error("[Worker] Couldn't set marshal result: ", err.Error())
-							raven.CaptureError(err, nil)
-						} else { //successfully predicted, remove file
-							err = os.Remove(job.PredictionRequest.Filename)
-							if err != nil {
-								log.Error("[Worker] Couldn't remove file ", err.Error())
-								raven.CaptureError(err, nil)
-							}
-						}
-					}
-				} else {
-					log.Error("[Worker] Couln't predict: ", err.Error())
-					raven.CaptureError(err, nil)
-				}
+				w.process(predictor, job)
+				w.pending.Done()
 
 			case <-w.quitChan:
 				// We have been asked to stop.
@@ -85,6 +76,199 @@ func (w Worker) start() {
 			}
 		}
 	}()
+
+	return nil
+}
+
+func (w Worker) process(predictor *TensorflowPredictor, job Job) {
+	pendingJobs.WithLabelValues(w.model).Dec()
+	busyWorkers.WithLabelValues(w.model).Inc()
+	defer busyWorkers.WithLabelValues(w.model).Dec()
+
+	redisConn := redisPool.Get()
+	defer redisConn.Close()
+	defer leases.release(job.Queue, job.Item)
+
+	//the job might have waited in the job queue for a while
+	leased, err := job.Queue.Extend(redisConn, job.Item, leases.visibilityTimeout)
+	if err != nil {
+		log.Error("[Worker] Couldn't extend lease: ", err.Error())
+		raven.CaptureError(err, nil)
+	} else if !leased {
+		//the job was handed to another worker (or given up on), which is responsible for it now
+		log.Info("[Worker] Lease of job ", job.PredictionRequest.Uuid, " expired - skipping it")
+		return
+	}
+
+	//whatever happens, the job is finished once we return
+	defer ackJob(redisConn, job)
+
+	//a job can be delivered more than once, e.g. if we were too slow to acknowledge it
+	jobState, found, err := commons.GetJobState(redisConn, job.PredictionRequest.Uuid)
+	if err != nil {
+		log.Error("[Worker] Couldn't get job state: ", err.Error())
+		raven.CaptureError(err, nil)
+	} else if found && commons.IsFinalJobState(jobState.State) {
+		log.Info("[Worker] Job ", job.PredictionRequest.Uuid, " is already ", jobState.State, " - skipping it")
+		return
+	}
+
+	w.setJobState(redisConn, job, commons.JobStateProcessing, "")
+
+	tfResults, err := predictStoredImage(predictor, job.PredictionRequest)
+
+	var predictionResult datastructures.PredictionResult
+	predictionResult.Uuid = job.PredictionRequest.Uuid
+	predictionResult.ModelInfo = predictor.modelInfo
+	if err == nil {
+		predictionResult.Result = tfResults[0]
+		predictionResult.Predictions = tfResults
+	} else {
+		log.Error("[Worker] Couln't predict: ", err.Error())
+		raven.CaptureError(err, nil)
+
+		code := getPredictionErrorCode(err)
+		predictionFailuresTotal.WithLabelValues(w.model, code).Inc()
+
+		//persist the failure, so that the client knows that it can stop polling
+		predictionResult.Error = &datastructures.PredictionFailure{
+			Code:       code,
+			Message:    getPredictionErrorMessage(code),
+			ModelBuild: predictor.modelInfo.Build,
+		}
+	}
+
+	serialized, err := json.Marshal(predictionResult)
+	if err != nil {
+		log.Error("[Worker] Couldn't marshal prediction result: ", err.Error())
+		raven.CaptureError(err, nil)
+		w.setJobState(redisConn, job, commons.JobStateFailed, "Couldn't process request")
+		return
+	}
+
+	//store result with an expiration time of 1hr...it doesn't make sense to store it longer
+	//than that.
+	_, err = redisConn.Do("SETEX", ("predict" + job.PredictionRequest.Uuid), 3600, serialized)
+	if err != nil {
+		log.Error("[Worker] Couldn't set marshal result: ", err.Error())
+		raven.CaptureError(err, nil)
+		w.setJobState(redisConn, job, commons.JobStateFailed, "Couldn't process request")
+		return
+	}
+
+	if predictionResult.Error == nil {
+		w.setJobState(redisConn, job, commons.JobStateDone, "")
+	} else {
+		w.setJobState(redisConn, job, commons.JobStateFailed, predictionResult.Error.Message)
+	}
+
+	//result is persisted, remove image
+	err = imageStorage.Delete(job.PredictionRequest.Filename)
+	if err != nil {
+		log.Error("[Worker] Couldn't remove image ", err.Error())
+		raven.CaptureError(err, nil)
+	}
+}
+
+//predictStoredImage fetches the image of the request from the storage and predicts its labels
+func predictStoredImage(predictor *TensorflowPredictor, predictionRequest datastructures.PredictionRequest) ([]datastructures.TFResult, error) {
+	image, err := imageStorage.Get(predictionRequest.Filename)
+	if err != nil {
+		return nil, &PredictionError{Code: PredictionErrorImageUnavailable, Err: err}
+	}
+	defer image.Close()
+
+	return predictor.Predict(image, predictionRequest.TopK)
+}
+
+func (w Worker) setJobState(redisConn redis.Conn, job Job, state string, errMsg string) {
+	if state == commons.JobStateDone || state == commons.JobStateFailed {
+		jobsProcessedTotal.WithLabelValues(w.model, state).Inc()
+	}
+
+	err := commons.UpdateJobState(redisConn, job.PredictionRequest.Uuid, state, errMsg)
+	if err != nil {
+		log.Error("[Worker] Couldn't update job state: ", err.Error())
+		raven.CaptureError(err, nil)
+	}
+}
+
+//ackJob removes the job from the queue, so that it isn't handed to another worker
+func ackJob(redisConn redis.Conn, job Job) {
+	err := job.Queue.Ack(redisConn, job.Item)
+	if err != nil {
+		log.Error("[Worker] Couldn't acknowledge job: ", err.Error())
+		raven.CaptureError(err, nil)
+	}
+}
+
+//leaseKeeper renews the leases of the jobs we took from the queue until they are processed,
+//so that jobs that wait in a job queue (or take long) aren't handed to another worker
+type leaseKeeper struct {
+	visibilityTimeout time.Duration
+	mutex             sync.Mutex
+	items             map[leasedItem]int //number of times we hold the item
+}
+
+type leasedItem struct {
+	queue commons.ReliableQueue
+	item  string
+}
+
+func newLeaseKeeper(visibilityTimeout time.Duration) *leaseKeeper {
+	return &leaseKeeper{visibilityTimeout: visibilityTimeout, items: make(map[leasedItem]int)}
+}
+
+//hold renews the lease of the item until it's released
+func (l *leaseKeeper) hold(queue commons.ReliableQueue, item []byte) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.items[leasedItem{queue: queue, item: string(item)}]++
+}
+
+func (l *leaseKeeper) release(queue commons.ReliableQueue, item []byte) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	key := leasedItem{queue: queue, item: string(item)}
+	l.items[key]--
+	if l.items[key] <= 0 {
+		delete(l.items, key)
+	}
+}
+
+//run renews the leases three times per visibility timeout, so that a renewal can fail
+//without the lease expiring
+func (l *leaseKeeper) run() {
+	interval := l.visibilityTimeout / 3
+	if interval < time.Second {
+		interval = time.Second
+	}
+
+	for range time.Tick(interval) {
+		l.renew()
+	}
+}
+
+func (l *leaseKeeper) renew() {
+	l.mutex.Lock()
+	items := make([]leasedItem, 0, len(l.items))
+	for item := range l.items {
+		items = append(items, item)
+	}
+	l.mutex.Unlock()
+
+	redisConn := redisPool.Get()
+	defer redisConn.Close()
+
+	for _, item := range items {
+		//if the lease expired nevertheless, process skips the job
+		_, err := item.queue.Extend(redisConn, []byte(item.item), l.visibilityTimeout)
+		if err != nil {
+			log.Error("[Worker] Couldn't renew lease: ", err.Error())
+			raven.CaptureError(err, nil)
+			return
+		}
+	}
 }
 
 func (w Worker) stop() {
@@ -94,7 +278,7 @@ func (w Worker) stop() {
 }
 
 // NewDispatcher creates, and returns a new Dispatcher object.
-func NewDispatcher(jobQueue chan Job, maxWorkers int, modelDir string) *Dispatcher {
+func NewDispatcher(jobQueue chan Job, maxWorkers int, modelDir string, model string) *Dispatcher {
 	workerPool := make(chan chan Job, maxWorkers)
 
 	return &Dispatcher{
@@ -102,6 +286,7 @@ func NewDispatcher(jobQueue chan Job, maxWorkers int, modelDir string) *Dispatch
 		maxWorkers: maxWorkers,
 		workerPool: workerPool,
 		modelDir:   modelDir,
+		model:      model,
 	}
 }
 
@@ -110,27 +295,64 @@ type Dispatcher struct {
 	maxWorkers int
 	jobQueue   chan Job
 	modelDir   string
+	model      string
+	workers    []Worker
+	pending    sync.WaitGroup
+	running    sync.WaitGroup
 }
 
-func (d *Dispatcher) run() {
+//run starts the workers. Returns an error if a worker couldn't load its model.
+func (d *Dispatcher) run() error {
 	for i := 0; i < d.maxWorkers; i++ {
-		worker := NewWorker(i+1, d.workerPool, d.modelDir)
-		worker.start()
+		worker := NewWorker(i+1, d.workerPool, d.modelDir, d.model, &d.pending, &d.running)
+		err := worker.start()
+		if err != nil {
+			return err
+		}
+		d.workers = append(d.workers, worker)
 	}
+	workers.WithLabelValues(d.model).Set(float64(d.maxWorkers))
 
 	go d.dispatch()
+	return nil
+}
+
+//trySubmit hands the job over to the next free worker. Returns false (without blocking) if
+//the job queue of the dispatcher is full.
+func (d *Dispatcher) trySubmit(job Job) bool {
+	d.pending.Add(1)
+	select {
+	case d.jobQueue <- job:
+		pendingJobs.WithLabelValues(d.model).Inc()
+		return true
+	default:
+		d.pending.Done()
+		return false
+	}
 }
 
+//full returns true if the job queue of the dispatcher is full
+func (d *Dispatcher) full() bool {
+	return len(d.jobQueue) == cap(d.jobQueue)
+}
+
+//stop waits until all submitted jobs are processed and stops the workers afterwards.
+//No jobs must be submitted once stop was called.
+func (d *Dispatcher) stop() {
+	d.pending.Wait()
+
+	for _, worker := range d.workers {
+		worker.stop()
+	}
+	d.running.Wait()
+}
+
+//dispatch takes the next job from the job queue as soon as a worker is free. Jobs wait in
+//the job queue until then, so that the job queue fills up when all workers are busy.
 func (d *Dispatcher) dispatch() {
 	for {
-		select {
-		case job := <-d.jobQueue:
-			go func() {
-				//fmt.Printf("fetching workerJobQueue for: %s\n", job.id)
-				workerJobQueue := <-d.workerPool
-				//fmt.Printf("adding %s to workerJobQueue\n", job.Name)
-				workerJobQueue <- job
-			}()
-		}
+		workerJobQueue := <-d.workerPool
+		job := <-d.jobQueue
+		workerJobQueue <- job
 	}
 }
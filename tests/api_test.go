@@ -1,29 +1,49 @@
 package tests
 
 import (
+	"bufio"
 	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
 	datastructures "github.com/bbernhard/imagemonkey-playground/datastructures"
 	"github.com/go-resty/resty/v2"
 	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
 	"testing"
 	"time"
 )
 
 func testPostGrabcut(t *testing.T, imageUuid string, pathToGrabcutMask string) string {
+	//request succeeds with status code 202. grabcut processing happens asynchronously
+	return testPostGrabcutWithStatusCode(t, imageUuid, pathToGrabcutMask, 202)
+}
+
+func testPostGrabcutWithStatusCode(t *testing.T, imageUuid string, pathToGrabcutMask string, expectedStatusCode int) string {
+	return testPostGrabcutWithFormData(t, map[string]string{"uuid": imageUuid}, pathToGrabcutMask, expectedStatusCode)
+}
+
+func testPostGrabcutWithFormData(t *testing.T, formData map[string]string, pathToGrabcutMask string, expectedStatusCode int) string {
 	url := "http://127.0.0.1:8079/v1/grabcut"
 
-	imgBytes, err := ioutil.ReadFile(pathToGrabcutMask)
-	ok(t, err)
+	req := resty.New().R().SetFormData(formData)
+	if pathToGrabcutMask != "" { //otherwise the mask is passed as strokes
+		imgBytes, err := ioutil.ReadFile(pathToGrabcutMask)
+		ok(t, err)
+		req.SetFileReader("image", "grabcut.png", bytes.NewReader(imgBytes))
+	}
 
-	client := resty.New()
-	resp, err := client.R().
-		SetFileReader("image", "grabcut.png", bytes.NewReader(imgBytes)).
-		SetFormData(map[string]string{
-			"uuid": imageUuid,
-		}).Post(url)
+	resp, err := req.Post(url)
 
 	ok(t, err)
-	equals(t, resp.StatusCode(), 202) //request always succeeds with status code 202. grabcut processing happens asynchronously
+	equals(t, resp.StatusCode(), expectedStatusCode)
+	if expectedStatusCode != 202 {
+		return ""
+	}
 
 	if _, ok := resp.Header()["Location"]; ok {
 		h := resp.Header()["Location"]
@@ -45,7 +65,8 @@ type GrabcutMeResult struct {
 func testGetGrabcut(t *testing.T, uuid string) GrabcutMeResult {
 	var res GrabcutMeResult
 
-	url := "http://127.0.0.1:8079/v1/grabcut/" + uuid
+	//block until the grabcut is done, instead of sleeping a fixed time
+	url := "http://127.0.0.1:8079/v1/grabcut/" + uuid + "?wait=30"
 
 	client := resty.New()
 	resp, err := client.R().
@@ -59,6 +80,10 @@ func testGetGrabcut(t *testing.T, uuid string) GrabcutMeResult {
 }
 
 func testPostPredict(t *testing.T, predictionType string, pathToImage string) string {
+	return testPostPredictWithFormData(t, map[string]string{}, pathToImage)
+}
+
+func testPostPredictWithFormData(t *testing.T, formData map[string]string, pathToImage string) string {
 	url := "http://127.0.0.1:8079/v1/predict"
 
 	imgBytes, err := ioutil.ReadFile(pathToImage)
@@ -67,6 +92,7 @@ func testPostPredict(t *testing.T, predictionType string, pathToImage string) st
 	client := resty.New()
 	resp, err := client.R().
 		SetFileReader("image", "predict.png", bytes.NewReader(imgBytes)).
+		SetFormData(formData).
 		Post(url)
 
 	ok(t, err)
@@ -87,7 +113,8 @@ func testPostPredict(t *testing.T, predictionType string, pathToImage string) st
 func testGetPredict(t *testing.T, uuid string) datastructures.PredictMeResult {
 	var res datastructures.PredictMeResult
 
-	url := "http://127.0.0.1:8079/v1/predict/" + uuid
+	//block until the prediction is done, instead of sleeping a fixed time
+	url := "http://127.0.0.1:8079/v1/predict/" + uuid + "?wait=30"
 
 	client := resty.New()
 	resp, err := client.R().
@@ -101,33 +128,435 @@ func testGetPredict(t *testing.T, uuid string) datastructures.PredictMeResult {
 }
 
 func TestGrabcutFailsDueToNotExistingImage(t *testing.T) {
-	uuid := testPostGrabcut(t, "not-existing.jpeg", "./images/grabcut/apple.png")
-	
-	//grabcut takes a few seconds
-	time.Sleep(5 * time.Second)
+	testPostGrabcutWithStatusCode(t, "not-existing.jpeg", "./images/grabcut/apple.png", 404)
+}
 
-	res := testGetGrabcut(t, uuid)
-	equals(t, res.Error, "Couldn't process request")
+func TestGrabcutFailsDueToInvalidUuid(t *testing.T) {
+	testPostGrabcutWithStatusCode(t, "../../etc/passwd", "./images/grabcut/apple.png", 422)
+	testPostGrabcutWithStatusCode(t, "/etc/passwd", "./images/grabcut/apple.png", 422)
 }
 
 func TestGrabcutSucceeds(t *testing.T) {
 	uuid := testPostGrabcut(t, "apple1.jpeg", "./images/grabcut/apple.png")
-	
-	//grabcut takes a few seconds
-	time.Sleep(5 * time.Second)
 
 	res := testGetGrabcut(t, uuid)
 	equals(t, res.Error, "")
 	notEquals(t, len(res.Result.Points), 0)
 }
 
+func TestGrabcutMaxVertices(t *testing.T) {
+	uuid := testPostGrabcutWithFormData(t, map[string]string{"uuid": "apple1.jpeg", "max_vertices": "10"},
+		"./images/grabcut/apple.png", 202)
+
+	res := testGetGrabcut(t, uuid)
+	equals(t, res.Error, "")
+	equals(t, res.Result.Vertices, len(res.Result.Points))
+	equals(t, res.Result.Vertices <= 10, true)
+	equals(t, res.Result.OriginalVertices >= res.Result.Vertices, true)
+}
+
+func TestGrabcutAllPolygons(t *testing.T) {
+	uuid := testPostGrabcutWithFormData(t, map[string]string{"uuid": "apple1.jpeg", "polygons": "all"},
+		"./images/grabcut/apple.png", 202)
+
+	res := testGetGrabcut(t, uuid)
+	equals(t, res.Error, "")
+	notEquals(t, len(res.Result.Polygons), 0)
+	equals(t, len(res.Result.Polygons[0].Points), len(res.Result.Points))
+	for i := 1; i < len(res.Result.Polygons); i++ {
+		equals(t, res.Result.Polygons[i-1].Area >= res.Result.Polygons[i].Area, true)
+	}
+}
+
+func TestGrabcutExportGeoJSON(t *testing.T) {
+	uuid := testPostGrabcut(t, "apple1.jpeg", "./images/grabcut/apple.png")
+	testGetGrabcut(t, uuid)
+
+	var feature struct {
+		Type     string `json:"type"`
+		Geometry struct {
+			Type string `json:"type"`
+		} `json:"geometry"`
+	}
+	resp, err := resty.New().R().SetResult(&feature).Get("http://127.0.0.1:8079/v1/grabcut/" + uuid + "?format=geojson")
+	ok(t, err)
+	equals(t, resp.StatusCode(), 200)
+	equals(t, resp.Header().Get("Content-Type"), "application/geo+json")
+	equals(t, feature.Type, "Feature")
+	equals(t, feature.Geometry.Type, "Polygon")
+
+	resp, err = resty.New().R().Get("http://127.0.0.1:8079/v1/grabcut/" + uuid + "?format=kml")
+	ok(t, err)
+	equals(t, resp.StatusCode(), 422)
+}
+
+func TestGrabcutStrokesSucceeds(t *testing.T) {
+	strokes := `{"rectangles": [{"type": "background", "x": 0, "y": 0, "width": 1132, "height": 40}],` +
+		`"strokes": [{"type": "foreground", "width": 20, "points": [[500, 300], [600, 400], [650, 450]]}]}`
+	uuid := testPostGrabcutWithFormData(t, map[string]string{"uuid": "apple1.jpeg", "strokes": strokes}, "", 202)
+
+	res := testGetGrabcut(t, uuid)
+	equals(t, res.Error, "")
+	notEquals(t, len(res.Result.Points), 0)
+}
+
+func TestGrabcutFailsDueToInvalidStrokes(t *testing.T) {
+	testPostGrabcutWithFormData(t, map[string]string{"uuid": "apple1.jpeg", "strokes": `{"strokes": []}`}, "", 422)
+}
+
+func TestGrabcutBoundingBoxSucceeds(t *testing.T) {
+	uuid := testPostGrabcutWithFormData(t, map[string]string{"uuid": "apple1.jpeg", "x": "0.25", "y": "0.2",
+		"width": "0.5", "height": "0.6", "normalized": "true"}, "", 202)
+
+	res := testGetGrabcut(t, uuid)
+	equals(t, res.Error, "")
+	notEquals(t, len(res.Result.Points), 0)
+}
+
+func TestGrabcutFailsDueToInvalidBoundingBox(t *testing.T) {
+	testPostGrabcutWithFormData(t, map[string]string{"uuid": "apple1.jpeg", "x": "1000", "y": "0",
+		"width": "500", "height": "100"}, "", 422)
+}
+
+type GrabcutSessionRound struct {
+	Round  int              `json:"round"`
+	Uuid   string           `json:"uuid"`
+	State  string           `json:"state"`
+	Result *GrabcutMeResult `json:"result"`
+}
+
+type GrabcutSession struct {
+	Uuid   string                `json:"uuid"`
+	Rounds []GrabcutSessionRound `json:"rounds"`
+}
+
+func TestGrabcutSession(t *testing.T) {
+	resp, err := resty.New().R().
+		SetFormData(map[string]string{"uuid": "apple1.jpeg", "x": "0.25", "y": "0.2", "width": "0.5",
+			"height": "0.6", "normalized": "true"}).
+		Post("http://127.0.0.1:8079/v1/grabcut-sessions")
+	ok(t, err)
+	equals(t, resp.StatusCode(), 202)
+	sessionUuid := resp.Header().Get("Location")
+	notEquals(t, sessionUuid, "")
+
+	corrections := `{"strokes": [{"type": "background", "width": 30, "points": [[300, 160], [800, 160]]}]}`
+	resp, err = resty.New().R().
+		SetFormData(map[string]string{"strokes": corrections}).
+		Post("http://127.0.0.1:8079/v1/grabcut-sessions/" + sessionUuid + "/rounds")
+	ok(t, err)
+	equals(t, resp.StatusCode(), 202)
+
+	var res GrabcutSession
+	for i := 0; i < 30; i++ {
+		resp, err = resty.New().R().
+			SetResult(&res).
+			Get("http://127.0.0.1:8079/v1/grabcut-sessions/" + sessionUuid)
+		ok(t, err)
+		equals(t, resp.StatusCode(), 200)
+		if len(res.Rounds) == 2 && res.Rounds[0].Result != nil && res.Rounds[1].Result != nil {
+			break
+		}
+		time.Sleep(time.Second)
+	}
+
+	equals(t, res.Uuid, sessionUuid)
+	equals(t, len(res.Rounds), 2)
+	for i, round := range res.Rounds {
+		equals(t, round.Round, i+1)
+		equals(t, round.State, "done")
+		equals(t, round.Result.Error, "")
+		notEquals(t, len(round.Result.Result.Points), 0)
+	}
+
+	resp, err = resty.New().R().Get("http://127.0.0.1:8079/v1/grabcut-sessions/" + sessionUuid + "/mask")
+	ok(t, err)
+	equals(t, resp.StatusCode(), 200)
+	equals(t, resp.Header().Get("Content-Type"), "image/png")
+}
+
+func TestRefineUnknownGrabcutSession(t *testing.T) {
+	resp, err := resty.New().R().
+		SetFormData(map[string]string{"strokes": `{"rectangles": [{"type": "background", "x": 0, "y": 0, "width": 10, "height": 10}]}`}).
+		Post("http://127.0.0.1:8079/v1/grabcut-sessions/00000000-0000-0000-0000-000000000000/rounds")
+	ok(t, err)
+	equals(t, resp.StatusCode(), 404)
+}
+
+func TestGrabcutFailsDueToInvalidSimplification(t *testing.T) {
+	testPostGrabcutWithFormData(t, map[string]string{"uuid": "apple1.jpeg", "tolerance": "-1"},
+		"./images/grabcut/apple.png", 422)
+}
+
 func TestPredict(t *testing.T) {
 	uuid := testPostPredict(t, "", "./images/apple1.jpeg")
 	notEquals(t, uuid, "")
 
-	//prediction takes a few seconds
-	time.Sleep(5 * time.Second)
+	predictionResult := testGetPredict(t, uuid)
+	equals(t, predictionResult.Label, "apple")
+}
+
+func TestPredictTopK(t *testing.T) {
+	uuid := testPostPredictWithFormData(t, map[string]string{"top_k": "3"}, "./images/apple1.jpeg")
+	notEquals(t, uuid, "")
 
 	predictionResult := testGetPredict(t, uuid)
 	equals(t, predictionResult.Label, "apple")
+	equals(t, len(predictionResult.Predictions), 3)
+	equals(t, predictionResult.Predictions[0].Label, predictionResult.Label)
+	assert(t, predictionResult.Predictions[0].Score >= predictionResult.Predictions[1].Score, "predictions not sorted by score")
+}
+
+func TestPredictWithInvalidTopK(t *testing.T) {
+	imgBytes, err := ioutil.ReadFile("./images/apple1.jpeg")
+	ok(t, err)
+
+	resp, err := resty.New().R().
+		SetFileReader("image", "predict.png", bytes.NewReader(imgBytes)).
+		SetFormData(map[string]string{"top_k": "0"}).
+		Post("http://127.0.0.1:8079/v1/predict")
+	ok(t, err)
+	equals(t, resp.StatusCode(), 422)
+}
+
+func TestGetPredictWithUnknownUuid(t *testing.T) {
+	resp, err := resty.New().R().
+		Get("http://127.0.0.1:8079/v1/predict/00000000-0000-0000-0000-000000000000")
+	ok(t, err)
+	equals(t, resp.StatusCode(), 404)
+}
+
+func TestGetGrabcutWithUnknownUuid(t *testing.T) {
+	resp, err := resty.New().R().
+		Get("http://127.0.0.1:8079/v1/grabcut/00000000-0000-0000-0000-000000000000")
+	ok(t, err)
+	equals(t, resp.StatusCode(), 404)
+}
+
+func TestGetPredictWhileInProgress(t *testing.T) {
+	uuid := testPostPredict(t, "", "./images/apple1.jpeg")
+
+	var res map[string]interface{}
+	resp, err := resty.New().R().
+		SetResult(&res).
+		Get("http://127.0.0.1:8079/v1/predict/" + uuid)
+	ok(t, err)
+	//the worker might already be done, depending on how fast it is
+	if resp.StatusCode() == 202 {
+		assert(t, res["state"] == "queued" || res["state"] == "processing", "unexpected state %v", res["state"])
+	} else {
+		equals(t, resp.StatusCode(), 200)
+	}
+}
+
+func TestPredictFailsDueToInvalidImage(t *testing.T) {
+	imgBytes, err := ioutil.ReadFile("./images/apple1.jpeg")
+	ok(t, err)
+
+	//a truncated jpeg passes the upload validation (the header is fine), but can't be decoded by the worker
+	resp, err := resty.New().R().
+		SetFileReader("image", "predict.jpeg", bytes.NewReader(imgBytes[:4000])).
+		Post("http://127.0.0.1:8079/v1/predict")
+	ok(t, err)
+	equals(t, resp.StatusCode(), 202)
+	uuid := resp.Header().Get("Location")
+	notEquals(t, uuid, "")
+
+	predictionResult := testGetPredict(t, uuid)
+	notEquals(t, predictionResult.Error, (*datastructures.PredictionFailure)(nil))
+	equals(t, predictionResult.Error.Code, "invalid_image")
+}
+
+func TestGetPredictWithInvalidWait(t *testing.T) {
+	uuid := testPostPredict(t, "", "./images/apple1.jpeg")
+
+	resp, err := resty.New().R().
+		Get("http://127.0.0.1:8079/v1/predict/" + uuid + "?wait=abc")
+	ok(t, err)
+	equals(t, resp.StatusCode(), 422)
+}
+
+func TestPredictEventStream(t *testing.T) {
+	uuid := testPostPredict(t, "", "./images/apple1.jpeg")
+
+	resp, err := http.Get("http://127.0.0.1:8079/v1/jobs/" + uuid + "/events")
+	ok(t, err)
+	defer resp.Body.Close()
+	equals(t, resp.StatusCode, 200)
+
+	//the stream is closed by the server after the result was sent
+	events := []string{}
+	scanner := bufio.NewScanner(resp.Body)
+	for scanner.Scan() {
+		if strings.HasPrefix(scanner.Text(), "event:") {
+			events = append(events, strings.TrimPrefix(scanner.Text(), "event:"))
+		}
+	}
+	ok(t, scanner.Err())
+
+	assert(t, len(events) >= 2, "expected at least two events, got %v", events)
+	equals(t, events[len(events)-2], "state")
+	equals(t, events[len(events)-1], "result")
+}
+
+func TestPredictWithCallbackUrl(t *testing.T) {
+	type webhook struct {
+		body      []byte
+		signature string
+		timestamp string
+	}
+	webhooks := make(chan webhook, 1)
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		webhooks <- webhook{body: body, signature: r.Header.Get("X-Playground-Signature"),
+			timestamp: r.Header.Get("X-Playground-Timestamp")}
+	}))
+	defer receiver.Close()
+
+	uuid := testPostPredictWithFormData(t, map[string]string{"callback_url": receiver.URL}, "./images/apple1.jpeg")
+
+	select {
+	case w := <-webhooks:
+		mac := hmac.New(sha256.New, []byte(os.Getenv("WEBHOOK_SECRET")))
+		mac.Write([]byte(w.timestamp + "."))
+		mac.Write(w.body)
+		equals(t, w.signature, "sha256="+hex.EncodeToString(mac.Sum(nil)))
+
+		var predictionResult datastructures.PredictMeResult
+		ok(t, json.Unmarshal(w.body, &predictionResult))
+		equals(t, predictionResult.Label, "apple")
+	case <-time.After(30 * time.Second):
+		t.Fatal("webhook wasn't delivered")
+	}
+
+	//the delivery log is written after the receiver answered
+	var res map[string][]datastructures.WebhookDeliveryAttempt
+	for i := 0; i < 10 && len(res["attempts"]) == 0; i++ {
+		time.Sleep(500 * time.Millisecond)
+		resp, err := resty.New().R().
+			SetResult(&res).
+			Get("http://127.0.0.1:8079/v1/jobs/" + uuid + "/webhook")
+		ok(t, err)
+		equals(t, resp.StatusCode(), 200)
+	}
+	equals(t, len(res["attempts"]), 1)
+	equals(t, res["attempts"][0].StatusCode, 200)
+}
+
+func TestPredictWithInvalidCallbackUrl(t *testing.T) {
+	imgBytes, err := ioutil.ReadFile("./images/apple1.jpeg")
+	ok(t, err)
+
+	resp, err := resty.New().R().
+		SetFileReader("image", "predict.png", bytes.NewReader(imgBytes)).
+		SetFormData(map[string]string{"callback_url": "ftp://127.0.0.1/hook"}).
+		Post("http://127.0.0.1:8079/v1/predict")
+	ok(t, err)
+	equals(t, resp.StatusCode(), 422)
+}
+
+type PredictionBatchProgress struct {
+	Total    int `json:"total"`
+	Done     int `json:"done"`
+	Finished int `json:"finished"`
+}
+
+type PredictionBatchItem struct {
+	Uuid   string                         `json:"uuid"`
+	State  string                         `json:"state"`
+	Result datastructures.PredictMeResult `json:"result"`
+}
+
+type PredictionBatchResult struct {
+	Uuid        string                  `json:"uuid"`
+	Progress    PredictionBatchProgress `json:"progress"`
+	Predictions []PredictionBatchItem   `json:"predictions"`
+}
+
+func TestBatchPredict(t *testing.T) {
+	imgBytes, err := ioutil.ReadFile("./images/apple1.jpeg")
+	ok(t, err)
+
+	resp, err := resty.New().R().
+		SetFileReader("image", "apple1.jpeg", bytes.NewReader(imgBytes)).
+		SetFileReader("image", "apple2.jpeg", bytes.NewReader(imgBytes)).
+		Post("http://127.0.0.1:8079/v1/batch/predict")
+	ok(t, err)
+	equals(t, resp.StatusCode(), 202)
+	batchUuid := resp.Header().Get("Location")
+	notEquals(t, batchUuid, "")
+
+	var res PredictionBatchResult
+	for i := 0; i < 30; i++ {
+		resp, err = resty.New().R().
+			SetResult(&res).
+			Get("http://127.0.0.1:8079/v1/batch/predict/" + batchUuid)
+		ok(t, err)
+		equals(t, resp.StatusCode(), 200)
+		if res.Progress.Finished == res.Progress.Total {
+			break
+		}
+		time.Sleep(time.Second)
+	}
+
+	equals(t, res.Progress.Total, 2)
+	equals(t, res.Progress.Done, 2)
+	equals(t, len(res.Predictions), 2)
+	for _, prediction := range res.Predictions {
+		equals(t, prediction.State, "done")
+		equals(t, prediction.Result.Label, "apple")
+	}
+}
+
+func TestPredictRejectsNonImage(t *testing.T) {
+	var res map[string]string
+	resp, err := resty.New().R().
+		SetFileReader("image", "predict.png", bytes.NewReader([]byte("this is not an image"))).
+		SetError(&res).
+		Post("http://127.0.0.1:8079/v1/predict")
+	ok(t, err)
+	equals(t, resp.StatusCode(), 415)
+	equals(t, res["reason"], "unsupported_media_type")
+}
+
+func TestPredictRejectsTooLargeImage(t *testing.T) {
+	var res map[string]string
+	resp, err := resty.New().R().
+		SetFileReader("image", "predict.png", bytes.NewReader(make([]byte, 6*1024*1024))).
+		SetError(&res).
+		Post("http://127.0.0.1:8079/v1/predict")
+	ok(t, err)
+	equals(t, resp.StatusCode(), 413)
+	equals(t, res["reason"], "file_too_large")
+}
+
+func TestRateLimitHeaders(t *testing.T) {
+	resp, err := resty.New().R().
+		Get("http://127.0.0.1:8079/v1/predict/00000000-0000-0000-0000-000000000000")
+	ok(t, err)
+	equals(t, resp.StatusCode(), 404)
+	notEquals(t, resp.Header().Get("RateLimit-Limit"), "")
+	notEquals(t, resp.Header().Get("RateLimit-Remaining"), "")
+	notEquals(t, resp.Header().Get("RateLimit-Reset"), "")
+}
+
+func TestHealthz(t *testing.T) {
+	resp, err := resty.New().R().Get("http://127.0.0.1:8079/healthz")
+	ok(t, err)
+	equals(t, resp.StatusCode(), 200)
+}
+
+func TestReadyz(t *testing.T) {
+	var health struct {
+		Status  string `json:"status"`
+		Workers map[string]struct {
+			Active int `json:"active"`
+		} `json:"workers"`
+	}
+
+	resp, err := resty.New().R().SetResult(&health).Get("http://127.0.0.1:8079/readyz")
+	ok(t, err)
+	equals(t, resp.StatusCode(), 200)
+	equals(t, health.Status, "ok")
+	assert(t, health.Workers["predict"].Active > 0, "expected at least one predict worker")
 }